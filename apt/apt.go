@@ -1,75 +1,27 @@
 package apt
 
 import (
-	"archive/tar"
-	"bytes"
-	"compress/gzip"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"path"
 	"strconv"
 	"strings"
 
+	"github.com/subutai-io/cdn/auth"
 	"github.com/subutai-io/cdn/config"
 	"github.com/subutai-io/cdn/db"
+	"github.com/subutai-io/cdn/deb822"
 	"github.com/subutai-io/cdn/download"
 	"github.com/subutai-io/cdn/upload"
+	"github.com/subutai-io/cdn/utils"
 
-	"os/exec"
-
-	"github.com/mkrautz/goar"
 	"github.com/satori/go.uuid"
 	"github.com/subutai-io/agent/log"
 )
 
-func readDeb(hash string) (control bytes.Buffer, err error) {
-	file, err := os.Open(config.Storage.Path + hash)
-	log.Check(log.WarnLevel, "Opening deb package", err)
-
-	defer file.Close()
-
-	library := ar.NewReader(file)
-	for header, err := library.Next(); err != io.EOF; header, err = library.Next() {
-		if err != nil {
-			return control, err
-		}
-		if header.Name == "control.tar.gz" {
-			ungzip, err := gzip.NewReader(library)
-			if err != nil {
-				return control, err
-			}
-
-			defer ungzip.Close()
-
-			tr := tar.NewReader(ungzip)
-			for tarHeader, err := tr.Next(); err != io.EOF; tarHeader, err = tr.Next() {
-				if err != nil {
-					return control, err
-				}
-				if tarHeader.Name == "./control" {
-					if _, err := io.Copy(&control, tr); err != nil {
-						return control, err
-					}
-					break
-				}
-			}
-		}
-	}
-	return
-}
-
-func getControl(control bytes.Buffer) map[string]string {
-	d := make(map[string]string)
-	for _, v := range strings.Split(control.String(), "\n") {
-		line := strings.Split(v, ":")
-		if len(line) > 1 {
-			d[line[0]] = strings.TrimPrefix(line[1], " ")
-		}
-	}
-	return d
-}
-
 func getSize(file string) (size int) {
 	f, err := os.Open(file)
 	if !log.Check(log.WarnLevel, "Opening file "+file, err) {
@@ -89,6 +41,12 @@ func Upload(w http.ResponseWriter, r *http.Request) {
 			w.Write([]byte("Failed to upload apt with the same name"))
 			return
 		}
+		suites, comp, ok := uploadTarget(r.FormValue("suite"), r.FormValue("component"))
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Invalid suite or component name"))
+			return
+		}
 		md5, sha256, owner := upload.Handler(w, r)
 		if len(md5) == 0 || len(sha256) == 0 {
 			log.Info("Md5 or sha256 is empty. Failed to calculate the hash")
@@ -98,16 +56,30 @@ func Upload(w http.ResponseWriter, r *http.Request) {
 		control, err := readDeb(header.Filename)
 		if err != nil {
 			log.Warn("Reading deb package finished with error: ", err.Error())
-			w.WriteHeader(http.StatusUnsupportedMediaType)
-			w.Write([]byte(err.Error()))
-			if db.Delete(owner, "apt", md5) == 0 {
-				log.Info(fmt.Sprintf("Removed file %v", config.Storage.Path+md5))
-				os.Remove(config.Storage.Path + md5)
+			if _, ok := err.(unsupportedError); ok {
+				w.WriteHeader(http.StatusUnsupportedMediaType)
+			} else {
+				w.WriteHeader(http.StatusBadRequest)
 			}
+			w.Write([]byte(err.Error()))
+			log.Info(fmt.Sprintf("Removed file %v", config.Storage.Path+header.Filename))
+			os.Remove(config.Storage.Path + header.Filename)
 			return
 		}
 		log.Info("Starting to read control file of deb package")
-		meta := getControl(control)
+		paragraph, err := deb822.Parse(control.Bytes())
+		if err != nil {
+			log.Warn("Parsing control file finished with error: ", err.Error())
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			w.Write([]byte("Malformed control file: " + err.Error()))
+			os.Remove(config.Storage.Path + header.Filename)
+			return
+		}
+		meta := map[string]string{}
+		paragraph.Record(meta)
+		if contents, err := readContents(header.Filename); !log.Check(log.WarnLevel, "Reading contents of deb package", err) {
+			meta["contents"] = strings.Join(contents, "\n")
+		}
 		meta["Filename"] = header.Filename
 		meta["Size"] = strconv.Itoa(getSize(config.Storage.Path + header.Filename))
 		meta["SHA512"] = upload.Hash(config.Storage.Path+header.Filename, "sha512")
@@ -115,6 +87,8 @@ func Upload(w http.ResponseWriter, r *http.Request) {
 		meta["SHA1"] = upload.Hash(config.Storage.Path+header.Filename, "sha1")
 		meta["md5"] = md5
 		meta["type"] = "apt"
+		meta["suite"] = strings.Join(suites, ",")
+		meta["component"] = comp
 		tags := r.FormValue("tag")
 		meta["tag"] = tags
 		my_uuid, err := uuid.NewV4()
@@ -125,50 +99,89 @@ func Upload(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		ID := my_uuid.String()
-		db.AddTag(strings.Split(tags, ","), ID, "apt")
+		artifact := db.Artifact{
+			ID:      ID,
+			Name:    header.Filename,
+			Owner:   owner,
+			Repo:    "apt",
+			Info:    meta,
+			Private: len(r.MultipartForm.Value["private"]) > 0 && r.MultipartForm.Value["private"][0] == "true",
+			Size:    getSize(config.Storage.Path + header.Filename),
+		}
+		if tags != "" {
+			artifact.Tags = strings.Split(tags, ",")
+		}
 		log.Info(fmt.Sprintf("Writing deb package %v into database", header.Filename))
-		err = db.Write(owner, ID, header.Filename, meta)
+		err = db.Register(artifact)
 		if err != nil {
 			log.Warn("Failed writing record into database")
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte(err.Error()))
+			os.Remove(config.Storage.Path + header.Filename)
 			return
 		}
-		if len(r.MultipartForm.Value["private"]) > 0 && r.MultipartForm.Value["private"][0] == "true" {
-			log.Info("Sharing " + ID + " with " + owner)
-			db.MakePrivate(ID, owner)
-		} else {
-			db.MakePublic(ID, owner)
-		}
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte(ID))
 		log.Info(meta["Filename"] + " saved to apt repo by " + owner)
+		scheduleUpdate(suites)
 	}
 }
 
+// Download serves packages and indexes of apt repo. Debian repository layout is served under the same prefix:
+// dists/<suite>/ contains generated indexes, pool/ resolves package file names to stored packages. Snapshots
+// are served as repositories snapshots/<name>/ with the same layout.
 func Download(w http.ResponseWriter, r *http.Request) {
 	file := r.URL.Query().Get("hash")
 	log.Info(fmt.Sprintf("Starting download the deb package %v", file))
 	if len(file) == 0 {
-		file = strings.TrimPrefix(r.RequestURI, "/kurjun/rest/apt/")
+		file = strings.TrimPrefix(r.URL.Path, "/kurjun/rest/apt/")
 	}
-	size := getSize(config.Storage.Path + "Packages")
-	if file == "Packages" && size == 0 {
-		GenerateReleaseFile()
+	if strings.Contains(file, "..") {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	switch {
+	// Flat Packages index refers to packages in the root, they are resolved like pool/ ones, so trashed packages aren't served
+	case strings.HasPrefix(file, "pool/") || strings.HasPrefix(file, "snapshots/") && strings.Contains(file, "/pool/"),
+		!strings.Contains(file, "/") && strings.HasSuffix(file, ".deb"):
+		name := path.Base(file)
+		if len(db.LastHash(name, "apt")) == 0 {
+			log.Info(fmt.Sprintf("Package %v not found", name))
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		file = name
+	case strings.HasPrefix(file, "dists/"):
+		if _, err := os.Stat(config.Storage.Path + "dists"); os.IsNotExist(err) {
+			GenerateReleaseFile()
+		}
+	case file == "Packages":
+		if getSize(config.Storage.Path+"Packages") == 0 {
+			GenerateReleaseFile()
+		}
 	}
 	log.Info(fmt.Sprintf("Opening file %v", config.Storage.Path+file))
 	if f, err := os.Open(config.Storage.Path + file); err == nil && file != "" {
 		defer f.Close()
-		io.Copy(w, f)
-	} else {
-		log.Info(fmt.Sprintf("File %v not found", config.Storage.Path+file))
-		w.WriteHeader(http.StatusNotFound)
+		if stat, err := f.Stat(); err == nil && !stat.IsDir() {
+			io.Copy(w, f)
+			return
+		}
 	}
+	log.Info(fmt.Sprintf("File %v not found", config.Storage.Path+file))
+	w.WriteHeader(http.StatusNotFound)
 }
 
 func Delete(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "DELETE" {
+		info := db.Info(r.URL.Query().Get("id"))
+		if name := snapshotOf(info["id"]); len(name) != 0 {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte("Package is part of snapshot " + name))
+			return
+		}
 		if hash := upload.Delete(w, r); len(hash) != 0 {
+			scheduleUpdate(suites(info))
 			log.Info(fmt.Sprintf("Removed file with hash %v", hash))
 			w.Write([]byte("Removed"))
 			return
@@ -201,79 +214,100 @@ func List(w http.ResponseWriter, r *http.Request) {
 	w.Write(download.List("apt", r))
 }
 
-func renameOldDebFiles() {
-	log.Info("Starting rename old deb files")
-	list := db.SearchName("")
-	for _, k := range list {
-		if db.CheckRepo("", []string{"apt"}, k) == 0 {
+type contentsItem struct {
+	ID           string   `json:"id"`
+	Package      string   `json:"package"`
+	Version      string   `json:"version"`
+	Architecture string   `json:"architecture"`
+	Suites       []string `json:"suites"`
+	Path         string   `json:"path"`
+}
+
+// Contents answers which packages ship file given by path parameter, result can be narrowed by suite and arch parameters
+func Contents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Incorrect method"))
+		return
+	}
+	file := strings.TrimPrefix(path.Clean("/"+r.URL.Query().Get("path")), "/")
+	if len(file) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Please specify path"))
+		return
+	}
+	suite := r.URL.Query().Get("suite")
+	arch := r.URL.Query().Get("arch")
+	user := auth.RequestOwner(r)
+	items := []contentsItem{}
+	for _, info := range records() {
+		if !db.IsPublic(info["id"]) && !db.CheckShare(info["id"], user) ||
+			len(arch) != 0 && info["Architecture"] != arch && info["Architecture"] != "all" ||
+			len(suite) != 0 && !utils.In([]string{suite}, suites(info)) ||
+			!utils.In([]string{file}, strings.Split(info["contents"], "\n")) {
 			continue
 		}
-		item := download.FormatItem(db.Info(k), "apt")
-		os.Rename(config.Storage.Path+item.Hash.Md5, config.Storage.Path+item.Name)
+		items = append(items, contentsItem{
+			ID:           info["id"],
+			Package:      info["Package"],
+			Version:      info["Version"],
+			Architecture: info["Architecture"],
+			Suites:       suites(info),
+			Path:         "/" + file,
+		})
 	}
-	log.Info("Finished rename old deb packages")
+	js, _ := json.Marshal(items)
+	w.Write(js)
 }
 
+// GenerateReleaseFile regenerates indexes of apt repo, it is run by scheduler
 func GenerateReleaseFile() {
-	log.Warn("Starting GenerateReleaseFiles")
-	cmd := exec.Command("bash", "-c", "dpkg-scanpackages . /dev/null | tee Packages | gzip > Packages.gz")
-	cmd.Dir = config.Storage.Path
-	log.Warn("config.Storage.Path: ", config.Storage.Path)
-	log.Warn("Cmd.Dir: ", cmd.Dir)
-	log.Warn("Running command to run dpkg-scanpackages and waiting for it to finish")
-	err := cmd.Run()
-	if err != nil {
-		log.Fatal(err)
-		log.Info("Can't run dpkg-scanpackages")
-	}
-	log.Warn(fmt.Sprintf("Command to run dpkg-scanpackages finished with error %v", err))
-
-	cmd = exec.Command("bash", "-c", "apt-ftparchive release . > Release")
-	cmd.Dir = config.Storage.Path
-	log.Warn("config.Storage.Path: ", config.Storage.Path)
-	log.Warn("Cmd.Dir: ", cmd.Dir)
-	log.Warn("Running command to run apt-ftparchive and waiting for it to finish")
-	err = cmd.Run()
-	if err != nil {
-		log.Fatal(err)
-		log.Info("Can't run apt-ftparchive")
-	}
-	log.Warn(fmt.Sprintf("Command to run apt-ftparchive finished with error %v", err))
-
-	cmd = exec.Command("bash", "-c", "gpg --batch --yes --armor -u subutai-release@subutai.io -abs -o Release.gpg Release")
-	cmd.Dir = config.Storage.Path
-	log.Warn("config.Storage.Path: ", config.Storage.Path)
-	log.Warn("Cmd.Dir: ", cmd.Dir)
-	log.Warn("Running command to sign Realease file and waiting for it to finish")
-	err = cmd.Run()
-	if err != nil {
-		log.Fatal(err)
-		log.Info("Can't sign Realease file")
+	log.Info("Generating APT indexes")
+	if !log.Check(log.WarnLevel, "Generating APT indexes", generateIndexes()) {
+		log.Info("APT indexes are generated")
 	}
-	log.Warn(fmt.Sprintf("Command to sign Realease file finished with error %v", err))
-	log.Warn("Finished GenerateReleaseFiles")
 }
 
 func Generate(w http.ResponseWriter, r *http.Request) {
 	log.Info("Starting Generate")
-	token := strings.ToLower(r.Header.Get("token"))
-	owner := strings.ToLower(db.TokenOwner(token))
-	if len(token) == 0 || len(owner) == 0 {
+	owner := strings.ToLower(auth.RequestOwner(r))
+	if len(owner) == 0 {
 		log.Warn("Not authorized user wanted to generate release file")
 		w.WriteHeader(http.StatusUnauthorized)
 		w.Write([]byte("Not authorized"))
-		log.Warn(r.RemoteAddr + " - rejecting generate request")
+		log.Warn(utils.ClientIP(r) + " - rejecting generate request")
 		return
 	}
 	if owner != "subutai" && owner != "jenkins" {
 		log.Warn("Not allowed user wanted to generate release file")
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte("Only allowed users can generate release file"))
-		log.Warn(r.RemoteAddr + " - rejecting generate request")
+		log.Warn(utils.ClientIP(r) + " - rejecting generate request")
 		return
 	}
 	log.Info("Generating release file")
-	GenerateReleaseFile()
+	if err := generateIndexes(); log.Check(log.WarnLevel, "Generating APT indexes", err) {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Failed to generate indexes: " + err.Error()))
+		return
+	}
 	w.Write([]byte("New Packages file generated and Release file signed"))
 	log.Info("New Packages file generated and Release file signed")
 }
+
+// Key serves armored public key which signs Release files of suite given by suite parameter, key of the default
+// suite is served if it is omitted
+func Key(w http.ResponseWriter, r *http.Request) {
+	suite := r.URL.Query().Get("suite")
+	if len(suite) == 0 {
+		suite = config.APT.Suite
+	}
+	key, err := publicKey(suite)
+	if log.Check(log.WarnLevel, "Exporting APT public key", err) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Signing key not found"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/pgp-keys")
+	w.Write(key)
+}
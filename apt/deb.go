@@ -0,0 +1,139 @@
+package apt
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/mkrautz/goar"
+	"github.com/subutai-io/cdn/config"
+	"github.com/ulikunitz/xz"
+)
+
+// unsupportedError is returned for packages which are not Debian binary packages or use compression we can't read
+type unsupportedError struct {
+	message string
+}
+
+func (e unsupportedError) Error() string {
+	return e.message
+}
+
+// readDeb reads control file of deb package stored in storage directory
+func readDeb(name string) (control bytes.Buffer, err error) {
+	file, err := os.Open(config.Storage.Path + name)
+	if err != nil {
+		return control, err
+	}
+	defer file.Close()
+	err = debMember(file, "control.tar", func(tr *tar.Reader) error {
+		for header, err := tr.Next(); err != io.EOF; header, err = tr.Next() {
+			if err != nil {
+				return err
+			}
+			if path.Clean(strings.TrimPrefix(header.Name, "./")) == "control" {
+				_, err = io.Copy(&control, tr)
+				return err
+			}
+		}
+		return unsupportedError{"Control file not found in control archive"}
+	})
+	return
+}
+
+// readContents lists files shipped in data archive of deb package stored in storage directory, paths are relative
+// to root directory. Directories are omitted.
+func readContents(name string) (list []string, err error) {
+	file, err := os.Open(config.Storage.Path + name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	err = debMember(file, "data.tar", func(tr *tar.Reader) error {
+		for header, err := tr.Next(); err != io.EOF; header, err = tr.Next() {
+			if err != nil {
+				return err
+			}
+			if header.Typeflag == tar.TypeDir {
+				continue
+			}
+			if p := strings.TrimPrefix(path.Clean("/"+header.Name), "/"); len(p) != 0 {
+				list = append(list, p)
+			}
+		}
+		return nil
+	})
+	sort.Strings(list)
+	return
+}
+
+// debMember checks debian-binary member of deb package and passes decompressed tar archive of member with
+// given name, control.tar or data.tar, to read
+func debMember(file io.Reader, member string, read func(*tar.Reader) error) error {
+	library := ar.NewReader(file)
+	header, err := library.Next()
+	if err != nil {
+		return unsupportedError{fmt.Sprintf("Not a Debian binary package: %v", err)}
+	}
+	if name := strings.TrimSuffix(header.Name, "/"); name != "debian-binary" {
+		return unsupportedError{fmt.Sprintf("Not a Debian binary package: first member is %q instead of debian-binary", name)}
+	}
+	version, err := ioutil.ReadAll(io.LimitReader(library, 16))
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(strings.TrimSpace(string(version)), "2.") {
+		return unsupportedError{fmt.Sprintf("Unsupported Debian binary package format %q", strings.TrimSpace(string(version)))}
+	}
+	for header, err = library.Next(); err != io.EOF; header, err = library.Next() {
+		if err != nil {
+			return err
+		}
+		name := strings.TrimSuffix(header.Name, "/")
+		if !strings.HasPrefix(name, member) {
+			continue
+		}
+		r, closer, err := decompress(library, name, strings.TrimPrefix(name, member))
+		if err != nil {
+			return err
+		}
+		defer closer()
+		return read(tar.NewReader(r))
+	}
+	return unsupportedError{member + " member not found in package"}
+}
+
+// decompress returns reader of tar archive compressed as ext suffix of member name says and function releasing it
+func decompress(r io.Reader, name, ext string) (io.Reader, func(), error) {
+	switch ext {
+	case "":
+		return r, func() {}, nil
+	case ".gz":
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		return gz, func() { gz.Close() }, nil
+	case ".xz":
+		x, err := xz.NewReader(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		return x, func() {}, nil
+	case ".zst":
+		z, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		return z, z.Close, nil
+	}
+	return nil, nil, unsupportedError{fmt.Sprintf("Unsupported compression %q of %s", strings.TrimPrefix(ext, "."), name)}
+}
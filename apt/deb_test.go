@@ -0,0 +1,142 @@
+package apt
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/subutai-io/cdn/config"
+	"github.com/ulikunitz/xz"
+)
+
+const testControl = "Package: winff\nVersion: 1.5.5-1\n"
+
+// testDeb builds deb package with debian-binary member containing version and control archive of given member
+// name, control file is stored in the archive under controlName. Data archive with given files follows it.
+func testDeb(version, member, controlName string, data ...string) []byte {
+	var deb bytes.Buffer
+	deb.WriteString("!<arch>\n")
+	for _, m := range []struct {
+		name string
+		data []byte
+	}{
+		{"debian-binary", []byte(version)},
+		{member, testCompress(filepath.Ext(member), testTar(controlName))},
+		{"data.tar.xz", testCompress(".xz", testTar(data...))},
+	} {
+		fmt.Fprintf(&deb, "%-16s%-12d%-6d%-6d%-8s%-10d`\n", m.name, 0, 0, 0, "100644", len(m.data))
+		deb.Write(m.data)
+		if len(m.data)%2 == 1 {
+			deb.WriteString("\n")
+		}
+	}
+	return deb.Bytes()
+}
+
+// testTar builds tar archive of files with testControl content, names ending with slash are directories
+func testTar(names ...string) []byte {
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	for _, name := range names {
+		if strings.HasSuffix(name, "/") {
+			tw.WriteHeader(&tar.Header{Name: name, Mode: 0755, Typeflag: tar.TypeDir})
+			continue
+		}
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(testControl))})
+		tw.Write([]byte(testControl))
+	}
+	tw.Close()
+	return archive.Bytes()
+}
+
+// testCompress compresses data as file name extension ext says
+func testCompress(ext string, data []byte) []byte {
+	var compressed bytes.Buffer
+	switch ext {
+	case ".gz":
+		w := gzip.NewWriter(&compressed)
+		w.Write(data)
+		w.Close()
+	case ".xz":
+		w, _ := xz.NewWriter(&compressed)
+		w.Write(data)
+		w.Close()
+	case ".zst":
+		w, _ := zstd.NewWriter(&compressed)
+		w.Write(data)
+		w.Close()
+	default:
+		return data
+	}
+	return compressed.Bytes()
+}
+
+func TestReadDeb(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	storage := config.Storage.Path
+	config.Storage.Path = dir + "/"
+	defer func() { config.Storage.Path = storage }()
+	for _, c := range []struct {
+		version, member, control string
+		err                      string
+	}{
+		{"2.0\n", "control.tar.gz", "./control", ""},
+		{"2.0\n", "control.tar.xz", "./control", ""},
+		{"2.0\n", "control.tar.zst", "control", ""},
+		{"2.0\n", "control.tar", "control", ""},
+		{"2.0\n", "control.tar.bz2", "./control", `Unsupported compression "bz2" of control.tar.bz2`},
+		{"3.0\n", "control.tar.gz", "./control", `Unsupported Debian binary package format "3.0"`},
+		{"2.0\n", "control.tar.gz", "./postinst", "Control file not found in control archive"},
+	} {
+		name := c.member + "-" + c.control[strings.LastIndex(c.control, "/")+1:] + "-" + strings.TrimSpace(c.version) + ".deb"
+		if err := ioutil.WriteFile(filepath.Join(dir, name), testDeb(c.version, c.member, c.control), 0644); err != nil {
+			t.Fatal(err)
+		}
+		control, err := readDeb(name)
+		switch {
+		case len(c.err) == 0 && err != nil:
+			t.Errorf("readDeb(%s) error %v", name, err)
+		case len(c.err) == 0 && control.String() != testControl:
+			t.Errorf("readDeb(%s) = %q, want %q", name, control.String(), testControl)
+		case len(c.err) != 0 && (err == nil || err.Error() != c.err):
+			t.Errorf("readDeb(%s) error %v, want %q", name, err, c.err)
+		}
+	}
+	ioutil.WriteFile(filepath.Join(dir, "plain.ar"), []byte(fmt.Sprintf("!<arch>\n%-16s%-12d%-6d%-6d%-8s%-10d`\n", "control.tar.gz/", 0, 0, 0, "100644", 0)), 0644)
+	if _, err := readDeb("plain.ar"); err == nil || !strings.Contains(err.Error(), "instead of debian-binary") {
+		t.Errorf("readDeb(plain.ar) error %v, want missing debian-binary", err)
+	}
+}
+
+func TestReadContents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	storage := config.Storage.Path
+	config.Storage.Path = dir + "/"
+	defer func() { config.Storage.Path = storage }()
+	deb := testDeb("2.0\n", "control.tar.gz", "./control", "./", "./usr/", "./usr/bin/", "./usr/bin/hello", "usr/share/doc/hello/copyright")
+	if err := ioutil.WriteFile(filepath.Join(dir, "hello.deb"), deb, 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readContents("hello.deb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"usr/bin/hello", "usr/share/doc/hello/copyright"}; strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("readContents() = %q, want %q", got, want)
+	}
+}
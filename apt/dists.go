@@ -0,0 +1,68 @@
+package apt
+
+import (
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/subutai-io/cdn/config"
+)
+
+// validName matches names of suites and components accepted in upload requests
+var validName = regexp.MustCompile(`^[a-z0-9][a-z0-9.+-]*$`)
+
+// suites returns suites package is published to, packages uploaded before suites were introduced
+// belong to the default suite
+func suites(info map[string]string) (list []string) {
+	for _, s := range strings.Split(info["suite"], ",") {
+		if s = strings.TrimSpace(s); len(s) != 0 {
+			list = append(list, s)
+		}
+	}
+	if len(list) == 0 {
+		list = []string{config.APT.Suite}
+	}
+	return
+}
+
+// component returns component of suite package belongs to
+func component(info map[string]string) string {
+	if len(info["component"]) != 0 {
+		return info["component"]
+	}
+	return config.APT.Component
+}
+
+// poolPath returns path of package in pool directory, pool/<component>/<prefix>/<source>/<file>,
+// where prefix is the first letter of source package name or four letters for libraries
+func poolPath(info map[string]string) string {
+	source := strings.Fields(info["Source"])
+	name := info["Package"]
+	if len(source) != 0 {
+		name = source[0]
+	}
+	prefix := name
+	if strings.HasPrefix(name, "lib") && len(name) > 3 {
+		prefix = name[:4]
+	} else if len(name) > 0 {
+		prefix = name[:1]
+	}
+	return path.Join("pool", component(info), prefix, name, info["Filename"])
+}
+
+// uploadTarget returns suites and component requested in upload form, defaults are used for empty values
+func uploadTarget(suite, comp string) (list []string, c string, ok bool) {
+	if len(suite) == 0 {
+		suite = config.APT.Suite
+	}
+	if c = strings.ToLower(strings.TrimSpace(comp)); len(c) == 0 {
+		c = config.APT.Component
+	}
+	for _, s := range strings.Split(strings.ToLower(suite), ",") {
+		if s = strings.TrimSpace(s); !validName.MatchString(s) {
+			return nil, "", false
+		}
+		list = append(list, s)
+	}
+	return list, c, validName.MatchString(c)
+}
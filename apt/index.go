@@ -0,0 +1,538 @@
+package apt
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/subutai-io/agent/log"
+	"github.com/subutai-io/cdn/config"
+	"github.com/subutai-io/cdn/db"
+	"github.com/subutai-io/cdn/deb822"
+	"github.com/subutai-io/cdn/pgp"
+	"github.com/subutai-io/cdn/utils"
+	"github.com/ulikunitz/xz"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/clearsign"
+)
+
+// stanzaFields is the order of fields in Packages stanza of packages uploaded before order of control fields
+// was stored. Other control fields follow them in alphabetical order, Description is always the last one.
+var stanzaFields = []string{"Package", "Source", "Version", "Section", "Priority", "Architecture", "Essential",
+	"Maintainer", "Installed-Size", "Provides", "Pre-Depends", "Depends", "Recommends", "Suggests", "Conflicts",
+	"Breaks", "Replaces", "Filename", "Size", "MD5sum", "SHA1", "SHA256", "SHA512", "Homepage"}
+
+// fileFields describe package file in Packages stanza, they follow control fields of the package
+var fileFields = []string{"Filename", "Size", "MD5sum", "SHA1", "SHA256", "SHA512"}
+
+// releaseHashes are checksum fields of Release file
+var releaseHashes = []struct {
+	field string
+	new   func() hash.Hash
+}{
+	{"MD5Sum", md5.New},
+	{"SHA1", sha1.New},
+	{"SHA256", sha256.New},
+	{"SHA512", sha512.New},
+}
+
+// generating serializes index generation
+var generating sync.Mutex
+
+// stanza formats package record as paragraph of Packages index, filename is path of package relative
+// to repository root. Control fields keep their order in the package, fields describing package file
+// follow them and Description is always the last one.
+func stanza(info map[string]string, filename string) string {
+	if len(info[deb822.OrderField]) == 0 {
+		return legacyStanza(info, filename)
+	}
+	fields := map[string]string{}
+	for _, k := range fileFields {
+		fields[k] = info[k]
+	}
+	fields["Filename"] = filename
+	fields["MD5sum"] = info["md5"]
+	var p deb822.Paragraph
+	for _, f := range deb822.FromRecord(info) {
+		if _, ok := fields[f.Name]; !ok && f.Name != "Description" && len(f.Value) != 0 {
+			p = append(p, f)
+		}
+	}
+	for _, k := range fileFields {
+		if len(fields[k]) != 0 {
+			p = append(p, deb822.Field{Name: k, Value: fields[k]})
+		}
+	}
+	if len(info["Description"]) != 0 {
+		p = append(p, deb822.Field{Name: "Description", Value: info["Description"]})
+	}
+	return p.String()
+}
+
+// legacyStanza formats record stored without order of control fields, they are told apart from gorjun fields
+// by capital first letter
+func legacyStanza(info map[string]string, filename string) string {
+	fields := map[string]string{}
+	for k, v := range info {
+		if len(k) != 0 && unicode.IsUpper(rune(k[0])) && len(v) != 0 {
+			fields[k] = v
+		}
+	}
+	fields["Filename"] = filename
+	fields["MD5sum"] = info["md5"]
+	order, known := []string{}, map[string]bool{}
+	for _, k := range stanzaFields {
+		if _, ok := fields[k]; ok {
+			order = append(order, k)
+		}
+		known[k] = true
+	}
+	rest := []string{}
+	for k := range fields {
+		if !known[k] && k != "Description" {
+			rest = append(rest, k)
+		}
+	}
+	sort.Strings(rest)
+	order = append(order, rest...)
+	if _, ok := fields["Description"]; ok {
+		order = append(order, "Description")
+	}
+	var p deb822.Paragraph
+	for _, k := range order {
+		p = append(p, deb822.Field{Name: k, Value: fields[k]})
+	}
+	return p.String()
+}
+
+// records returns metadata of all packages in apt repo ordered by name, version and architecture
+func records() []map[string]string {
+	return packageRecords(db.RepoFiles("apt"))
+}
+
+// packageRecords returns metadata of packages with given IDs ordered by name, version and architecture
+func packageRecords(ids []string) []map[string]string {
+	list := []map[string]string{}
+	for _, id := range ids {
+		if info := db.Info(id); len(info["Package"]) != 0 {
+			list = append(list, info)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		a, b := list[i], list[j]
+		if a["Package"] != b["Package"] {
+			return a["Package"] < b["Package"]
+		}
+		if c := deb822.CompareVersions(a["Version"], b["Version"]); c != 0 {
+			return c < 0
+		}
+		return a["Architecture"] < b["Architecture"]
+	})
+	return list
+}
+
+// packages builds Packages index of packages, flat index refers to packages in repository root instead of pool
+func packages(list []map[string]string, flat bool) []byte {
+	var out bytes.Buffer
+	for i, info := range list {
+		if i > 0 {
+			out.WriteString("\n")
+		}
+		if flat {
+			out.WriteString(stanza(info, "./"+info["Filename"]))
+		} else {
+			out.WriteString(stanza(info, poolPath(info)))
+		}
+	}
+	return out.Bytes()
+}
+
+// compress returns gzip and xz compressed copies of index
+func compress(index []byte) (gz, x []byte, err error) {
+	if gz, err = gzipped(index); err != nil {
+		return
+	}
+	var z bytes.Buffer
+	zw, err := xz.NewWriter(&z)
+	if err != nil {
+		return
+	}
+	if _, err = zw.Write(index); err != nil {
+		return
+	}
+	if err = zw.Close(); err != nil {
+		return
+	}
+	return gz, z.Bytes(), nil
+}
+
+// gzipped returns gzip compressed copy of data
+func gzipped(data []byte) ([]byte, error) {
+	var g bytes.Buffer
+	gw := gzip.NewWriter(&g)
+	if _, err := gw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := gw.Close(); err != nil {
+		return nil, err
+	}
+	return g.Bytes(), nil
+}
+
+// contents builds Contents index of architecture which maps files to packages shipping them. Packages are
+// listed as <section>/<package>, packages of architecture "all" are included in index of every architecture.
+func contents(list []map[string]string, arch string) []byte {
+	files := map[string][]string{}
+	for _, info := range list {
+		if info["Architecture"] != arch && info["Architecture"] != "all" || len(info["contents"]) == 0 {
+			continue
+		}
+		location := info["Package"]
+		if section := info["Section"]; len(section) != 0 {
+			location = section + "/" + location
+		}
+		for _, f := range strings.Split(info["contents"], "\n") {
+			if !utils.In([]string{location}, files[f]) {
+				files[f] = append(files[f], location)
+			}
+		}
+	}
+	names := []string{}
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var out bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&out, "%-60s %s\n", name, strings.Join(files[name], ","))
+	}
+	return out.Bytes()
+}
+
+// release builds Release file listing checksums and sizes of index files. Header fields are written
+// in the given order before the date.
+func release(header [][2]string, files map[string][]byte, date time.Time) []byte {
+	names := []string{}
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var out bytes.Buffer
+	for _, field := range header {
+		out.WriteString(field[0] + ": " + field[1] + "\n")
+	}
+	out.WriteString("Date: " + date.UTC().Format(time.RFC1123) + "\n")
+	for _, h := range releaseHashes {
+		out.WriteString(h.field + ":\n")
+		for _, name := range names {
+			sum := h.new()
+			sum.Write(files[name])
+			fmt.Fprintf(&out, " %x %16d %s\n", sum.Sum(nil), len(files[name]), name)
+		}
+	}
+	return out.Bytes()
+}
+
+// writeIndex replaces file in storage directory atomically, so clients never get partially written index.
+// Name is path relative to storage directory.
+func writeIndex(name string, data []byte) error {
+	path := filepath.Join(config.Storage.Path, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// signingKey returns key signing Release files of suite, key of [apt] section is used unless the suite has
+// its own [apt-suite] section. Empty identity selects the first key of keyring. Nil is returned if keyring
+// is not configured.
+func signingKey(suite string) (*openpgp.Entity, error) {
+	keyring, identity, passphrase := config.APT.Keyring, config.APT.Identity, config.APT.Passphrase
+	if c, ok := config.APTSuite[suite]; ok && c != nil && len(c.Keyring) != 0 {
+		keyring, identity, passphrase = c.Keyring, c.Identity, c.Passphrase
+	}
+	if len(keyring) == 0 {
+		return nil, nil
+	}
+	return pgp.SigningKey(keyring, identity, passphrase)
+}
+
+// suiteKey returns signing key of suite, problems are logged and nil is returned to leave Release unsigned
+func suiteKey(suite string) *openpgp.Entity {
+	key, err := signingKey(suite)
+	if log.Check(log.WarnLevel, "Reading APT signing key", err) || key == nil {
+		log.Warn("Release files of suite " + suite + " are left unsigned")
+		return nil
+	}
+	return key
+}
+
+// publish writes index files to directory dir of storage along with Release, its detached signature
+// Release.gpg and clearsigned InRelease, both are made by the same signing key or subkey. Signatures are
+// removed if key is nil.
+func publish(dir string, header [][2]string, files map[string][]byte, key *openpgp.Entity) error {
+	rel := release(header, files, time.Now())
+	var signature, inline bytes.Buffer
+	if key != nil {
+		signer, err := pgp.SignKey(key, time.Now())
+		if err != nil {
+			return fmt.Errorf("Signing Release: %v", err)
+		}
+		if err = pgp.DetachSign(&signature, signer, rel); err != nil {
+			return fmt.Errorf("Signing Release: %v", err)
+		}
+		w, err := clearsign.Encode(&inline, signer, nil)
+		if err != nil {
+			return fmt.Errorf("Signing InRelease: %v", err)
+		}
+		if _, err = w.Write(rel); err != nil {
+			return fmt.Errorf("Signing InRelease: %v", err)
+		}
+		if err = w.Close(); err != nil {
+			return fmt.Errorf("Signing InRelease: %v", err)
+		}
+	}
+	for name, data := range files {
+		if err := writeIndex(path.Join(dir, name), data); err != nil {
+			return err
+		}
+	}
+	if err := writeIndex(path.Join(dir, "Release"), rel); err != nil {
+		return err
+	}
+	if key == nil {
+		os.Remove(filepath.Join(config.Storage.Path, dir, "Release.gpg"))
+		os.Remove(filepath.Join(config.Storage.Path, dir, "InRelease"))
+		return nil
+	}
+	if err := writeIndex(path.Join(dir, "Release.gpg"), signature.Bytes()); err != nil {
+		return err
+	}
+	return writeIndex(path.Join(dir, "InRelease"), inline.Bytes())
+}
+
+// publicKey returns armored public key which signs Release files of suite
+func publicKey(suite string) ([]byte, error) {
+	key, err := signingKey(suite)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nil, fmt.Errorf("APT signing key is not configured")
+	}
+	var out bytes.Buffer
+	w, err := armor.Encode(&out, openpgp.PublicKeyType, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err = key.Serialize(w); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	out.WriteString("\n")
+	return out.Bytes(), nil
+}
+
+// indexFiles returns Packages index with its compressed copies under names prefixed with dir
+func indexFiles(dir string, index []byte) (map[string][]byte, error) {
+	gz, x, err := compress(index)
+	if err != nil {
+		return nil, fmt.Errorf("Compressing Packages: %v", err)
+	}
+	return map[string][]byte{
+		path.Join(dir, "Packages"):    index,
+		path.Join(dir, "Packages.gz"): gz,
+		path.Join(dir, "Packages.xz"): x,
+	}, nil
+}
+
+// flatFiles returns names of flat indexes which publish writes to storage directory itself,
+// the rest of repository layout is kept in dists, generated and snapshots directories
+func flatFiles() []string {
+	files, _ := indexFiles("", nil)
+	names := []string{"Release", "Release.gpg", "InRelease"}
+	for name := range files {
+		names = append(names, name)
+	}
+	return names
+}
+
+// suiteFiles builds Packages indexes of every component and architecture of suite and Contents indexes
+// of every architecture. Packages of architecture "all" are listed in indexes of every architecture.
+func suiteFiles(list []map[string]string) (files map[string][]byte, components, architectures []string, err error) {
+	arch := map[string]bool{}
+	for _, a := range config.APT.Architecture {
+		if len(a) != 0 {
+			arch[a] = true
+		}
+	}
+	comp := map[string][]map[string]string{}
+	for _, info := range list {
+		comp[component(info)] = append(comp[component(info)], info)
+		if a := info["Architecture"]; len(a) != 0 && a != "all" {
+			arch[a] = true
+		}
+	}
+	for c := range comp {
+		components = append(components, c)
+	}
+	for a := range arch {
+		architectures = append(architectures, a)
+	}
+	sort.Strings(components)
+	sort.Strings(architectures)
+	files = map[string][]byte{}
+	for _, a := range architectures {
+		if files["Contents-"+a+".gz"], err = gzipped(contents(list, a)); err != nil {
+			return nil, nil, nil, fmt.Errorf("Compressing Contents: %v", err)
+		}
+	}
+	for _, c := range components {
+		for _, a := range architectures {
+			selected := []map[string]string{}
+			for _, info := range comp[c] {
+				if info["Architecture"] == a || info["Architecture"] == "all" {
+					selected = append(selected, info)
+				}
+			}
+			index, err := indexFiles(path.Join(c, "binary-"+a), packages(selected, false))
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			for name, data := range index {
+				files[name] = data
+			}
+		}
+	}
+	return
+}
+
+// writeByHash stores index files of suite under by-hash/SHA256/<digest> in their directories, so clients holding
+// Release of previous generation still get matching indexes. Files of generations older than configured by
+// byhashkeep option are removed, at least two generations are kept.
+func writeByHash(dir string, files map[string][]byte) error {
+	digests := map[string]map[string]bool{}
+	now := time.Now()
+	for name, data := range files {
+		byHash := path.Join(dir, path.Dir(name), "by-hash", "SHA256")
+		if digests[byHash] == nil {
+			digests[byHash] = map[string]bool{}
+		}
+		digest := fmt.Sprintf("%x", sha256.Sum256(data))
+		digests[byHash][digest] = true
+		if os.Chtimes(filepath.Join(config.Storage.Path, byHash, digest), now, now) == nil {
+			continue
+		}
+		if err := writeIndex(path.Join(byHash, digest), data); err != nil {
+			return err
+		}
+	}
+	keep := config.APT.Byhashkeep
+	if keep < 2 {
+		keep = 2
+	}
+	for byHash, current := range digests {
+		list, err := ioutil.ReadDir(filepath.Join(config.Storage.Path, byHash))
+		if err != nil {
+			return err
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].ModTime().After(list[j].ModTime()) })
+		for i, f := range list {
+			if i >= keep*len(current) && !current[f.Name()] {
+				os.Remove(filepath.Join(config.Storage.Path, byHash, f.Name()))
+			}
+		}
+	}
+	return nil
+}
+
+// publishSuite writes indexes of suite listing packages to directory dir of storage
+func publishSuite(dir, suite string, list []map[string]string) error {
+	files, components, architectures, err := suiteFiles(list)
+	if err != nil {
+		return err
+	}
+	header := [][2]string{
+		{"Origin", "Gorjun"},
+		{"Label", "Gorjun"},
+		{"Suite", suite},
+		{"Codename", suite},
+		{"Architectures", strings.Join(architectures, " ")},
+		{"Components", strings.Join(components, " ")},
+		{"Acquire-By-Hash", "yes"},
+	}
+	if err = writeByHash(dir, files); err != nil {
+		return err
+	}
+	return publish(dir, header, files, suiteKey(suite))
+}
+
+// generateIndexes writes flat Packages and Release to storage directory for clients using "./" repository syntax,
+// and Packages and Release of every suite to generated directory, dists/<suite> is a symlink to them. Suites
+// published from snapshots are left as they are, suites without packages are removed.
+func generateIndexes() error {
+	return generate(nil)
+}
+
+// generate writes flat indexes and indexes of suites listed in only, all suites are written if only is nil
+func generate(only map[string]bool) error {
+	generating.Lock()
+	defer generating.Unlock()
+	list := records()
+	files, err := indexFiles("", packages(list, true))
+	if err != nil {
+		return err
+	}
+	if err = publish("", nil, files, suiteKey(config.APT.Suite)); err != nil {
+		return err
+	}
+	bySuite := map[string][]map[string]string{}
+	for _, info := range list {
+		for _, s := range suites(info) {
+			bySuite[s] = append(bySuite[s], info)
+		}
+	}
+	for suite, list := range bySuite {
+		if only != nil && !only[suite] || published(suite) {
+			continue
+		}
+		if err = publishSuite(generatedDir(suite), suite, list); err != nil {
+			return err
+		}
+		if err = switchSuite(suite, generatedDir(suite)); err != nil {
+			return err
+		}
+	}
+	dists, _ := ioutil.ReadDir(filepath.Join(config.Storage.Path, "dists"))
+	for _, dir := range dists {
+		suite := dir.Name()
+		if _, ok := bySuite[suite]; ok || strings.HasPrefix(suite, ".") || published(suite) || only != nil && !only[suite] {
+			continue
+		}
+		log.Info("Removing indexes of empty suite " + suite)
+		os.RemoveAll(filepath.Join(config.Storage.Path, "dists", suite))
+		os.RemoveAll(filepath.Join(config.Storage.Path, generatedDir(suite)))
+	}
+	return nil
+}
@@ -0,0 +1,263 @@
+package apt
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/subutai-io/cdn/config"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/clearsign"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+func TestStanza(t *testing.T) {
+	info := map[string]string{
+		"id":           "some-id",
+		"name":         "winff_1.5.5-1_all.deb",
+		"md5":          "some-md5",
+		"date":         "some-date",
+		"Filename":     "winff_1.5.5-1_all.deb",
+		"Description":  "GUI for ffmpeg",
+		"Version":      "1.5.5-1",
+		"Package":      "winff",
+		"Architecture": "all",
+		"Depends":      "ffmpeg",
+		"X-Custom":     "value",
+		"Size":         "1024",
+		"SHA256":       "some-sha256",
+	}
+	want := "Package: winff\nVersion: 1.5.5-1\nArchitecture: all\nDepends: ffmpeg\nFilename: ./winff_1.5.5-1_all.deb\n" +
+		"Size: 1024\nMD5sum: some-md5\nSHA256: some-sha256\nX-Custom: value\nDescription: GUI for ffmpeg\n"
+	if got := stanza(info, "./"+info["Filename"]); got != want {
+		t.Errorf("stanza() = %q, want %q", got, want)
+	}
+}
+
+func TestStanzaOrder(t *testing.T) {
+	info := map[string]string{
+		"md5":            "some-md5",
+		"Filename":       "hello_2.10-2_amd64.deb",
+		"Size":           "1024",
+		"Package":        "hello",
+		"Version":        "2.10-2",
+		"Architecture":   "amd64",
+		"Maintainer":     "Someone <someone@example.com>",
+		"Depends":        "libc6:amd64 (>= 2.14)",
+		"Description":    "greeting\n long description\n .\n more",
+		"control-fields": "Package,Version,Architecture,Maintainer,Description,Depends",
+	}
+	want := "Package: hello\nVersion: 2.10-2\nArchitecture: amd64\nMaintainer: Someone <someone@example.com>\n" +
+		"Depends: libc6:amd64 (>= 2.14)\nFilename: pool/main/h/hello/hello_2.10-2_amd64.deb\nSize: 1024\nMD5sum: some-md5\n" +
+		"Description: greeting\n long description\n .\n more\n"
+	if got := stanza(info, poolPath(info)); got != want {
+		t.Errorf("stanza() = %q, want %q", got, want)
+	}
+}
+
+func TestRelease(t *testing.T) {
+	date := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	got := string(release([][2]string{{"Suite", "stable"}}, map[string][]byte{"Packages": []byte(""), "Packages.gz": []byte("x")}, date))
+	for _, line := range []string{
+		"Suite: stable\nDate: Fri, 01 Jun 2018 12:00:00 UTC\n",
+		"MD5Sum:\n d41d8cd98f00b204e9800998ecf8427e                0 Packages\n 9dd4e461268c8034f5c8564e155c67a6                1 Packages.gz\n",
+		"SHA256:\n e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855                0 Packages\n",
+	} {
+		if !strings.Contains(got, line) {
+			t.Errorf("release() = %q, missing %q", got, line)
+		}
+	}
+}
+
+func TestPoolPath(t *testing.T) {
+	for _, c := range []struct {
+		info map[string]string
+		want string
+	}{
+		{map[string]string{"Package": "winff", "Filename": "winff_1.5.5-1_all.deb"}, "pool/main/w/winff/winff_1.5.5-1_all.deb"},
+		{map[string]string{"Package": "libfoo1", "Source": "foo", "component": "contrib", "Filename": "libfoo1_1.0_amd64.deb"},
+			"pool/contrib/f/foo/libfoo1_1.0_amd64.deb"},
+		{map[string]string{"Package": "libbar1", "Source": "libbar (1.2-1)", "Filename": "libbar1_1.0_amd64.deb"},
+			"pool/main/libb/libbar/libbar1_1.0_amd64.deb"},
+	} {
+		if got := poolPath(c.info); got != c.want {
+			t.Errorf("poolPath(%v) = %q, want %q", c.info, got, c.want)
+		}
+	}
+}
+
+func TestSuiteFiles(t *testing.T) {
+	list := []map[string]string{
+		{"Package": "a", "Architecture": "all", "Filename": "a_1_all.deb"},
+		{"Package": "b", "Architecture": "arm64", "component": "contrib", "Filename": "b_1_arm64.deb"},
+	}
+	files, components, architectures, err := suiteFiles(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(components, " ") != "contrib main" || strings.Join(architectures, " ") != "amd64 arm64" {
+		t.Errorf("suiteFiles() components %v, architectures %v", components, architectures)
+	}
+	for name, want := range map[string]string{
+		"main/binary-amd64/Packages":    "Filename: pool/main/a/a/a_1_all.deb",
+		"main/binary-arm64/Packages":    "Filename: pool/main/a/a/a_1_all.deb",
+		"contrib/binary-arm64/Packages": "Filename: pool/contrib/b/b/b_1_arm64.deb",
+	} {
+		if !strings.Contains(string(files[name]), want) {
+			t.Errorf("suiteFiles() %s = %q, missing %q", name, files[name], want)
+		}
+	}
+	if len(files["contrib/binary-amd64/Packages"]) != 0 {
+		t.Errorf("suiteFiles() contrib/binary-amd64/Packages = %q, want empty", files["contrib/binary-amd64/Packages"])
+	}
+}
+
+// addSigningSubkey adds RSA subkey flagged for signing to key and returns its private part
+func addSigningSubkey(t *testing.T, key *openpgp.Entity) *packet.PrivateKey {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	subkey := openpgp.Subkey{
+		PublicKey:  packet.NewRSAPublicKey(now, &rsaKey.PublicKey),
+		PrivateKey: packet.NewRSAPrivateKey(now, rsaKey),
+		Sig: &packet.Signature{CreationTime: now, SigType: packet.SigTypeSubkeyBinding, PubKeyAlgo: packet.PubKeyAlgoRSA,
+			Hash: crypto.SHA256, FlagsValid: true, FlagSign: true, IssuerKeyId: &key.PrimaryKey.KeyId},
+	}
+	if err = subkey.Sig.SignKey(subkey.PublicKey, key.PrivateKey, nil); err != nil {
+		t.Fatal(err)
+	}
+	key.Subkeys = append(key.Subkeys, subkey)
+	return subkey.PrivateKey
+}
+
+// issuer returns ID of key which made signature
+func issuer(t *testing.T, signature io.Reader) uint64 {
+	p, err := packet.Read(signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sig, ok := p.(*packet.Signature); ok && sig.IssuerKeyId != nil {
+		return *sig.IssuerKeyId
+	}
+	t.Fatalf("Signature packet without issuer: %#v", p)
+	return 0
+}
+
+func TestPublish(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	storage := config.Storage.Path
+	config.Storage.Path = dir + "/"
+	defer func() { config.Storage.Path = storage }()
+	plain, err := openpgp.NewEntity("Test", "", "test@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withSubkey, err := openpgp.NewEntity("Test", "", "test@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subkey := addSigningSubkey(t, withSubkey)
+	files := map[string][]byte{"main/binary-amd64/Packages": []byte("Package: a\n")}
+	for _, c := range []struct {
+		key    *openpgp.Entity
+		signer uint64
+	}{
+		{plain, plain.PrimaryKey.KeyId},
+		{withSubkey, subkey.KeyId},
+	} {
+		if err = publish("dists/stable", [][2]string{{"Suite", "stable"}}, files, c.key); err != nil {
+			t.Fatal(err)
+		}
+		rel, _ := ioutil.ReadFile(filepath.Join(dir, "dists/stable/Release"))
+		inline, _ := ioutil.ReadFile(filepath.Join(dir, "dists/stable/InRelease"))
+		block, _ := clearsign.Decode(inline)
+		if block == nil || !bytes.Equal(bytes.TrimRight(block.Plaintext, "\n"), bytes.TrimRight(rel, "\n")) {
+			t.Fatalf("InRelease doesn't contain Release")
+		}
+		if _, err = openpgp.CheckDetachedSignature(openpgp.EntityList{c.key}, bytes.NewReader(block.Bytes), block.ArmoredSignature.Body); err != nil {
+			t.Errorf("InRelease signature: %v", err)
+		}
+		// signature body is consumed by the check, so InRelease is decoded again
+		block, _ = clearsign.Decode(inline)
+		if id := issuer(t, block.ArmoredSignature.Body); id != c.signer {
+			t.Errorf("InRelease is signed by %X, want %X", id, c.signer)
+		}
+		signature, _ := ioutil.ReadFile(filepath.Join(dir, "dists/stable/Release.gpg"))
+		if _, err = openpgp.CheckArmoredDetachedSignature(openpgp.EntityList{c.key}, bytes.NewReader(rel), bytes.NewReader(signature)); err != nil {
+			t.Errorf("Release.gpg signature: %v", err)
+		}
+		if armored, err := armor.Decode(bytes.NewReader(signature)); err != nil {
+			t.Errorf("Release.gpg is not armored: %v", err)
+		} else if id := issuer(t, armored.Body); id != c.signer {
+			t.Errorf("Release.gpg is signed by %X, want %X", id, c.signer)
+		}
+	}
+	if err = publish("dists/stable", nil, files, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "dists/stable/InRelease")); !os.IsNotExist(err) {
+		t.Errorf("InRelease of unsigned suite is not removed")
+	}
+}
+
+func TestWriteByHash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	storage, keep := config.Storage.Path, config.APT.Byhashkeep
+	config.Storage.Path, config.APT.Byhashkeep = dir+"/", 2
+	defer func() { config.Storage.Path, config.APT.Byhashkeep = storage, keep }()
+	for _, content := range []string{"a", "b", "c", "b"} {
+		files := map[string][]byte{"main/binary-amd64/Packages": []byte(content), "main/binary-amd64/Packages.gz": []byte(content + ".gz")}
+		if err = writeByHash("dists/stable", files); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	list, _ := ioutil.ReadDir(filepath.Join(dir, "dists/stable/main/binary-amd64/by-hash/SHA256"))
+	names := map[string]bool{}
+	for _, f := range list {
+		names[f.Name()] = true
+	}
+	for content, want := range map[string]bool{"a": false, "b": true, "c": true} {
+		if digest := fmt.Sprintf("%x", sha256.Sum256([]byte(content))); names[digest] != want {
+			t.Errorf("by-hash file of generation %q kept: %v, want %v", content, names[digest], want)
+		}
+	}
+	if len(names) != 4 {
+		t.Errorf("by-hash directory has %d files, want 4", len(names))
+	}
+}
+
+func TestContents(t *testing.T) {
+	list := []map[string]string{
+		{"Package": "hello", "Section": "utils", "Architecture": "amd64", "contents": "usr/bin/hello\nusr/share/doc/hello/copyright"},
+		{"Package": "hello", "Section": "utils", "Architecture": "amd64", "contents": "usr/bin/hello"},
+		{"Package": "hello-doc", "Architecture": "all", "contents": "usr/share/doc/hello/copyright"},
+		{"Package": "hello", "Section": "utils", "Architecture": "arm64", "contents": "usr/bin/hello-arm"},
+	}
+	want := fmt.Sprintf("%-60s %s\n%-60s %s\n", "usr/bin/hello", "utils/hello",
+		"usr/share/doc/hello/copyright", "utils/hello,hello-doc")
+	if got := string(contents(list, "amd64")); got != want {
+		t.Errorf("contents() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,300 @@
+package apt
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/subutai-io/agent/log"
+	"github.com/subutai-io/cdn/auth"
+	"github.com/subutai-io/cdn/config"
+	"github.com/subutai-io/cdn/utils"
+)
+
+// snapshot is a frozen set of packages of suite. Its indexes are published to snapshots/<name>/dists/<suite>,
+// so clients can pin it as repository snapshots/<name>, and they are never regenerated.
+type snapshot struct {
+	Name      string    `json:"name"`
+	Suite     string    `json:"suite"`
+	Date      time.Time `json:"date"`
+	Packages  []string  `json:"packages"`
+	Published []string  `json:"published,omitempty"`
+}
+
+// snapshotFile returns path of snapshot manifest relative to storage directory
+func snapshotFile(name string) string {
+	return path.Join("snapshots", name, "snapshot.json")
+}
+
+// readSnapshot reads manifest of snapshot, suites it is published as are filled from dists directory
+func readSnapshot(name string) (snap snapshot, err error) {
+	data, err := ioutil.ReadFile(filepath.Join(config.Storage.Path, snapshotFile(name)))
+	if err != nil {
+		return snap, err
+	}
+	if err = json.Unmarshal(data, &snap); err != nil {
+		return snap, err
+	}
+	dists, _ := ioutil.ReadDir(filepath.Join(config.Storage.Path, "dists"))
+	for _, dir := range dists {
+		if target, err := os.Readlink(filepath.Join(config.Storage.Path, "dists", dir.Name())); err == nil &&
+			strings.HasPrefix(filepath.ToSlash(target), "../snapshots/"+name+"/") {
+			snap.Published = append(snap.Published, dir.Name())
+		}
+	}
+	return snap, nil
+}
+
+// snapshots returns manifests of all snapshots ordered by date
+func snapshots() (list []snapshot) {
+	dirs, _ := ioutil.ReadDir(filepath.Join(config.Storage.Path, "snapshots"))
+	for _, dir := range dirs {
+		if snap, err := readSnapshot(dir.Name()); !log.Check(log.WarnLevel, "Reading snapshot "+dir.Name(), err) {
+			list = append(list, snap)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Date.Before(list[j].Date) })
+	return
+}
+
+// snapshotOf returns name of the first snapshot containing package, empty string if there is none
+func snapshotOf(id string) string {
+	for _, snap := range snapshots() {
+		if utils.In([]string{id}, snap.Packages) {
+			return snap.Name
+		}
+	}
+	return ""
+}
+
+// published returns true if suite points to snapshot instead of being generated from uploaded packages
+func published(suite string) bool {
+	target, err := os.Readlink(filepath.Join(config.Storage.Path, "dists", suite))
+	return err == nil && strings.HasPrefix(filepath.ToSlash(target), "../snapshots/")
+}
+
+// generatedDir returns directory of storage with indexes of suite generated from uploaded packages
+func generatedDir(suite string) string {
+	return path.Join("generated", suite)
+}
+
+// switchSuite atomically points dists/<suite> symlink to directory dir of storage. Suites generated before
+// indexes were kept in generated directory are plain directories, they are moved away first and moved back
+// if the switch fails.
+func switchSuite(suite, dir string) error {
+	dists := filepath.Join(config.Storage.Path, "dists")
+	if err := os.MkdirAll(dists, 0755); err != nil {
+		return err
+	}
+	link := filepath.Join(dists, suite)
+	if target, err := os.Readlink(link); err == nil && target == path.Join("..", dir) {
+		return nil
+	}
+	tmp := filepath.Join(dists, "."+suite+".link")
+	os.Remove(tmp)
+	if err := os.Symlink(path.Join("..", dir), tmp); err != nil {
+		return err
+	}
+	stat, err := os.Lstat(link)
+	if err != nil || !stat.IsDir() {
+		if err = os.Rename(tmp, link); err != nil {
+			os.Remove(tmp)
+		}
+		return err
+	}
+	old := filepath.Join(dists, "."+suite+".old")
+	os.RemoveAll(old)
+	if err = os.Rename(link, old); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err = os.Rename(tmp, link); err != nil {
+		os.Remove(tmp)
+		log.Check(log.WarnLevel, "Restoring indexes of suite "+suite, os.Rename(old, link))
+		return err
+	}
+	return os.RemoveAll(old)
+}
+
+// suiteRecords returns records of packages uploaded to suite
+func suiteRecords(suite string) (list []map[string]string) {
+	for _, info := range records() {
+		if utils.In([]string{suite}, suites(info)) {
+			list = append(list, info)
+		}
+	}
+	return
+}
+
+// createSnapshot freezes current packages of suite as snapshot with given name
+func createSnapshot(name, suite string) (snap snapshot, err error) {
+	generating.Lock()
+	defer generating.Unlock()
+	if _, err = os.Stat(filepath.Join(config.Storage.Path, "snapshots", name)); err == nil {
+		return snap, fmt.Errorf("Snapshot %s already exists", name)
+	}
+	snap = snapshot{Name: name, Suite: suite, Date: time.Now().UTC(), Packages: []string{}}
+	list := suiteRecords(suite)
+	for _, info := range list {
+		snap.Packages = append(snap.Packages, info["id"])
+	}
+	if len(list) == 0 {
+		return snap, fmt.Errorf("Suite %s has no packages", suite)
+	}
+	if err = publishSuite(path.Join("snapshots", name, "dists", suite), suite, list); err != nil {
+		os.RemoveAll(filepath.Join(config.Storage.Path, "snapshots", name))
+		return snap, err
+	}
+	data, _ := json.Marshal(snap)
+	if err = writeIndex(snapshotFile(name), data); err != nil {
+		os.RemoveAll(filepath.Join(config.Storage.Path, "snapshots", name))
+	}
+	return snap, err
+}
+
+// promote publishes packages of snapshot as suite and atomically switches suite to them. Indexes of the suite
+// are written to the snapshot directory once and reused by later promotions. Indexes generated from uploaded
+// packages are kept, so the suite can be switched back to them.
+func promote(name, suite string) error {
+	generating.Lock()
+	defer generating.Unlock()
+	snap, err := readSnapshot(name)
+	if err != nil {
+		return fmt.Errorf("Snapshot %s not found", name)
+	}
+	dir := path.Join("snapshots", name, "dists", suite)
+	if _, err := os.Stat(filepath.Join(config.Storage.Path, dir, "Release")); os.IsNotExist(err) {
+		if err = publishSuite(dir, suite, packageRecords(snap.Packages)); err != nil {
+			return err
+		}
+	}
+	return switchSuite(suite, dir)
+}
+
+// unpublish detaches suite from snapshot, its indexes are generated from uploaded packages again before
+// the suite is switched to them. Suite without uploaded packages is removed.
+func unpublish(suite string) error {
+	generating.Lock()
+	defer generating.Unlock()
+	if !published(suite) {
+		return fmt.Errorf("Suite %s is not published from snapshot", suite)
+	}
+	list := suiteRecords(suite)
+	if len(list) == 0 {
+		return os.Remove(filepath.Join(config.Storage.Path, "dists", suite))
+	}
+	if err := publishSuite(generatedDir(suite), suite, list); err != nil {
+		return err
+	}
+	return switchSuite(suite, generatedDir(suite))
+}
+
+// maintainer checks that request is made by user allowed to maintain apt repo, rejection is written to w
+func maintainer(w http.ResponseWriter, r *http.Request) bool {
+	owner := strings.ToLower(auth.RequestOwner(r))
+	if len(owner) == 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("Not authorized"))
+		log.Warn(utils.ClientIP(r) + " - rejecting apt snapshot request")
+		return false
+	}
+	if owner != "subutai" && owner != "jenkins" {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("Only allowed users can manage snapshots"))
+		log.Warn(utils.ClientIP(r) + " - rejecting apt snapshot request of " + owner)
+		return false
+	}
+	return true
+}
+
+// Snapshot lists snapshots on GET request and creates snapshot of suite given by suite parameter on POST request
+func Snapshot(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		list := snapshots()
+		if list == nil {
+			list = []snapshot{}
+		}
+		js, _ := json.Marshal(list)
+		w.Write(js)
+	case "POST":
+		if !maintainer(w, r) {
+			return
+		}
+		name := r.FormValue("name")
+		suites, _, ok := uploadTarget(r.FormValue("suite"), "")
+		if !validName.MatchString(name) || !ok || len(suites) != 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Invalid snapshot or suite name"))
+			return
+		}
+		snap, err := createSnapshot(name, suites[0])
+		if log.Check(log.WarnLevel, "Creating snapshot "+name, err) {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		log.Info("Snapshot " + name + " of suite " + suites[0] + " created")
+		js, _ := json.Marshal(snap)
+		w.Write(js)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Incorrect method"))
+	}
+}
+
+// Promote publishes snapshot given by name parameter as suite given by suite parameter
+func Promote(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Incorrect method"))
+		return
+	}
+	if !maintainer(w, r) {
+		return
+	}
+	name, suite := r.FormValue("name"), strings.ToLower(r.FormValue("suite"))
+	if !validName.MatchString(name) || !validName.MatchString(suite) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Invalid snapshot or suite name"))
+		return
+	}
+	if _, err := readSnapshot(name); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Snapshot " + name + " not found"))
+		return
+	}
+	if err := promote(name, suite); log.Check(log.WarnLevel, "Promoting snapshot "+name+" to "+suite, err) {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Failed to promote snapshot " + name + " to " + suite + ": " + err.Error()))
+		return
+	}
+	log.Info("Snapshot " + name + " is published as " + suite)
+	w.Write([]byte("Snapshot " + name + " is published as " + suite))
+}
+
+// Unpublish makes suite given by suite parameter follow uploaded packages again
+func Unpublish(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Incorrect method"))
+		return
+	}
+	if !maintainer(w, r) {
+		return
+	}
+	suite := strings.ToLower(r.FormValue("suite"))
+	if err := unpublish(suite); log.Check(log.WarnLevel, "Unpublishing suite "+suite, err) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Write([]byte("Suite " + suite + " follows uploaded packages"))
+}
@@ -0,0 +1,69 @@
+package apt
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/subutai-io/cdn/config"
+)
+
+func TestPromote(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	storage := config.Storage.Path
+	config.Storage.Path = dir + "/"
+	defer func() { config.Storage.Path = storage }()
+	for _, name := range []string{"6.3.0", "6.4.0"} {
+		data, _ := json.Marshal(snapshot{Name: name, Suite: "testing", Packages: []string{}})
+		writeIndex(snapshotFile(name), data)
+		writeIndex("snapshots/"+name+"/dists/stable/Release", []byte("Suite: stable\nLabel: "+name+"\n"))
+	}
+	// suite generated before indexes were kept in generated directory
+	writeIndex("dists/stable/Release", []byte("Suite: stable\nLabel: live\n"))
+	writeIndex(generatedDir("stable")+"/Release", []byte("Suite: stable\nLabel: generated\n"))
+	byHash := generatedDir("stable") + "/main/binary-amd64/by-hash/SHA256/0123"
+	writeIndex(byHash, []byte("Package: a\n"))
+	if err = switchSuite("stable", generatedDir("stable")); err != nil {
+		t.Fatal(err)
+	}
+	if release, _ := ioutil.ReadFile(filepath.Join(dir, "dists/stable/Release")); string(release) != "Suite: stable\nLabel: generated\n" {
+		t.Errorf("Release after switch to generated indexes = %q", release)
+	}
+	if published("stable") {
+		t.Errorf("published(stable) = true for suite generated from uploads")
+	}
+	for _, name := range []string{"6.3.0", "6.4.0"} {
+		if err = promote(name, "stable"); err != nil {
+			t.Fatal(err)
+		}
+		release, _ := ioutil.ReadFile(filepath.Join(dir, "dists/stable/Release"))
+		if string(release) != "Suite: stable\nLabel: "+name+"\n" {
+			t.Errorf("Release after promotion of %s = %q", name, release)
+		}
+	}
+	if !published("stable") {
+		t.Errorf("published(stable) = false after promotion")
+	}
+	if snap, _ := readSnapshot("6.4.0"); len(snap.Published) != 1 || snap.Published[0] != "stable" {
+		t.Errorf("snapshot 6.4.0 is published as %v, want [stable]", snap.Published)
+	}
+	if snap, _ := readSnapshot("6.3.0"); len(snap.Published) != 0 {
+		t.Errorf("snapshot 6.3.0 is published as %v, want none", snap.Published)
+	}
+	if err = promote("6.5.0", "stable"); err == nil {
+		t.Errorf("promote() of missing snapshot succeeded")
+	}
+	if _, err = os.Stat(filepath.Join(dir, byHash)); err != nil {
+		t.Errorf("Generated indexes are lost after promotion: %v", err)
+	}
+	leftovers, _ := filepath.Glob(filepath.Join(dir, "dists", ".*"))
+	if len(leftovers) != 0 {
+		t.Errorf("promote() left temporary files %v", leftovers)
+	}
+}
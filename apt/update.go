@@ -0,0 +1,62 @@
+package apt
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/subutai-io/agent/log"
+	"github.com/subutai-io/cdn/db"
+	"github.com/subutai-io/cdn/upload"
+)
+
+// debounce is how long index update waits for further changes of apt repo before indexes are regenerated
+var debounce = 5 * time.Second
+
+var (
+	pending      = map[string]bool{}
+	pendingMutex sync.Mutex
+	pendingTimer *time.Timer
+)
+
+func init() {
+	upload.Restored["apt"] = func(id string) {
+		scheduleUpdate(suites(db.Info(id)))
+	}
+	for _, name := range flatFiles() {
+		db.Generated[name] = true
+	}
+}
+
+// scheduleUpdate marks suites as changed and regenerates their indexes after debounce period. The period
+// restarts with every change, so a burst of uploads results in single regeneration.
+func scheduleUpdate(list []string) {
+	pendingMutex.Lock()
+	defer pendingMutex.Unlock()
+	for _, s := range list {
+		pending[s] = true
+	}
+	if pendingTimer != nil {
+		pendingTimer.Stop()
+	}
+	pendingTimer = time.AfterFunc(debounce, updateIndexes)
+}
+
+// updateIndexes regenerates indexes of changed suites, generation itself is serialized by generate
+func updateIndexes() {
+	pendingMutex.Lock()
+	changed := pending
+	pending = map[string]bool{}
+	pendingMutex.Unlock()
+	if len(changed) == 0 {
+		return
+	}
+	list := []string{}
+	for s := range changed {
+		list = append(list, s)
+	}
+	log.Info("Updating APT indexes of " + strings.Join(list, ", "))
+	if !log.Check(log.WarnLevel, "Updating APT indexes", generate(changed)) {
+		log.Info("APT indexes are updated")
+	}
+}
@@ -1,11 +1,10 @@
 package auth
 
 import (
-	"crypto/md5"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/json"
 	"fmt"
-	"math/rand"
 	"net/http"
 	"strings"
 	"time"
@@ -14,23 +13,50 @@ import (
 
 	"github.com/subutai-io/cdn/db"
 	"github.com/subutai-io/cdn/pgp"
+	"github.com/subutai-io/cdn/sshsig"
+	"github.com/subutai-io/cdn/utils"
 )
 
 func Register(w http.ResponseWriter, r *http.Request) {
+	if limited(w, r, "") {
+		return
+	}
 	if r.Method == "POST" {
 		r.ParseMultipartForm(32 << 20)
-		if strings.Split(r.RemoteAddr, ":")[0] == "127.0.0.1" && len(r.MultipartForm.Value["name"]) > 0 && len(r.MultipartForm.Value["key"]) > 0 {
+		if utils.Local(r) && len(r.MultipartForm.Value["name"]) > 0 && len(r.MultipartForm.Value["key"]) > 0 {
 			name := r.MultipartForm.Value["name"][0]
 			key := r.MultipartForm.Value["key"][0]
+			if err := db.RegisterUser([]byte(name), []byte(key)); log.Check(log.WarnLevel, "Registering user "+name, err) {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(err.Error()))
+				return
+			}
 			w.Write([]byte("Name: " + name + "\n"))
 			w.Write([]byte("PGP key: " + key + "\n"))
-			db.RegisterUser([]byte(name), []byte(key))
 			log.Info("User " + name + " registered with this key " + key)
 			return
+		} else if utils.Local(r) && len(r.MultipartForm.Value["name"]) > 0 && len(r.MultipartForm.Value["ssh"]) > 0 {
+			name := r.MultipartForm.Value["name"][0]
+			key := strings.TrimSpace(r.MultipartForm.Value["ssh"][0])
+			if !sshsig.Supported(key) {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte("Unsupported SSH key"))
+				return
+			}
+			if err := db.AddUserSSHKey(name, key); log.Check(log.WarnLevel, "Registering SSH key of "+name, err) {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(err.Error()))
+				return
+			}
+			w.Write([]byte("Name: " + name + "\n"))
+			w.Write([]byte("SSH key: " + key + "\n"))
+			log.Info("User " + name + " registered with this SSH key " + key)
+			return
 		} else if len(r.MultipartForm.Value["key"]) > 0 {
 			key := pgp.Verify("Hub", r.MultipartForm.Value["key"][0])
 			log.Debug(fmt.Sprintf("Key == %+v", r.MultipartForm.Value["key"]))
 			if len(key) == 0 {
+				failed(r, "")
 				log.Debug(fmt.Sprintf("Key empty"))
 				w.Write([]byte("Signature check failed"))
 				w.WriteHeader(http.StatusForbidden)
@@ -42,10 +68,14 @@ func Register(w http.ResponseWriter, r *http.Request) {
 				w.WriteHeader(http.StatusBadRequest)
 				return
 			}
+			name := fmt.Sprintf("%x", fingerprint)
 			if len(r.MultipartForm.Value["name"]) > 0 {
-				db.RegisterUser([]byte(r.MultipartForm.Value["name"][0]), []byte(key))
-			} else {
-				db.RegisterUser([]byte(fmt.Sprintf("%x", fingerprint)), []byte(key))
+				name = r.MultipartForm.Value["name"][0]
+			}
+			if err := db.RegisterUser([]byte(name), []byte(key)); log.Check(log.WarnLevel, "Registering user "+name, err) {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(err.Error()))
+				return
 			}
 			return
 		}
@@ -54,14 +84,22 @@ func Register(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("Not allowed"))
 }
 
+// Token issues auth challenge on GET request and exchanges signed challenge for session token on POST request.
+// Challenge may be either clearsigned with PGP key, or signed with SSH key by "ssh-keygen -Y sign -n gorjun",
+// in the latter case challenge itself is sent in "authid" field next to the signature.
 func Token(w http.ResponseWriter, r *http.Request) {
-	rand.Seed(time.Now().UnixNano())
 	if r.Method == http.MethodGet {
 		name := r.URL.Query().Get("user")
 		if len(name) != 0 {
-			hash := md5.New()
-			hash.Write([]byte(fmt.Sprint(time.Now().String(), name, rand.Float64())))
-			authID := fmt.Sprintf("%x", hash.Sum(nil))
+			if limited(w, r, name) {
+				return
+			}
+			authID, err := random()
+			if log.Check(log.WarnLevel, "Generating auth ID", err) {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte("Failed to generate auth ID"))
+				return
+			}
 			db.SaveAuthID(name, authID)
 			w.Write([]byte(authID))
 		}
@@ -71,29 +109,58 @@ func Token(w http.ResponseWriter, r *http.Request) {
 		if len(name) == 0 || len(message) == 0 {
 			w.WriteHeader(http.StatusBadRequest)
 			w.Write([]byte("Please specify user name and auth message"))
-			log.Warn(r.RemoteAddr + " - empty user name or message filed")
+			log.Warn(utils.ClientIP(r) + " - empty user name or message filed")
+			return
+		}
+		if limited(w, r, name) {
 			return
 		}
-		authid := pgp.Verify(name, message)
-		if db.CheckAuthID(authid) == name {
-			token := fmt.Sprintf("%x", sha256.Sum256([]byte(fmt.Sprint(time.Now().String(), name, rand.Float64()))))
+		authid := ""
+		if sshsig.Armored(message) {
+			if id := r.FormValue("authid"); sshsig.Verify(name, id, message) {
+				authid = id
+			}
+		} else {
+			authid = pgp.Verify(name, message)
+		}
+		if len(authid) != 0 && db.CheckAuthID(authid) == name {
+			token, err := random()
+			if log.Check(log.WarnLevel, "Generating token", err) {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte("Failed to generate token"))
+				return
+			}
 			db.SaveToken(name, fmt.Sprintf("%x", sha256.Sum256([]byte(token))))
 			w.Write([]byte(token))
 		} else {
+			failed(r, name)
 			w.WriteHeader(http.StatusUnauthorized)
 			w.Write([]byte("Signature verification failed"))
 		}
 	}
 }
 
+// random returns hex encoded 256 bits from cryptographically secure source
+func random() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", b), nil
+}
+
 func Validate(w http.ResponseWriter, r *http.Request) {
-	token := strings.ToLower(r.URL.Query().Get("token"))
+	if limited(w, r, "") {
+		return
+	}
+	token := RequestToken(r)
 	if len(token) == 0 {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte("Empty token"))
 		return
 	}
-	if len(db.TokenOwner(token)) == 0 {
+	if len(TokenOwner(token)) == 0 {
+		failed(r, "")
 		w.WriteHeader(http.StatusForbidden)
 		w.Write([]byte("Forbidden"))
 		return
@@ -112,6 +179,217 @@ func Keys(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNotFound)
 }
 
+// SSHKeys manages users' SSH public keys. GET request returns list of user's keys,
+// authorized POST request adds new key and authorized DELETE request removes key by its fingerprint.
+func SSHKeys(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		list := []sshKeyInfo{}
+		for _, key := range db.UserSSHKeys(r.URL.Query().Get("user")) {
+			list = append(list, sshKeyInfo{Fingerprint: sshsig.Fingerprint(key), Key: key})
+		}
+		if len(list) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		out, _ := json.Marshal(list)
+		w.Write(out)
+		return
+	}
+	owner := RequestOwner(r)
+	if len(owner) == 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("Not authorized"))
+		log.Warn(utils.ClientIP(r) + " - rejecting unauthorized SSH key request")
+		return
+	}
+	switch r.Method {
+	case http.MethodPost:
+		key := strings.TrimSpace(r.FormValue("key"))
+		if !sshsig.Supported(key) {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Unsupported SSH key, ed25519, ECDSA or RSA key in authorized_keys format expected"))
+			return
+		}
+		if log.Check(log.WarnLevel, "Adding SSH key of "+owner, db.AddUserSSHKey(owner, key)) {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Failed to add SSH key"))
+			return
+		}
+		w.Write([]byte(sshsig.Fingerprint(key)))
+		log.Info("User " + owner + " added SSH key " + sshsig.Fingerprint(key))
+	case http.MethodDelete:
+		fingerprint := r.FormValue("fingerprint")
+		if len(fingerprint) == 0 {
+			fingerprint = r.URL.Query().Get("fingerprint")
+		}
+		for _, key := range db.UserSSHKeys(owner) {
+			if len(fingerprint) > 0 && sshsig.Fingerprint(key) == fingerprint {
+				db.RemoveUserSSHKey(owner, key)
+				w.Write([]byte("Removed"))
+				log.Info("User " + owner + " removed SSH key " + fingerprint)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Key not found"))
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Incorrect method"))
+	}
+}
+
+type sshKeyInfo struct {
+	Fingerprint string `json:"fingerprint"`
+	Key         string `json:"key"`
+}
+
+// KeyList returns authorized user's keys with fingerprints, expiration and revocation dates.
+// Hub and subutai may request keys of any other user.
+func KeyList(w http.ResponseWriter, r *http.Request) {
+	owner := RequestOwner(r)
+	if len(owner) == 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("Not authorized"))
+		log.Warn(utils.ClientIP(r) + " - rejecting unauthorized key list request")
+		return
+	}
+	user := r.URL.Query().Get("user")
+	if len(user) == 0 {
+		user = owner
+	} else if !strings.EqualFold(user, owner) && owner != "Hub" && owner != "subutai" {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("Forbidden"))
+		return
+	}
+	list := []keyInfo{}
+	for _, key := range db.UserKeys(user) {
+		list = append(list, newKeyInfo(key, time.Time{}))
+	}
+	for key, date := range db.RevokedKeys(user) {
+		list = append(list, newKeyInfo(key, date))
+	}
+	out, err := json.Marshal(list)
+	if log.Check(log.WarnLevel, "Marshaling key list", err) {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Write(out)
+}
+
+// RevokeKey revokes one of authorized user's keys by its fingerprint.
+// The only active key can't be revoked, it should be rotated instead.
+func RevokeKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Incorrect method"))
+		return
+	}
+	owner := RequestOwner(r)
+	if len(owner) == 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("Not authorized"))
+		log.Warn(utils.ClientIP(r) + " - rejecting unauthorized key revocation request")
+		return
+	}
+	key := userKey(owner, r.FormValue("fingerprint"))
+	if len(key) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Key not found"))
+		return
+	}
+	if len(db.UserKeys(owner)) < 2 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Can't revoke the only active key, rotate it instead"))
+		return
+	}
+	if log.Check(log.WarnLevel, "Revoking key of "+owner, db.RevokeUserKey(owner, key)) {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Failed to revoke key"))
+		return
+	}
+	w.Write([]byte("Key revoked"))
+	log.Info("User " + owner + " revoked key " + strings.ToLower(r.FormValue("fingerprint")))
+}
+
+// RotateKey replaces one of authorized user's keys with the new one.
+// Request should contain the new public key and its fingerprint clearsigned by the key being replaced.
+func RotateKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Incorrect method"))
+		return
+	}
+	owner := RequestOwner(r)
+	if len(owner) == 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("Not authorized"))
+		log.Warn(utils.ClientIP(r) + " - rejecting unauthorized key rotation request")
+		return
+	}
+	key := r.FormValue("key")
+	fingerprint := fmt.Sprintf("%x", pgp.Fingerprint(key))
+	if len(key) == 0 || len(fingerprint) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Failed to read new key"))
+		return
+	}
+	content, old := pgp.Signer(owner, r.FormValue("signature"))
+	if len(old) == 0 || !strings.EqualFold(strings.TrimSpace(content), fingerprint) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("New key fingerprint should be signed by the old key"))
+		log.Warn(utils.ClientIP(r) + " - rejecting key rotation request of " + owner + ": signature check failed")
+		return
+	}
+	if err := db.RegisterUser([]byte(owner), []byte(key)); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if log.Check(log.WarnLevel, "Revoking key of "+owner, db.RevokeUserKey(owner, old)) {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Failed to revoke old key"))
+		return
+	}
+	w.Write([]byte("Key rotated"))
+	log.Info("User " + owner + " rotated key to " + fingerprint)
+}
+
+type keyInfo struct {
+	Fingerprint string `json:"fingerprint"`
+	Status      string `json:"status"`
+	Expires     string `json:"expires,omitempty"`
+	Revoked     string `json:"revoked,omitempty"`
+	Key         string `json:"key"`
+}
+
+func newKeyInfo(key string, revoked time.Time) keyInfo {
+	info := keyInfo{Fingerprint: fmt.Sprintf("%x", pgp.Fingerprint(key)), Status: "active", Key: key}
+	if expires := pgp.Expiry(key); !expires.IsZero() {
+		info.Expires = expires.Format(time.RFC3339)
+		if expires.Before(time.Now()) {
+			info.Status = "expired"
+		}
+	}
+	if pgp.Revoked(key) {
+		info.Status = "revoked"
+	}
+	if !revoked.IsZero() {
+		info.Status = "revoked"
+		info.Revoked = revoked.Format(time.RFC3339)
+	}
+	return info
+}
+
+// userKey returns user's active key with requested fingerprint
+func userKey(user, fingerprint string) string {
+	for _, key := range db.UserKeys(user) {
+		if len(fingerprint) > 0 && strings.EqualFold(fmt.Sprintf("%x", pgp.Fingerprint(key)), strings.TrimSpace(fingerprint)) {
+			return key
+		}
+	}
+	return ""
+}
+
 // Key is replaced by Keys and left for compatibility. This function should be removed later.
 func Key(w http.ResponseWriter, r *http.Request) {
 	user := r.URL.Query().Get("user")
@@ -131,13 +409,13 @@ func Key(w http.ResponseWriter, r *http.Request) {
 
 func Sign(w http.ResponseWriter, r *http.Request) {
 	r.ParseMultipartForm(32 << 20)
-	if len(r.MultipartForm.Value["token"]) == 0 || len(db.TokenOwner(r.MultipartForm.Value["token"][0])) == 0 {
+	owner := RequestOwner(r)
+	if len(owner) == 0 {
 		w.WriteHeader(http.StatusUnauthorized)
 		w.Write([]byte("Not authorized"))
-		log.Warn(r.RemoteAddr + " - rejecting unauthorized sign request")
+		log.Warn(utils.ClientIP(r) + " - rejecting unauthorized sign request")
 		return
 	}
-	owner := db.TokenOwner(r.MultipartForm.Value["token"][0])
 	if len(r.MultipartForm.Value["signature"]) == 0 {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte("Empty signature"))
@@ -166,12 +444,11 @@ func Sign(w http.ResponseWriter, r *http.Request) {
 }
 
 func Owner(w http.ResponseWriter, r *http.Request) {
-	token := strings.ToLower(r.URL.Query().Get("token"))
-	owner := strings.ToLower(db.TokenOwner(token))
-	if len(token) == 0 || len(owner) == 0 {
+	owner := strings.ToLower(RequestOwner(r))
+	if len(owner) == 0 {
 		w.WriteHeader(http.StatusUnauthorized)
 		w.Write([]byte("Not authorized"))
-		log.Warn(r.RemoteAddr + " - rejecting unauthorized owner request")
+		log.Warn(utils.ClientIP(r) + " - rejecting unauthorized owner request")
 		return
 	}
 	w.Write([]byte(owner))
@@ -0,0 +1,308 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/subutai-io/agent/log"
+
+	"github.com/subutai-io/cdn/config"
+	"github.com/subutai-io/cdn/db"
+	"github.com/subutai-io/cdn/utils"
+)
+
+// jwksTTL is the period after which JWKS is reloaded from configured file or URL
+const jwksTTL = time.Hour
+
+var jwks = &keySet{}
+
+// keySet caches public keys of identity provider by their key ID
+type keySet struct {
+	sync.Mutex
+	source  string
+	loaded  time.Time
+	tried   time.Time
+	loading bool
+	keys    map[string]crypto.PublicKey
+}
+
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// JWTOwner verifies JWT issued by external identity provider and returns the name of gorjun user it maps to.
+// Empty string is returned if OIDC is not configured or token is invalid.
+func JWTOwner(token string) string {
+	if len(config.OIDC.Jwks) == 0 || strings.Count(token, ".") != 2 {
+		return ""
+	}
+	claims, err := verifyJWT(token, time.Now())
+	if log.Check(log.WarnLevel, "Verifying JWT", err) {
+		return ""
+	}
+	return claimsOwner(claims)
+}
+
+// claimsOwner maps JWT claims to gorjun user. Roles listed in config as "role = <claim value>:<user>"
+// take precedence over user claim, so identity provider groups can act as privileged gorjun users.
+// User claim may be editable by users of identity provider, so it never maps to administrators
+// or to users registered with PGP keys, these are reachable through role mapping only.
+func claimsOwner(claims map[string]interface{}) string {
+	for _, role := range claimValues(claims[config.OIDC.Roleclaim]) {
+		for _, mapping := range config.OIDC.Role {
+			if pair := strings.SplitN(mapping, ":", 2); len(pair) == 2 && strings.TrimSpace(pair[0]) == role {
+				return strings.TrimSpace(pair[1])
+			}
+		}
+	}
+	claim := config.OIDC.Userclaim
+	if len(claim) == 0 {
+		claim = "sub"
+	}
+	user := claimValues(claims[claim])
+	if len(user) == 0 {
+		return ""
+	}
+	name := strings.ToLower(user[0])
+	if name == "subutai" || name == "hub" || len(db.UserKey(name)) != 0 || len(db.UserKeys(name)) != 0 {
+		log.Warn("JWT claim " + claim + " refers to existing user " + name + " outside of role mapping, rejecting")
+		return ""
+	}
+	return name
+}
+
+func verifyJWT(token string, now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("Malformed header: %v", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("Malformed signature: %v", err)
+	}
+	key, err := jwks.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err = verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, err
+	}
+	claims := make(map[string]interface{})
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("Malformed claims: %v", err)
+	}
+	if exp, ok := claims["exp"].(float64); !ok || now.After(time.Unix(int64(exp), 0)) {
+		return nil, fmt.Errorf("Token is expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Before(time.Unix(int64(nbf), 0)) {
+		return nil, fmt.Errorf("Token is not valid yet")
+	}
+	if len(config.OIDC.Issuer) != 0 && claims["iss"] != config.OIDC.Issuer {
+		return nil, fmt.Errorf("Unexpected issuer %v", claims["iss"])
+	}
+	if len(config.OIDC.Audience) != 0 && !utils.In([]string{config.OIDC.Audience}, claimValues(claims["aud"])) {
+		return nil, fmt.Errorf("Token is issued for another audience")
+	}
+	return claims, nil
+}
+
+func verifySignature(alg string, key crypto.PublicKey, payload, signature []byte) error {
+	var hash crypto.Hash
+	if len(alg) != 5 {
+		return fmt.Errorf("Unsupported algorithm %s", alg)
+	}
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("Unsupported algorithm %s", alg)
+	}
+	h := hash.New()
+	h.Write(payload)
+	digest := h.Sum(nil)
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if strings.HasPrefix(alg, "RS") {
+			return rsa.VerifyPKCS1v15(k, hash, digest, signature)
+		} else if strings.HasPrefix(alg, "PS") {
+			return rsa.VerifyPSS(k, hash, digest, signature, nil)
+		}
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if strings.HasPrefix(alg, "ES") && len(signature) == 2*size {
+			r := new(big.Int).SetBytes(signature[:size])
+			s := new(big.Int).SetBytes(signature[size:])
+			if ecdsa.Verify(k, digest, r, s) {
+				return nil
+			}
+			return fmt.Errorf("Signature verification failed")
+		}
+	}
+	return fmt.Errorf("Algorithm %s doesn't match key type", alg)
+}
+
+// key returns identity provider key by its ID. Keys are reloaded when the cache is stale or the key is unknown,
+// which happens after identity provider rotates its keys. JWKS is fetched without holding the lock, and keys
+// loaded last time keep being served while the identity provider is unreachable.
+func (s *keySet) key(kid string) (crypto.PublicKey, error) {
+	source := config.OIDC.Jwks
+	s.Lock()
+	reload := !s.loading && (s.source != source ||
+		(time.Since(s.loaded) > jwksTTL || s.keys[kid] == nil) && time.Since(s.tried) > time.Minute)
+	if reload {
+		s.loading = true
+	}
+	s.Unlock()
+	if reload {
+		keys, err := loadJWKS(source)
+		s.Lock()
+		s.loading, s.tried = false, time.Now()
+		if err == nil {
+			s.source, s.loaded, s.keys = source, time.Now(), keys
+		} else if s.source != source {
+			s.Unlock()
+			return nil, err
+		}
+		s.Unlock()
+		log.Check(log.WarnLevel, "Reloading JWKS, keeping keys loaded before", err)
+	}
+	s.Lock()
+	defer s.Unlock()
+	if key := s.keys[kid]; key != nil {
+		return key, nil
+	}
+	if len(kid) == 0 && len(s.keys) == 1 {
+		for _, key := range s.keys {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("Key %s not found in JWKS", kid)
+}
+
+func loadJWKS(source string) (map[string]crypto.PublicKey, error) {
+	var data []byte
+	var err error
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		var resp *http.Response
+		client := &http.Client{Timeout: 10 * time.Second}
+		if resp, err = client.Get(source); err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("Fetching JWKS: %s", resp.Status)
+		}
+		data, err = ioutil.ReadAll(resp.Body)
+	} else {
+		data, err = ioutil.ReadFile(source)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err = json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if log.Check(log.WarnLevel, "Parsing JWKS key "+k.Kid, err) {
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	return keys, nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("Unsupported curve %s", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+	return nil, fmt.Errorf("Unsupported key type %s", k.Kty)
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// claimValues returns claim as list of strings, claims like "aud" or "groups" may be either string or array
+func claimValues(claim interface{}) (list []string) {
+	switch v := claim.(type) {
+	case string:
+		list = append(list, v)
+	case []interface{}:
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,152 @@
+package auth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/subutai-io/cdn/config"
+	"github.com/subutai-io/cdn/db"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+func encodeSegment(v interface{}) string {
+	data, _ := json.Marshal(v)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func pad(b []byte, size int) []byte {
+	return append(make([]byte, size-len(b)), b...)
+}
+
+func signJWT(t *testing.T, key crypto.Signer, alg, kid string, claims map[string]interface{}) string {
+	payload := encodeSegment(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"}) + "." + encodeSegment(claims)
+	digest := crypto.SHA256.New()
+	digest.Write([]byte(payload))
+	var signature []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest.Sum(nil)); err != nil {
+			t.Fatalf("Failed to sign JWT: %v", err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest.Sum(nil))
+		if err != nil {
+			t.Fatalf("Failed to sign JWT: %v", err)
+		}
+		signature = append(pad(r.Bytes(), 32), pad(s.Bytes(), 32)...)
+	}
+	return payload + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func publicKey(t *testing.T, name string) []byte {
+	entity, err := openpgp.NewEntity(name, "", name+"@example.com", nil)
+	if err != nil {
+		t.Fatalf("Failed to generate PGP key: %v", err)
+	}
+	var buf bytes.Buffer
+	w, _ := armor.Encode(&buf, openpgp.PublicKeyType, nil)
+	entity.Serialize(w)
+	w.Close()
+	return buf.Bytes()
+}
+
+func TestJWTOwner(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate RSA key: %v", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate EC key: %v", err)
+	}
+	dir, err := ioutil.TempDir("", "gorjun-jwks")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	set := map[string][]map[string]string{"keys": {
+		{"kty": "RSA", "kid": "rsa", "use": "sig",
+			"n": base64.RawURLEncoding.EncodeToString(rsaKey.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{"kty": "EC", "kid": "ec", "crv": "P-256",
+			"x": base64.RawURLEncoding.EncodeToString(pad(ecKey.X.Bytes(), 32)),
+			"y": base64.RawURLEncoding.EncodeToString(pad(ecKey.Y.Bytes(), 32))},
+	}}
+	data, _ := json.Marshal(set)
+	ioutil.WriteFile(filepath.Join(dir, "jwks.json"), data, 0600)
+	config.DB.Path, config.Storage.Path = filepath.Join(dir, "my.db"), dir+"/"
+	if err = db.RegisterUser([]byte("alice"), publicKey(t, "alice")); err != nil {
+		t.Fatalf("Failed to register user: %v", err)
+	}
+
+	saved := config.OIDC
+	defer func() { config.OIDC = saved }()
+	config.OIDC.Jwks = filepath.Join(dir, "jwks.json")
+	config.OIDC.Issuer = "https://sso.example.com"
+	config.OIDC.Audience = "gorjun"
+	config.OIDC.Userclaim = "preferred_username"
+	config.OIDC.Roleclaim = "groups"
+	config.OIDC.Role = []string{"release-managers:subutai"}
+
+	claims := func(extra map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":                "https://sso.example.com",
+			"aud":                []string{"gorjun", "other"},
+			"exp":                time.Now().Add(time.Hour).Unix(),
+			"preferred_username": "Jdoe",
+		}
+		for k, v := range extra {
+			c[k] = v
+		}
+		return c
+	}
+	tests := []struct {
+		name  string
+		token string
+		want  string
+	}{
+		{"TestJWTOwner-1", signJWT(t, rsaKey, "RS256", "rsa", claims(nil)), "jdoe"},
+		{"TestJWTOwner-2", signJWT(t, ecKey, "ES256", "ec", claims(nil)), "jdoe"},
+		{"TestJWTOwner-3", signJWT(t, rsaKey, "RS256", "rsa", claims(map[string]interface{}{"exp": time.Now().Add(-time.Minute).Unix()})), ""},
+		{"TestJWTOwner-4", signJWT(t, rsaKey, "RS256", "rsa", claims(map[string]interface{}{"aud": "somebody-else"})), ""},
+		{"TestJWTOwner-5", signJWT(t, rsaKey, "RS256", "rsa", claims(map[string]interface{}{"iss": "https://evil.example.com"})), ""},
+		{"TestJWTOwner-6", signJWT(t, rsaKey, "RS256", "rsa", claims(map[string]interface{}{"groups": []string{"dev", "release-managers"}})), "subutai"},
+		{"TestJWTOwner-7", signJWT(t, rsaKey, "RS256", "ec", claims(nil)), ""},
+		{"TestJWTOwner-8", strings.Replace(signJWT(t, rsaKey, "RS256", "rsa", claims(nil)), ".", ".e30", 1), ""},
+		{"TestJWTOwner-9", "not.a.jwt", ""},
+		{"TestJWTOwner-10", signJWT(t, rsaKey, "RS256", "rsa", claims(map[string]interface{}{"preferred_username": "Subutai"})), ""},
+		{"TestJWTOwner-11", signJWT(t, rsaKey, "RS256", "rsa", claims(map[string]interface{}{"preferred_username": "Hub"})), ""},
+		{"TestJWTOwner-12", signJWT(t, rsaKey, "RS256", "rsa", claims(map[string]interface{}{"preferred_username": "alice"})), ""},
+		// TODO: Add test cases.
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := JWTOwner(tt.token); got != tt.want {
+				t.Errorf("JWTOwner() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	os.Remove(config.OIDC.Jwks)
+	jwks.Lock()
+	jwks.loaded, jwks.tried = time.Now().Add(-2*jwksTTL), time.Time{}
+	jwks.Unlock()
+	if got := JWTOwner(signJWT(t, rsaKey, "RS256", "rsa", claims(nil))); got != "jdoe" {
+		t.Errorf("JWTOwner() with unreachable JWKS = %v, want keys loaded before to be used", got)
+	}
+}
@@ -0,0 +1,143 @@
+package auth
+
+import (
+	"expvar"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/subutai-io/agent/log"
+
+	"github.com/subutai-io/cdn/utils"
+)
+
+var (
+	// requests limits the rate of calls to authentication endpoints per client address and per user name
+	// requested from that address
+	requests = newLimiter(30, time.Minute, 5*time.Minute)
+	// failures locks out client addresses and users after repeated invalid tokens or signatures. Users are
+	// counted per client address, so nobody can lock others out of their accounts by guessing on their behalf.
+	failures = newLimiter(10, 10*time.Minute, 15*time.Minute)
+	// accounts limits the rate of requests for one user name from all client addresses together, so guessing
+	// from many addresses is slowed down too. It has no lockout, requests are accepted again in the next window.
+	accounts = newLimiter(60, time.Minute, 0)
+
+	// throttled counts rejected attempts, exposed to administrators on /debug/vars
+	throttled = expvar.NewMap("auth_throttled")
+)
+
+// limiter counts hits per key within fixed window and locks the key out once the limit is exceeded.
+// Zero lockout keeps the key locked until the end of current window only.
+type limiter struct {
+	sync.Mutex
+	limit   int
+	window  time.Duration
+	lockout time.Duration
+	keys    map[string]*counter
+}
+
+type counter struct {
+	start  time.Time
+	hits   int
+	locked time.Time
+}
+
+func newLimiter(limit int, window, lockout time.Duration) *limiter {
+	return &limiter{limit: limit, window: window, lockout: lockout, keys: make(map[string]*counter)}
+}
+
+// hit registers attempt and returns false if the key is locked out
+func (l *limiter) hit(key string) bool {
+	l.Lock()
+	defer l.Unlock()
+	now := time.Now()
+	l.cleanup(now)
+	c := l.keys[key]
+	if c == nil {
+		c = &counter{start: now}
+		l.keys[key] = c
+	}
+	if now.Before(c.locked) {
+		return false
+	}
+	if now.Sub(c.start) > l.window {
+		c.start, c.hits = now, 0
+	}
+	if c.hits++; c.hits > l.limit {
+		if c.locked = now.Add(l.lockout); l.lockout == 0 {
+			c.locked = c.start.Add(l.window)
+		}
+		return false
+	}
+	return true
+}
+
+// retry returns time left until the key is unlocked, zero if the key is not locked
+func (l *limiter) retry(key string) time.Duration {
+	l.Lock()
+	defer l.Unlock()
+	if c := l.keys[key]; c != nil && time.Now().Before(c.locked) {
+		return time.Until(c.locked)
+	}
+	return 0
+}
+
+// cleanup drops counters which are neither locked nor counted in current window, so the map doesn't grow unbounded
+func (l *limiter) cleanup(now time.Time) {
+	if len(l.keys) < 10000 {
+		return
+	}
+	for key, c := range l.keys {
+		if now.Sub(c.start) > l.window && now.After(c.locked) {
+			delete(l.keys, key)
+		}
+	}
+}
+
+// keys returns limiter keys of client address and of user requested from that address, if user is specified
+func keys(r *http.Request, user string) []string {
+	ip := utils.ClientIP(r)
+	if len(user) == 0 {
+		return []string{"ip:" + ip}
+	}
+	return []string{"ip:" + ip, "user:" + user + "@" + ip}
+}
+
+// limited checks request rate and lockout of client address and user, if user is specified, and request rate
+// of the user from all addresses. Status 429 with Retry-After header is written if the request should be rejected.
+func limited(w http.ResponseWriter, r *http.Request, user string) bool {
+	for _, key := range keys(r, user) {
+		wait := failures.retry(key)
+		if wait == 0 && !requests.hit(key) {
+			wait = requests.retry(key)
+		}
+		if wait != 0 {
+			reject(w, r, key, wait)
+			return true
+		}
+	}
+	if key := "user:" + user; len(user) != 0 && !accounts.hit(key) {
+		reject(w, r, key, accounts.retry(key))
+		return true
+	}
+	return false
+}
+
+// failed registers failed authentication attempt of client address and user, if user is specified.
+func failed(r *http.Request, user string) {
+	for _, key := range keys(r, user) {
+		if !failures.hit(key) {
+			log.Warn(utils.ClientIP(r) + " - " + key + " is locked out after repeated authentication failures")
+		}
+	}
+}
+
+func reject(w http.ResponseWriter, r *http.Request, key string, wait time.Duration) {
+	throttled.Add(strings.SplitN(key, ":", 2)[0], 1)
+	log.Warn(utils.ClientIP(r) + " - throttling " + r.URL.Path + " request of " + key)
+	w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+	w.WriteHeader(http.StatusTooManyRequests)
+	w.Write([]byte("Too many requests"))
+}
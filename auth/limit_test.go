@@ -0,0 +1,64 @@
+package auth
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	l := newLimiter(3, time.Minute, time.Minute)
+	tests := []struct {
+		name string
+		key  string
+		want bool
+	}{
+		{"TestLimiter-1", "ip:10.0.0.1", true},
+		{"TestLimiter-2", "ip:10.0.0.1", true},
+		{"TestLimiter-3", "ip:10.0.0.1", true},
+		{"TestLimiter-4", "ip:10.0.0.1", false},
+		{"TestLimiter-5", "ip:10.0.0.2", true},
+		{"TestLimiter-6", "ip:10.0.0.1", false},
+		// TODO: Add test cases.
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := l.hit(tt.key); got != tt.want {
+				t.Errorf("limiter.hit() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if l.retry("ip:10.0.0.1") == 0 || l.retry("ip:10.0.0.2") != 0 {
+		t.Errorf("limiter.retry() doesn't match lockout state")
+	}
+}
+
+func TestLimited(t *testing.T) {
+	saved := requests
+	defer func() { requests = saved }()
+	requests = newLimiter(1, time.Minute, time.Minute)
+
+	r := httptest.NewRequest("GET", "/kurjun/rest/auth/token?user=jdoe", nil)
+	if w := httptest.NewRecorder(); limited(w, r, "jdoe") {
+		t.Errorf("limited() rejected the first request")
+	}
+	w := httptest.NewRecorder()
+	if !limited(w, r, "jdoe") {
+		t.Errorf("limited() accepted request over the limit")
+	}
+	if w.Code != 429 || len(w.Header().Get("Retry-After")) == 0 {
+		t.Errorf("limited() responded with %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	savedAccounts := accounts
+	defer func() { accounts = savedAccounts }()
+	requests, accounts = newLimiter(10, time.Minute, time.Minute), newLimiter(2, time.Minute, 0)
+	for i, want := range []bool{false, false, true} {
+		r := httptest.NewRequest("GET", "/kurjun/rest/auth/token?user=alice", nil)
+		r.RemoteAddr = "10.0.1." + strconv.Itoa(i+1) + ":1234"
+		if got := limited(httptest.NewRecorder(), r, "alice"); got != want {
+			t.Errorf("limited() for request %d of alice from new address = %v, want %v", i+1, got, want)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/subutai-io/agent/log"
+
+	"github.com/subutai-io/cdn/db"
+	"github.com/subutai-io/cdn/utils"
+)
+
+type contextKey int
+
+const tokenKey contextKey = iota
+
+// Middleware takes token from "Authorization: Bearer <token>" header and puts it into request context,
+// so every handler receives credentials the same way regardless of the form used by client.
+// Metrics on /debug/vars are served to administrators only.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token := bearer(r); len(token) != 0 {
+			r = r.WithContext(context.WithValue(r.Context(), tokenKey, token))
+		}
+		// expvar publishes internal counters on default mux, they are not meant for everybody
+		if r.URL.Path == "/debug/vars" {
+			if owner := RequestOwner(r); owner != "subutai" && owner != "Hub" {
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte("Not authorized"))
+				log.Warn(utils.ClientIP(r) + " - rejecting unauthorized metrics request")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequestToken returns token provided with request. Authorization header has the highest priority,
+// then legacy forms are checked: "token" header, query parameter and form field.
+func RequestToken(r *http.Request) string {
+	if token, ok := r.Context().Value(tokenKey).(string); ok {
+		return token
+	}
+	if token := bearer(r); len(token) != 0 {
+		return token
+	}
+	if token := r.Header.Get("token"); len(token) != 0 {
+		return strings.TrimSpace(token)
+	}
+	if token := r.URL.Query().Get("token"); len(token) != 0 {
+		return strings.TrimSpace(token)
+	}
+	if r.MultipartForm != nil && len(r.MultipartForm.Value["token"]) > 0 {
+		return strings.TrimSpace(r.MultipartForm.Value["token"][0])
+	}
+	if r.Method == http.MethodPost || r.Method == http.MethodPut || r.Method == http.MethodDelete {
+		return strings.TrimSpace(r.FormValue("token"))
+	}
+	return ""
+}
+
+// RequestOwner returns the name of user who owns token provided with request.
+// Clients which repeatedly send invalid tokens are locked out for a while and get empty owner.
+func RequestOwner(r *http.Request) string {
+	token := RequestToken(r)
+	if len(token) == 0 {
+		return ""
+	}
+	if failures.retry("ip:"+utils.ClientIP(r)) != 0 {
+		throttled.Add("token", 1)
+		log.Warn(utils.ClientIP(r) + " - ignoring token of locked out client")
+		return ""
+	}
+	owner := TokenOwner(token)
+	if len(owner) == 0 {
+		failed(r, "")
+	}
+	return owner
+}
+
+// TokenOwner returns the name of user who owns token. Token may be either issued by gorjun itself
+// or JWT signed by configured identity provider. Empty string is returned for empty, unknown or expired token.
+func TokenOwner(token string) string {
+	if len(token) == 0 {
+		return ""
+	}
+	if owner := JWTOwner(token); len(owner) != 0 {
+		return owner
+	}
+	return db.TokenOwner(strings.ToLower(token))
+}
+
+func bearer(r *http.Request) string {
+	header := strings.TrimSpace(r.Header.Get("Authorization"))
+	if len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+	return ""
+}
@@ -0,0 +1,67 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestRequestToken(t *testing.T) {
+	tests := []struct {
+		name    string
+		request func() *http.Request
+		want    string
+	}{
+		{"TestRequestToken-1", func() *http.Request {
+			r := httptest.NewRequest(http.MethodGet, "/kurjun/rest/quota", nil)
+			r.Header.Set("Authorization", "Bearer abc")
+			return r
+		}, "abc"},
+		{"TestRequestToken-2", func() *http.Request {
+			r := httptest.NewRequest(http.MethodGet, "/kurjun/rest/quota?token=query", nil)
+			r.Header.Set("Authorization", "bearer header")
+			return r
+		}, "header"},
+		{"TestRequestToken-3", func() *http.Request {
+			r := httptest.NewRequest(http.MethodPost, "/kurjun/rest/raw/upload", nil)
+			r.Header.Set("token", "legacy")
+			return r
+		}, "legacy"},
+		{"TestRequestToken-4", func() *http.Request {
+			return httptest.NewRequest(http.MethodGet, "/kurjun/rest/raw/info?token=query", nil)
+		}, "query"},
+		{"TestRequestToken-5", func() *http.Request {
+			r := httptest.NewRequest(http.MethodPost, "/kurjun/rest/quota", strings.NewReader(url.Values{"token": {"form"}}.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			return r
+		}, "form"},
+		{"TestRequestToken-6", func() *http.Request {
+			r := httptest.NewRequest(http.MethodGet, "/kurjun/rest/raw/info", nil)
+			r.Header.Set("Authorization", "Basic dXNlcjpwYXNz")
+			return r
+		}, ""},
+		// TODO: Add test cases.
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := RequestToken(tt.request()); got != tt.want {
+				t.Errorf("RequestToken() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	var got string
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = RequestToken(r)
+	}))
+	r := httptest.NewRequest(http.MethodGet, "/kurjun/rest/raw/info?token=query", nil)
+	r.Header.Set("Authorization", "Bearer header")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	if got != "header" {
+		t.Errorf("Middleware() passed token %v, want %v", got, "header")
+	}
+}
@@ -18,6 +18,10 @@ go get
 
 sudo chmod -R 777 /opt
 mkdir /opt/gorjun
+mkdir -p /opt/gorjun/etc
+if [ ! -f /opt/gorjun/etc/gorjun.gcfg ]; then
+	printf "[network]\ntrustedproxy = 127.0.0.1\n" > /opt/gorjun/etc/gorjun.gcfg
+fi
 
 sudo touch /etc/systemd/system/gorjun.service
 sudo chmod 777 /etc/systemd/system/gorjun.service
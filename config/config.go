@@ -11,14 +11,45 @@ type cdnConfig struct {
 	Node string
 }
 type networkConfig struct {
-	Port string
+	Port         string
+	Trustedproxy []string
 }
 type dbConfig struct {
-	Path string
+	Path           string
+	Driver         string
+	Dsn            string
+	Automigrate    bool
+	Backup         bool
+	Backupdir      string
+	Backupinterval int
+	Backupkeep     int
 }
 type fileConfig struct {
-	Path      string
-	Userquota string
+	Path           string
+	Userquota      string
+	Trashretention int
+}
+type aptConfig struct {
+	Keyring      string
+	Identity     string
+	Passphrase   string
+	Suite        string
+	Component    string
+	Architecture []string
+	Byhashkeep   int
+}
+type aptSuiteConfig struct {
+	Keyring    string
+	Identity   string
+	Passphrase string
+}
+type oidcConfig struct {
+	Jwks      string
+	Issuer    string
+	Audience  string
+	Userclaim string
+	Roleclaim string
+	Role      []string
 }
 
 type configFile struct {
@@ -26,21 +57,57 @@ type configFile struct {
 	CDN     cdnConfig
 	Network networkConfig
 	Storage fileConfig
+	OIDC    oidcConfig
+	APT     aptConfig
+	Suites  map[string]*aptSuiteConfig `gcfg:"apt-suite"`
 }
 
 const defaultConfig = `
 	[db]
 	path = /opt/gorjun/data/db/my.db
+	; "sqlite3" or "postgres" store given by dsn may be shared by several gorjun processes,
+	; backup, restore, export and import work with bolt store only
+	driver = bolt
+	dsn =
+	automigrate = true
+	backup = true
+	backupdir =
+	backupinterval = 24
+	backupkeep = 7
 
 	[CDN]
 	node =
 
 	[network]
 	port = 8080
+	trustedproxy = 127.0.0.1
+	; trustedproxy = 10.0.0.0/8
 
 	[storage]
 	path = /opt/gorjun/data/files/
 	userquota = 2G
+	trashretention = 168
+
+	[apt]
+	keyring = /opt/gorjun/etc/apt-signing.asc
+	identity = subutai-release@subutai.io
+	passphrase =
+	suite = stable
+	component = main
+	architecture = amd64
+	byhashkeep = 3
+
+	; [apt-suite "testing"]
+	; keyring = /opt/gorjun/etc/apt-testing.asc
+	; identity = testing@example.com
+	; passphrase =
+
+	[oidc]
+	jwks =
+	issuer =
+	audience =
+	userclaim = sub
+	roleclaim = groups
 `
 
 var (
@@ -50,6 +117,10 @@ var (
 	CDN     cdnConfig
 	Network networkConfig
 	Storage fileConfig
+	OIDC    oidcConfig
+	APT     aptConfig
+	// APTSuite holds signing keys of suites which are not signed by the key of [apt] section
+	APTSuite map[string]*aptSuiteConfig
 )
 
 func init() {
@@ -66,6 +137,9 @@ func init() {
 	// CDN      = "https://cdn.subut.ai:8338"
 	Network = config.Network
 	Storage = config.Storage
+	OIDC = config.OIDC
+	APT = config.APT
+	APTSuite = config.Suites
 }
 
 func DefaultQuota() int {
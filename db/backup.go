@@ -0,0 +1,129 @@
+package db
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/subutai-io/agent/log"
+	"github.com/subutai-io/cdn/config"
+)
+
+// Backup writes consistent snapshot of database to w. Snapshot is taken in read transaction,
+// so server keeps serving requests while backup is running.
+func Backup(w io.Writer) (size int64, err error) {
+	if opened(); db == nil {
+		return 0, errBoltOnly
+	}
+	err = db.View(func(tx *bolt.Tx) error {
+		size, err = tx.WriteTo(w)
+		return err
+	})
+	return
+}
+
+// BackupFile saves snapshot of database to file
+func BackupFile(path string) error {
+	if opened(); db == nil {
+		return errBoltOnly
+	}
+	return db.View(func(tx *bolt.Tx) error {
+		return tx.CopyFile(path, 0600)
+	})
+}
+
+// ScheduledBackup saves snapshot of database to configured backup directory
+// and removes the oldest snapshots exceeding configured retention.
+func ScheduledBackup() {
+	if len(config.DB.Backupdir) == 0 {
+		return
+	}
+	if opened(); db == nil {
+		log.Warn("Scheduled backup is skipped: " + errBoltOnly.Error())
+		return
+	}
+	if log.Check(log.WarnLevel, "Creating backup directory", os.MkdirAll(config.DB.Backupdir, 0700)) {
+		return
+	}
+	// Scheduled snapshots have their own prefix, so retention doesn't touch copies saved before restore or migration
+	prefix := filepath.Join(config.DB.Backupdir, filepath.Base(config.DB.Path)+".backup-")
+	path := prefix + time.Now().Format("20060102150405")
+	if log.Check(log.WarnLevel, "Backing up database to "+path, BackupFile(path)) {
+		return
+	}
+	log.Info("Database is backed up to " + path)
+	if config.DB.Backupkeep <= 0 {
+		return
+	}
+	list, _ := filepath.Glob(prefix + "*")
+	sort.Strings(list)
+	for i := 0; i < len(list)-config.DB.Backupkeep; i++ {
+		log.Check(log.WarnLevel, "Removing old backup "+list[i], os.Remove(list[i]))
+	}
+}
+
+// Restore replaces database with snapshot from file. Snapshot must contain gorjun buckets and its schema
+// must not be newer than supported by this build, older snapshots are migrated on the next start.
+// Current database is kept next to it with ".pre-restore" suffix.
+func Restore(path string) error {
+	if opened(); db == nil {
+		return errBoltOnly
+	}
+	version, err := checkSnapshot(path)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	Close()
+	saved := config.DB.Path + ".pre-restore-" + time.Now().Format("20060102150405")
+	if err = os.Rename(config.DB.Path, saved); err != nil && !os.IsNotExist(err) {
+		db = InitDB()
+		return err
+	}
+	if err = ioutil.WriteFile(config.DB.Path, data, 0600); err != nil {
+		os.Rename(saved, config.DB.Path)
+		db = InitDB()
+		return err
+	}
+	db = InitDB()
+	log.Info(fmt.Sprintf("Database is restored from %s, schema version %d, previous database is saved to %s", path, version, saved))
+	return nil
+}
+
+// checkSnapshot opens snapshot read-only and returns its schema version
+func checkSnapshot(path string) (version int, err error) {
+	snapshot, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 3 * time.Second, ReadOnly: true})
+	if err != nil {
+		return 0, fmt.Errorf("Opening snapshot: %v", err)
+	}
+	defer snapshot.Close()
+	err = snapshot.View(func(tx *bolt.Tx) error {
+		missing := []string{}
+		for _, b := range [][]byte{MyBucket, SearchIndex, Users} {
+			if tx.Bucket(b) == nil {
+				missing = append(missing, string(b))
+			}
+		}
+		if len(missing) != 0 {
+			return fmt.Errorf("Snapshot is not gorjun database, missing buckets: %s", strings.Join(missing, ", "))
+		}
+		if b := tx.Bucket(Meta); b != nil {
+			version, _ = strconv.Atoi(string(b.Get(schemaKey)))
+		}
+		return nil
+	})
+	if err == nil && version > LatestSchema() {
+		err = fmt.Errorf("Snapshot schema version %d is newer than supported version %d", version, LatestSchema())
+	}
+	return
+}
@@ -3,7 +3,6 @@ package db
 import (
 	"crypto/sha256"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -15,7 +14,6 @@ import (
 	"github.com/boltdb/bolt"
 	"github.com/subutai-io/agent/log"
 	"github.com/subutai-io/cdn/config"
-	"github.com/subutai-io/cdn/utils"
 )
 
 var (
@@ -25,54 +23,76 @@ var (
 	Tokens      = []byte("Tokens")
 	AuthID      = []byte("AuthID")
 	Tags        = []byte("Tags")
-	db          = InitDB()
 )
 
+// db is opened only when bolt store is used, functions working with bolt file directly check it for nil
+var db *bolt.DB
+
 var (
 	publicScope  = []byte("94205120b9aa305d3167085d26735f1b") // MD5 Hash of "public-scope"
 	privateScope = []byte("06e3ef83aafe325400bdd4b0321be4ad") // MD5 Hash of "private-scope"
 )
 
+const (
+	authIDTTL = 10 * time.Minute // Lifetime of auth challenge
+	tokenTTL  = 24 * time.Hour   // Lifetime of session token
+)
+
 // AddShare adds user to share scope of file if the file wasn't shared with him yet
-func AddShare(hash, owner, user string) {
+func (s *boltStore) AddShare(hash, owner, user string) {
 	log.Debug(fmt.Sprintf("Sharing %+v's file %+v (filename: %+v) with user %+v", owner, hash, NameByHash(hash), user))
 	db.Update(func(tx *bolt.Tx) error {
-		if b := tx.Bucket(MyBucket).Bucket([]byte(hash)); b != nil {
-			if b := b.Bucket([]byte("scope")); b != nil {
-				if b.Get([]byte(user)) == nil {
-					log.Debug(fmt.Sprintf("Adding %+v to tx.Bucket(%+v).Bucket(%+v).Bucket(%+v)", user, string(MyBucket), hash, "scope"))
-					b.Put([]byte(user), []byte("w"))
-				}
+		addShare(tx, hash, user)
+		return nil
+	})
+	log.Debug(fmt.Sprintf("Sharing finished"))
+}
+
+// addShare adds user to share scope of file and file to user's files in transaction
+func addShare(tx *bolt.Tx, hash, user string) {
+	if b := tx.Bucket(MyBucket).Bucket([]byte(hash)); b != nil {
+		name := b.Get([]byte("name"))
+		if b := b.Bucket([]byte("scope")); b != nil {
+			if b.Get([]byte(user)) == nil {
+				log.Debug(fmt.Sprintf("Adding %+v to tx.Bucket(%+v).Bucket(%+v).Bucket(%+v)", user, string(MyBucket), hash, "scope"))
+				b.Put([]byte(user), []byte("w"))
 			}
-			if e := tx.Bucket(Users).Bucket([]byte(user)); e != nil {
-				if f, _ := e.CreateBucketIfNotExists([]byte("files")); f != nil {
-					if f.Get([]byte(hash)) == nil {
-						log.Debug(fmt.Sprintf("Putting %+v's file %+v (filename: %+v) to %+v's files Bucket", owner, hash, NameByHash(hash), user))
-						f.Put([]byte(hash), []byte(NameByHash(hash)))
-					} else {
-						log.Debug(fmt.Sprintf("File already put in files Bucket"))
-					}
+		}
+		if e := tx.Bucket(Users).Bucket([]byte(user)); e != nil {
+			if f, _ := e.CreateBucketIfNotExists([]byte("files")); f != nil {
+				if f.Get([]byte(hash)) == nil {
+					log.Debug(fmt.Sprintf("Putting file %+v (filename: %+v) to %+v's files Bucket", hash, string(name), user))
+					f.Put([]byte(hash), name)
+				} else {
+					log.Debug(fmt.Sprintf("File already put in files Bucket"))
 				}
 			}
 		}
-		return nil
-	})
-	log.Debug(fmt.Sprintf("Sharing finished"))
+	}
 }
 
-func CheckAuthID(token string) (name string) {
+// CheckAuthID returns the name of user who requested auth challenge. Every challenge can be used only once,
+// so it is removed from DB even if it has already expired.
+func (s *boltStore) CheckAuthID(token string) (name string) {
+	hash := []byte(fmt.Sprintf("%x", sha256.Sum256([]byte(token))))
 	db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket(AuthID)
-		if value := b.Get([]byte(token)); value != nil {
-			name = string(value)
-			b.Delete([]byte(token))
+		if c := b.Bucket(hash); c != nil {
+			date := new(time.Time)
+			date.UnmarshalText(c.Get([]byte("date")))
+			if date.Add(authIDTTL).After(time.Now()) {
+				name = string(c.Get([]byte("name")))
+			} else {
+				log.Debug(fmt.Sprintf("Auth ID %s is expired", hash))
+			}
+			return b.DeleteBucket(hash)
 		}
 		return nil
 	})
 	return
 }
 
-func CheckRepo(owner string, repo []string, hash string) (val int) {
+func (s *boltStore) CheckRepo(owner string, repo []string, hash string) (val int) {
 	log.Debug(fmt.Sprintf("CheckRepo (repo: \"%+v (len: %+v)\", owner: \"%+v\", file: \"%+v\" (name: %+v))", repo, len(repo), owner, hash, NameByHash(hash)))
 	if len(repo) == 0 {
 		repo = []string{"apt", "template", "raw"}
@@ -103,7 +123,7 @@ func CheckRepo(owner string, repo []string, hash string) (val int) {
 }
 
 // CheckShare returns true if user has access to file, otherwise - false
-func CheckShare(hash, user string) (shared bool) {
+func (s *boltStore) CheckShare(hash, user string) (shared bool) {
 	log.Debug(fmt.Sprintf("Checking if user %+v has access to file %+v (%+v)", user, hash, NameByHash(hash)))
 	db.View(func(tx *bolt.Tx) error {
 		if b := tx.Bucket(MyBucket).Bucket([]byte(hash)); b != nil {
@@ -116,13 +136,9 @@ func CheckShare(hash, user string) (shared bool) {
 						shared = true
 					}
 				} else {
-					log.Debug(fmt.Sprintf("Availability scopes are missing"))
-					if d := b.Bucket([]byte("owner")); d != nil {
-						owner, _ := d.Cursor().First()
-						RebuildShare(hash, string(owner))
-						shared = CheckShare(hash, user)
-					} else {
-						log.Panic(fmt.Sprintf("Cannot find compromise: line 123, info_test.go"))
+					log.Warn(fmt.Sprintf("Availability scopes of file %+v are missing, database migration is required", hash))
+					if d := b.Bucket([]byte("owner")); d != nil && d.Get([]byte(user)) != nil {
+						shared = true
 					}
 				}
 			}
@@ -133,18 +149,34 @@ func CheckShare(hash, user string) (shared bool) {
 	return
 }
 
-func CleanAuthID() {
+// CleanAuthID removes expired auth challenges and challenges stored in obsolete plain format
+func (s *boltStore) CleanAuthID() {
 	db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket(AuthID)
+		list := make([][]byte, 0)
 		b.ForEach(func(k, v []byte) error {
-			b.Delete(k)
+			if c := b.Bucket(k); c != nil {
+				date := new(time.Time)
+				date.UnmarshalText(c.Get([]byte("date")))
+				if date.Add(authIDTTL).After(time.Now()) {
+					return nil
+				}
+			}
+			list = append(list, k)
 			return nil
 		})
+		for _, k := range list {
+			if b.Bucket(k) != nil {
+				b.DeleteBucket(k)
+			} else {
+				b.Delete(k)
+			}
+		}
 		return nil
 	})
 }
 
-func CleanSearchIndex() {
+func (s *boltStore) CleanSearchIndex() {
 	db.Update(func(tx *bolt.Tx) error {
 		list := make([]string, 0)
 		b := tx.Bucket(SearchIndex)
@@ -170,7 +202,7 @@ func CleanSearchIndex() {
 	})
 }
 
-func CleanTokens() {
+func (s *boltStore) CleanTokens() {
 	db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket(Tokens)
 		b.ForEach(func(k, v []byte) error {
@@ -183,7 +215,7 @@ func CleanTokens() {
 	})
 }
 
-func CleanUserFiles() {
+func (s *boltStore) CleanUserFiles() {
 	db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket(Users)
 		b.ForEach(func(k, v []byte) error {
@@ -206,12 +238,12 @@ func CleanUserFiles() {
 	})
 }
 
-func Close() {
+func (s *boltStore) Close() {
 	db.Close()
 }
 
 // Count all artifacts that have MD5 equal to hash
-func CountMd5(hash string) (md5 int) {
+func (s *boltStore) CountMd5(hash string) (md5 int) {
 	db.View(func(tx *bolt.Tx) error {
 		if b := tx.Bucket(MyBucket); b != nil {
 			b.ForEach(func(k, v []byte) error {
@@ -228,27 +260,14 @@ func CountMd5(hash string) (md5 int) {
 	return
 }
 
-// CountTotal counts and sets user's total quota usage
-func CountTotal(user string) (total int) {
-	db.View(func(tx *bolt.Tx) error {
-		if b := tx.Bucket(Users).Bucket([]byte(user)); b != nil {
-			if c := b.Bucket([]byte("files")); c != nil {
-				c.ForEach(func(k, v []byte) error {
-					tmp, _ := strconv.Atoi(Info(string(k))["size"])
-					total += tmp
-					return nil
-				})
-			}
-		}
-		return nil
-	})
-	return
-}
-
 func DebugDatabase() {
 	//	log.Debug(fmt.Sprintf("\ndb.GoString():\n%+v\n", db.GoString()))
 	//	log.Debug(fmt.Sprintf("\ndb.Stats():\n%+v\n", db.Stats()))
 	//	log.Debug(fmt.Sprintf("\ndb.Info():\n%+v\n", db.Info()))
+	if opened(); db == nil {
+		log.Debug(errBoltOnly.Error())
+		return
+	}
 	db.View(func(tx *bolt.Tx) error {
 		tx.ForEach(func(name []byte, b *bolt.Bucket) error {
 			log.Debug(fmt.Sprintf("\nPrinting tx:\n(name: %+v, b: %+v)\n", string(name), b))
@@ -261,12 +280,13 @@ func DebugDatabase() {
 
 // Delete removes record about file from DB*2
 
-func Delete(owner, repo, key string) (total int) {
+func (s *boltStore) Delete(owner, repo, key string) (total int) {
 	db.Update(func(tx *bolt.Tx) error {
 		var filename []byte
 		owned := CheckRepo(owner, []string{}, key)
 		md5, _ := Hash(key)
 		total = CheckRepo("", []string{}, key)
+		unindexFile(tx, key)
 		// Deleting user association with file
 		if b := tx.Bucket(MyBucket).Bucket([]byte(key)); b != nil {
 			if d := b.Bucket([]byte("type")); d != nil {
@@ -309,17 +329,18 @@ func Delete(owner, repo, key string) (total int) {
 			// Removing file from DB
 			tx.Bucket(MyBucket).DeleteBucket([]byte(key))
 		}
-		return nil
+		return indexFile(tx, key)
 	})
 	return
 }
 
 // Edit record about file in DB
-func Edit(owner, key, value string, options ...map[string]string) {
+func (s *boltStore) Edit(owner, key, value string, options ...map[string]string) {
 	if len(owner) == 0 {
 		owner = "subutai"
 	}
 	err := db.Update(func(tx *bolt.Tx) error {
+		unindexFile(tx, key)
 		//		Associating files with user
 		b, _ := tx.Bucket(Users).CreateBucketIfNotExists([]byte(owner))
 		if b, err := b.CreateBucketIfNotExists([]byte("files")); err == nil {
@@ -385,13 +406,13 @@ func Edit(owner, key, value string, options ...map[string]string) {
 				}
 			}
 		}
-		return nil
+		return indexFile(tx, key)
 	})
 	log.Check(log.WarnLevel, "Editing data in db", err)
 }
 
 // FileField provides list of file's field properties
-func FileField(hash, field string) (list []string) {
+func (s *boltStore) FileField(hash, field string) (list []string) {
 	log.Debug(fmt.Sprintf("FileField: providing field %+v for file %+v", field, NameByHash(hash)))
 	list = []string{}
 	db.View(func(tx *bolt.Tx) error {
@@ -417,7 +438,7 @@ func FileField(hash, field string) (list []string) {
 }
 
 // FileSignatures returns map with file's owners and their signatures
-func FileSignatures(hash string) (list map[string]string) {
+func (s *boltStore) FileSignatures(hash string) (list map[string]string) {
 	log.Debug(fmt.Sprintf("Gathering owners and their signatures of file %+v", NameByHash(hash)))
 	list = map[string]string{}
 	db.View(func(tx *bolt.Tx) error {
@@ -438,22 +459,17 @@ func FileSignatures(hash string) (list map[string]string) {
 }
 
 // GetFileScope shows users with whom owner shared a file with particular hash
-func GetFileScope(hash, owner string) (scope []string) {
+func (s *boltStore) GetFileScope(hash, owner string) (scope []string) {
 	scope = []string{}
 	db.View(func(tx *bolt.Tx) error {
 		if b := tx.Bucket(MyBucket).Bucket([]byte(hash)); b != nil {
 			if b := b.Bucket([]byte("scope")); b != nil {
-				if b.Get(publicScope) == nil && b.Get(privateScope) == nil {
-					RebuildShare(hash, owner)
-					scope = GetFileScope(hash, owner)
-				} else {
-					b.ForEach(func(k, v []byte) error {
-						if string(k) != string(publicScope) && string(k) != string(privateScope) {
-							scope = append(scope, string(k))
-						}
-						return nil
-					})
-				}
+				b.ForEach(func(k, v []byte) error {
+					if v != nil && string(k) != string(publicScope) && string(k) != string(privateScope) {
+						scope = append(scope, string(k))
+					}
+					return nil
+				})
 			}
 		}
 		return nil
@@ -461,7 +477,7 @@ func GetFileScope(hash, owner string) (scope []string) {
 	return
 }
 
-func GetUserToken(user string) (token string) {
+func (s *boltStore) GetUserToken(user string) (token string) {
 	db.View(func(tx *bolt.Tx) error {
 		if b := tx.Bucket(Tokens); b != nil {
 			b.ForEach(func(k, v []byte) error {
@@ -469,7 +485,7 @@ func GetUserToken(user string) (token string) {
 				if c := b.Bucket(k); c != nil {
 					date := new(time.Time)
 					date.UnmarshalText(c.Get([]byte("date")))
-					if date.Add(time.Hour * 24).Before(time.Now()) {
+					if date.Add(tokenTTL).Before(time.Now()) {
 						return nil
 					}
 					if value := c.Get([]byte("name")); value != nil && string(value) == user {
@@ -490,7 +506,7 @@ func GetUserToken(user string) (token string) {
 }
 
 // Hash returns MD5 and SHA256 hashes by ID
-func Hash(key string) (md5, sha256 string) {
+func (s *boltStore) Hash(key string) (md5, sha256 string) {
 	db.View(func(tx *bolt.Tx) error {
 		if b := tx.Bucket(MyBucket).Bucket([]byte(key)); b != nil {
 			if b := b.Bucket([]byte("hash")); b != nil {
@@ -507,7 +523,7 @@ func Hash(key string) (md5, sha256 string) {
 	return
 }
 
-func Info(id string) map[string]string {
+func (s *boltStore) Info(id string) map[string]string {
 	log.Debug(fmt.Sprintf("\n\nGathering %+v file's info", NameByHash(id)))
 	list := make(map[string]string)
 	db.View(func(tx *bolt.Tx) error {
@@ -530,13 +546,21 @@ func Info(id string) map[string]string {
 	return list
 }
 
+// boltStore keeps metadata in local bolt database file, it is the default store
+type boltStore struct{}
+
+func newBoltStore() *boltStore {
+	db = InitDB()
+	return &boltStore{}
+}
+
 func InitDB() *bolt.DB {
 	os.MkdirAll(filepath.Dir(config.DB.Path), 0755)
 	os.MkdirAll(config.Storage.Path, 0755)
 	db, err := bolt.Open(config.DB.Path, 0600, &bolt.Options{Timeout: 3 * time.Second})
 	log.Check(log.FatalLevel, "Opening DB: "+config.DB.Path, err)
 	err = db.Update(func(tx *bolt.Tx) error {
-		for _, b := range [][]byte{MyBucket, SearchIndex, Users, Tokens, AuthID, Tags} {
+		for _, b := range [][]byte{MyBucket, SearchIndex, Users, Tokens, AuthID, Tags, Meta, Index} {
 			_, err := tx.CreateBucketIfNotExists(b)
 			log.Check(log.FatalLevel, "Creating bucket: "+string(b), err)
 		}
@@ -547,19 +571,13 @@ func InitDB() *bolt.DB {
 }
 
 // IsPublic returns true if file is publicly accessible
-func IsPublic(hash string) (public bool) {
+func (s *boltStore) IsPublic(hash string) (public bool) {
 	log.Debug(fmt.Sprintf("Checking if file %+v (hash: %+v) is public", NameByHash(hash), hash))
 	db.View(func(tx *bolt.Tx) error {
 		if b := tx.Bucket(MyBucket).Bucket([]byte(hash)); b != nil {
 			if c := b.Bucket([]byte("scope")); c != nil {
 				if c.Get(publicScope) == nil && c.Get(privateScope) == nil {
-					log.Debug(fmt.Sprintf("Both public and private scopes are missing. Rebuilding scope"))
-					if d := b.Bucket([]byte("owner")); d != nil {
-						owner, _ := d.Cursor().First()
-						RebuildShare(hash, string(owner))
-					} else {
-						log.Panic(fmt.Sprintf("The file %+v has no owner", hash))
-					}
+					log.Warn(fmt.Sprintf("Availability scopes of file %+v are missing, database migration is required", hash))
 				} else {
 					log.Debug(fmt.Sprintf("Checking %+v (name: %+v) file's scope for publicScope", hash, NameByHash(hash)))
 					public = c.Get(publicScope) != nil
@@ -572,12 +590,15 @@ func IsPublic(hash string) (public bool) {
 	return
 }
 
-// LastHash returns hash of the last uploaded file
-func LastHash(name, t string) (hash string) {
+// LastHash returns hash of the last uploaded file which is not in trash
+func (s *boltStore) LastHash(name, t string) (hash string) {
 	db.View(func(tx *bolt.Tx) error {
 		if b := tx.Bucket(SearchIndex).Bucket([]byte(strings.ToLower(name))); b != nil {
 			c := b.Cursor()
 			for k, v := c.Last(); k != nil; k, v = c.Prev() {
+				if f := tx.Bucket(MyBucket).Bucket(v); f != nil && f.Get([]byte("trashed")) != nil {
+					continue
+				}
 				if CheckRepo("", []string{t}, string(v)) > 0 {
 					hash = string(v)
 					break
@@ -589,22 +610,8 @@ func LastHash(name, t string) (hash string) {
 	return
 }
 
-func MakePublic(hash, owner string) {
-	log.Debug(fmt.Sprintf("MakePublic(%+v, %+v) started", hash, owner))
-	RemoveShare(hash, owner, string(privateScope))
-	AddShare(hash, owner, string(publicScope))
-	log.Debug(fmt.Sprintf("MakePublic(%+v, %+v) ended", hash, owner))
-}
-
-func MakePrivate(hash, owner string) {
-	log.Debug(fmt.Sprintf("MakePrivate(%+v, %+v) started", hash, owner))
-	RemoveShare(hash, owner, string(publicScope))
-	AddShare(hash, owner, string(privateScope))
-	log.Debug(fmt.Sprintf("MakePrivate(%+v, %+v) ended", hash, owner))
-}
-
 // NameByHash returns file's name by its ID
-func NameByHash(hash string) (name string) {
+func (s *boltStore) NameByHash(hash string) (name string) {
 	db.View(func(tx *bolt.Tx) error {
 		if b := tx.Bucket(MyBucket).Bucket([]byte(hash)); b != nil {
 			if value := b.Get([]byte("name")); value != nil {
@@ -616,66 +623,6 @@ func NameByHash(hash string) (name string) {
 	return
 }
 
-func OwnerHadThisFile(owner, md5 string) (has bool) {
-	db.View(func(tx *bolt.Tx) error {
-		if b := tx.Bucket(Users).Bucket([]byte(owner)); b != nil {
-			if c := b.Bucket([]byte("files")); c != nil {
-				c.ForEach(func(k, v []byte) error {
-					m, _ := Hash(string(k))
-					log.Info(fmt.Sprintf("OwnerHadThisFile: checking file %s - md5 == %s against (owner: %s, md5: %s)", string(k), m, owner, md5))
-					if md5 == m {
-						has = true
-					}
-					return nil
-				})
-			} else {
-				log.Info("OwnerHadThisFile: couldn't find files bucket")
-			}
-		} else {
-			log.Info("OwnerHadThisFile: couldn't find this user")
-		}
-		return nil
-	})
-	log.Info(fmt.Sprintf("OwnerHadThisFile: %v", has))
-	return
-}
-
-// OwnerFilesByRepo returns all public files of owner from specified repo
-func OwnerFilesByRepo(owner string, repo string) (list []string) {
-	log.Debug(fmt.Sprintf("(OwnerFilesByRepo): Gathering all %+v's files from repo %+v...", owner, repo))
-	db.View(func(tx *bolt.Tx) error {
-		if b := tx.Bucket(Users).Bucket([]byte(owner)); b != nil {
-			if files := b.Bucket([]byte("files")); files != nil {
-				files.ForEach(func(k, v []byte) error {
-					log.Debug(fmt.Sprintf("(OwnerFilesByRepo): File of %+v -- (key: %v, value: %v)", owner, string(k), string(v)))
-					if IsPublic(string(k)) {
-						if /* CheckShare(string(k), owner) */ filesNumber := CheckRepo(owner, []string{repo}, string(k)); filesNumber > 0 {
-							log.Debug(fmt.Sprintf("(OwnerFilesByRepo): Found %+v files of %+v with key %v in repo %v", filesNumber, owner, string(k), repo))
-							list = append(list, string(k))
-						}
-					}
-					return nil
-				})
-			}
-		}
-		return nil
-	})
-	log.Debug(fmt.Sprintf("(OwnerFilesByRepo): list of all %+v's files from repo %+v: %+v", owner, repo, list))
-	return
-}
-
-func IsFileExists(filename string) bool {
-	exist := false
-	files, _ := ioutil.ReadDir(config.Storage.Path)
-	for _, file := range files {
-		if file.Name() == filename {
-			exist = true
-			return exist
-		}
-	}
-	return exist
-}
-
 func PrintBucketName(buckets []string) (path string) {
 	path = "tx"
 	for i := range buckets {
@@ -701,7 +648,7 @@ func PrintBuckets(b *bolt.Bucket, parents []string) {
 }
 
 // QuotaGet returns value of user's disk quota
-func QuotaGet(user string) (quota int) {
+func (s *boltStore) QuotaGet(user string) (quota int) {
 	db.View(func(tx *bolt.Tx) error {
 		if b := tx.Bucket(Users).Bucket([]byte(user)); b != nil {
 			if q := b.Get([]byte("quota")); q != nil {
@@ -715,35 +662,60 @@ func QuotaGet(user string) (quota int) {
 	return
 }
 
-// QuotaLeft returns user's quota left space
-func QuotaLeft(user string) int {
-	var quota, stored int
-	db.Update(func(tx *bolt.Tx) error {
+// QuotaUsage returns stored value of user's quota usage, false is returned if it wasn't counted yet
+func (s *boltStore) QuotaUsage(user string) (stored int, ok bool) {
+	db.View(func(tx *bolt.Tx) error {
 		if b := tx.Bucket(Users).Bucket([]byte(user)); b != nil {
-			if q := b.Get([]byte("quota")); q != nil {
-				quota, _ = strconv.Atoi(string(q))
-			} else {
-				quota = config.DefaultQuota()
-			}
-			if s := b.Get([]byte("stored")); s != nil {
-				stored, _ = strconv.Atoi(string(s))
-			} else {
-				stored = CountTotal(user)
-				b.Put([]byte("stored"), []byte(strconv.Itoa(stored)))
+			if v := b.Get([]byte("stored")); v != nil {
+				stored, _ = strconv.Atoi(string(v))
+				ok = true
 			}
 		}
 		return nil
 	})
-	if quota == -1 {
-		return -1
-	} else if quota <= stored {
-		return 0
+	return
+}
+
+// QuotaUsageStore saves counted quota usage of existing user
+func (s *boltStore) QuotaUsageStore(user string, stored int) {
+	db.Update(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(Users).Bucket([]byte(user)); b != nil {
+			b.Put([]byte("stored"), []byte(strconv.Itoa(stored)))
+		}
+		return nil
+	})
+}
+
+// QuotaUsageAdd changes quota usage of user by value in one transaction
+func (s *boltStore) QuotaUsageAdd(user string, value int) {
+	db.Update(func(tx *bolt.Tx) error {
+		return addUsage(tx, user, value)
+	})
+}
+
+// addUsage changes quota usage of user by value in transaction, usage is counted from user's files if it wasn't stored yet
+func addUsage(tx *bolt.Tx, user string, value int) error {
+	b := tx.Bucket(Users).Bucket([]byte(user))
+	if b == nil {
+		return nil
+	}
+	stored := 0
+	if v := b.Get([]byte("stored")); v != nil {
+		stored, _ = strconv.Atoi(string(v))
+	} else if files := b.Bucket([]byte("files")); files != nil {
+		files.ForEach(func(id, v []byte) error {
+			if f := tx.Bucket(MyBucket).Bucket(id); f != nil {
+				size, _ := strconv.Atoi(string(f.Get([]byte("size"))))
+				stored += size
+			}
+			return nil
+		})
 	}
-	return quota - stored
+	return b.Put([]byte("stored"), []byte(strconv.Itoa(stored+value)))
 }
 
 // QuotaSet sets changes default storage quota for user
-func QuotaSet(user, quota string) {
+func (s *boltStore) QuotaSet(user, quota string) {
 	db.Update(func(tx *bolt.Tx) error {
 		if b := tx.Bucket(Users).Bucket([]byte(user)); b != nil {
 			b.Put([]byte("quota"), []byte(quota))
@@ -752,162 +724,135 @@ func QuotaSet(user, quota string) {
 	})
 }
 
-// QuotaUsageCorrect updates saved values of quota usage according to file index table
-func QuotaUsageCorrect() {
-	db.Update(func(tx *bolt.Tx) error {
-		if b := tx.Bucket(Users); b != nil {
-			b.ForEach(func(k, v []byte) error {
-				if c := b.Bucket(k); c != nil {
-					rVal := CountTotal(string(k))
-					if sVal := c.Get([]byte("stored")); sVal == nil && rVal != 0 || sVal != nil && string(sVal) != strconv.Itoa(rVal) {
-						log.Info("Correcting quota usage for user " + string(k))
-						log.Info("Stored value: " + string(sVal) + ", real value: " + strconv.Itoa(rVal))
-						c.Put([]byte("stored"), []byte(strconv.Itoa(rVal)))
-					}
+// RegisterUser creates user if needed and adds key to the list of user's keys.
+// Keys that were revoked earlier are refused.
+func (s *boltStore) RegisterUser(name, key []byte) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(Users).CreateBucketIfNotExists([]byte(strings.ToLower(string(name))))
+		if log.Check(log.WarnLevel, "Registering user "+strings.ToLower(string(name)), err) {
+			return err
+		}
+		if r := b.Bucket([]byte("revoked")); r != nil {
+			fp := fingerprint(string(key))
+			err := r.ForEach(func(revoked, v []byte) error {
+				if fingerprint(string(revoked)) == fp {
+					return fmt.Errorf("Key has been revoked")
 				}
 				return nil
 			})
+			if err != nil {
+				log.Warn("Refusing to register revoked key for user " + strings.ToLower(string(name)))
+				return err
+			}
+		}
+		b.Put([]byte("key"), key)
+		if b, err := b.CreateBucketIfNotExists([]byte("keys")); err == nil {
+			log.Debug(fmt.Sprintf("Created user %+v", name))
+			b.Put(key, nil)
 		}
 		return nil
 	})
 }
 
-// QuotaUsageGet returns value of used disk quota
-func QuotaUsageGet(user string) (stored int) {
-	db.Update(func(tx *bolt.Tx) error {
-		if b := tx.Bucket(Users).Bucket([]byte(user)); b != nil {
-			if s := b.Get([]byte("stored")); s != nil {
-				stored, _ = strconv.Atoi(string(s))
-			} else {
-				stored = CountTotal(user)
-				b.Put([]byte("stored"), []byte(strconv.Itoa(stored)))
+// RevokeUserKey removes key from the list of user's active keys and remembers the moment of revocation,
+// so the key can't be used for authentication or registered again.
+func (s *boltStore) RevokeUserKey(name, key string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(Users).Bucket([]byte(strings.ToLower(name)))
+		if b == nil {
+			return fmt.Errorf("User not found")
+		}
+		k, err := b.CreateBucketIfNotExists([]byte("keys"))
+		if err != nil {
+			return err
+		}
+		// Users registered before keys bucket was introduced have only legacy key field
+		if legacy := b.Get([]byte("key")); legacy != nil && k.Get(legacy) == nil {
+			k.Put(legacy, nil)
+		}
+		r, err := b.CreateBucketIfNotExists([]byte("revoked"))
+		if err != nil {
+			return err
+		}
+		// Keys are stored with empty values, so lookup is done by cursor
+		if found, _ := k.Cursor().Seek([]byte(key)); !bytes.Equal(found, []byte(key)) {
+			return fmt.Errorf("Key not found")
+		}
+		// Copies of the same key armored differently are revoked together
+		revoked, fp := [][]byte{}, fingerprint(key)
+		k.ForEach(func(active, v []byte) error {
+			if fingerprint(string(active)) == fp {
+				revoked = append(revoked, active)
 			}
+			return nil
+		})
+		now, _ := time.Now().MarshalText()
+		for _, active := range revoked {
+			k.Delete(active)
+			r.Put(active, now)
 		}
-		return nil
-	})
-	return
-}
-
-// QuotaUsageSet accepts size of added/removed file and updates quota usage for user
-func QuotaUsageSet(user string, value int) {
-	var stored int
-	db.Update(func(tx *bolt.Tx) error {
-		if b := tx.Bucket(Users).Bucket([]byte(user)); b != nil {
-			if s := b.Get([]byte("stored")); s != nil {
-				stored, _ = strconv.Atoi(string(s))
+		if legacy := b.Get([]byte("key")); legacy != nil && fingerprint(string(legacy)) == fp {
+			if active, _ := k.Cursor().First(); active != nil {
+				b.Put([]byte("key"), active)
 			} else {
-				stored = CountTotal(user)
+				b.Delete([]byte("key"))
 			}
-			b.Put([]byte("stored"), []byte(strconv.Itoa(stored+value)))
 		}
+		log.Info("Key of user " + strings.ToLower(name) + " has been revoked")
 		return nil
 	})
 }
 
-func RebuildShare(hash, owner string) {
-	log.Debug(fmt.Sprintf("RebuildShare(%+v, %+v) started", hash, owner))
-	public := true
-	db.Update(func(tx *bolt.Tx) error {
-		log.Debug(fmt.Sprintf("Starting RebuildShare"))
-		if b := tx.Bucket(MyBucket).Bucket([]byte(hash)); b != nil {
-			/*			name := ""
-						if value := b.Get([]byte("name")); value != nil {
-							name = string(value)
-						}
-			*/if c := b.Bucket([]byte("scope")); c != nil {
-				keyList := [][]byte{}
-				valueList := [][]byte{}
-				bucketList := [][]byte{}
-				c.ForEach(func(k, v []byte) error {
-					log.Debug(fmt.Sprintf("Iterating through scope: (key: %+v, value: %+v)", string(k), string(v)))
-					if v == nil {
-						d := c.Bucket(k)
-						log.Debug(fmt.Sprintf("key: %+v is a Bucket", string(k)))
-						log.Debug(fmt.Sprintf("Iterating through this Bucket:"))
-						d.ForEach(func(kk, vv []byte) error {
-							log.Debug(fmt.Sprintf("	(subkey: %+v, subvalue: %+v)", string(kk), string(vv)))
-							if string(kk) == string(k) {
-								log.Debug(fmt.Sprintf("Self-share detected. File is private"))
-								public = false
-							} else {
-								keyList = append(keyList, kk)
-								valueList = append(valueList, vv)
-								/*if e := tx.Bucket(Users).Bucket(kk); e != nil {
-									if f := e.Bucket([]byte("files")); f != nil {
-										if f.Get([]byte(hash)) == nil {
-											log.Debug(fmt.Sprintf("		Putting %+v's file %+v (name: %+v, actual name: %+v) in files of %+v", owner, hash, name, NameByHash(hash), string(kk)))
-											f.Put([]byte(hash), []byte(name))
-										}
-									}
-								}*/
-							}
-							return nil
-						})
-						bucketList = append(bucketList, k)
-					}
+// RevokedKeys returns user's revoked keys with the date of revocation
+func (s *boltStore) RevokedKeys(name string) (keys map[string]time.Time) {
+	keys = make(map[string]time.Time)
+	db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(Users).Bucket([]byte(strings.ToLower(name))); b != nil {
+			if r := b.Bucket([]byte("revoked")); r != nil {
+				return r.ForEach(func(k, v []byte) error {
+					date := time.Time{}
+					date.UnmarshalText(v)
+					keys[string(k)] = date
 					return nil
 				})
-				for _, k := range bucketList {
-					c.DeleteBucket(k)
-				}
-				for i := 0; i < len(keyList); i++ {
-					if c.Get(keyList[i]) == nil {
-						c.Put(keyList[i], valueList[i])
-					}
-				}
 			}
 		}
 		return nil
 	})
-	log.Debug(fmt.Sprintf("Scope rebuild almost finished. Setting file's availability: %+v", public))
-	if public {
-		MakePublic(hash, owner)
-	} else {
-		MakePrivate(hash, owner)
-	}
-	log.Debug(fmt.Sprintf("RebuildShare(%+v, %+v) ended", hash, owner))
+	return
 }
 
-func RegisterUser(name, key []byte) {
+// RemoveShare removes user from share scope of file if the file was shared with him
+func (s *boltStore) RemoveShare(hash, owner, user string) {
+	log.Debug(fmt.Sprintf("RemoveShare(%+v, %+v, %+v) started", hash, owner, user))
 	db.Update(func(tx *bolt.Tx) error {
-		b, err := tx.Bucket(Users).CreateBucketIfNotExists([]byte(strings.ToLower(string(name))))
-		if !log.Check(log.WarnLevel, "Registering user "+strings.ToLower(string(name)), err) {
-			b.Put([]byte("key"), key)
-			if b, err := b.CreateBucketIfNotExists([]byte("keys")); err == nil {
-				log.Debug(fmt.Sprintf("Created user %+v", name))
-				b.Put(key, nil)
-			}
-		}
-		return err
+		removeShare(tx, hash, user)
+		return nil
 	})
+	log.Debug(fmt.Sprintf("RemoveShare(%+v, %+v, %+v) ended", hash, owner, user))
 }
 
-// RemoveShare removes user from share scope of file if the file was shared with him
-func RemoveShare(hash, owner, user string) {
-	log.Debug(fmt.Sprintf("RemoveShare(%+v, %+v, %+v) started", hash, owner, user))
-	db.Update(func(tx *bolt.Tx) error {
-		if b := tx.Bucket(MyBucket).Bucket([]byte(hash)); b != nil {
-			if b := b.Bucket([]byte("scope")); b != nil {
-				if b.Get([]byte(user)) != nil {
-					b.Delete([]byte(user))
-				}
-				if e := tx.Bucket(Users).Bucket([]byte(user)); e != nil {
-					if f := e.Bucket([]byte("files")); f != nil {
-						if f.Get([]byte(hash)) != nil {
-							f.Delete([]byte(hash))
-						}
+// removeShare removes user from share scope of file and file from user's files in transaction
+func removeShare(tx *bolt.Tx, hash, user string) {
+	if b := tx.Bucket(MyBucket).Bucket([]byte(hash)); b != nil {
+		if b := b.Bucket([]byte("scope")); b != nil {
+			if b.Get([]byte(user)) != nil {
+				b.Delete([]byte(user))
+			}
+			if e := tx.Bucket(Users).Bucket([]byte(user)); e != nil {
+				if f := e.Bucket([]byte("files")); f != nil {
+					if f.Get([]byte(hash)) != nil {
+						f.Delete([]byte(hash))
 					}
 				}
 			}
 		}
-		return nil
-	})
-	log.Debug(fmt.Sprintf("RemoveShare(%+v, %+v, %+v) ended", hash, owner, user))
+	}
 }
 
 // RemoveTags deletes tag from index bucket and file information.
 // It should be executed on every file deletion to keep DB consistant.
-func RemoveTags(key, list string) error {
+func (s *boltStore) RemoveTags(key, list string) error {
 	return db.Update(func(tx *bolt.Tx) error {
 		if b := tx.Bucket(MyBucket).Bucket([]byte(key)); b != nil {
 			if t := b.Bucket([]byte("tags")); t != nil {
@@ -924,14 +869,19 @@ func RemoveTags(key, list string) error {
 	})
 }
 
-func SaveAuthID(name, token string) {
+// SaveAuthID stores SHA256 hash of auth challenge together with user name and creation date
+func (s *boltStore) SaveAuthID(name, token string) {
 	db.Update(func(tx *bolt.Tx) error {
-		tx.Bucket(AuthID).Put([]byte(token), []byte(name))
+		if b, _ := tx.Bucket(AuthID).CreateBucketIfNotExists([]byte(fmt.Sprintf("%x", sha256.Sum256([]byte(token))))); b != nil {
+			b.Put([]byte("name"), []byte(name))
+			now, _ := time.Now().MarshalText()
+			b.Put([]byte("date"), now)
+		}
 		return nil
 	})
 }
 
-func SaveToken(name, token string) {
+func (s *boltStore) SaveToken(name, token string) {
 	db.Update(func(tx *bolt.Tx) error {
 		if b, _ := tx.Bucket(Tokens).CreateBucketIfNotExists([]byte(token)); b != nil {
 			b.Put([]byte("name"), []byte(name))
@@ -943,7 +893,7 @@ func SaveToken(name, token string) {
 }
 
 // SaveTorrent saves torrent file for particular template in DB for future usage to prevent regeneration same file again.
-func SaveTorrent(hash, torrent []byte) {
+func (s *boltStore) SaveTorrent(hash, torrent []byte) {
 	db.Update(func(tx *bolt.Tx) error {
 		if b, err := tx.Bucket(MyBucket).CreateBucketIfNotExists(hash); err == nil {
 			b.Put([]byte("torrent"), torrent)
@@ -953,7 +903,7 @@ func SaveTorrent(hash, torrent []byte) {
 }
 
 // SearchName searches for all (public/private) files of all users that have "query" substring in their names
-func SearchName(query string) (list []string) {
+func (s *boltStore) SearchName(query string) (list []string) {
 	log.Debug(fmt.Sprintf("Starting db.SearchName(%+v)", query))
 	db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket(SearchIndex)
@@ -985,7 +935,7 @@ func SearchName(query string) (list []string) {
 
 // Tag returns a list of artifacts that contains requested tags.
 // If no records found list will be empty.
-func Tag(query string) (list []string, err error) {
+func (s *boltStore) Tag(query string) (list []string, err error) {
 	log.Debug(fmt.Sprintf("Starting db.Tag(%+v)", query))
 	err = db.View(func(tx *bolt.Tx) error {
 		if b := tx.Bucket(Tags).Bucket([]byte(strings.ToLower(query))); b != nil {
@@ -1001,64 +951,27 @@ func Tag(query string) (list []string, err error) {
 	return
 }
 
-// TokenOwner returns the owner of the given token
-func TokenOwner(token string) (name string) {
+// TokenOwner returns the owner of the given token, tokens are looked up by their SHA256 hash only
+func (s *boltStore) TokenOwner(token string) (name string) {
 	tokenFormatted := fmt.Sprintf("%x", sha256.Sum256([]byte(token)))
 	db.View(func(tx *bolt.Tx) error {
 		if b := tx.Bucket(Tokens).Bucket([]byte(tokenFormatted)); b != nil {
 			date := new(time.Time)
 			date.UnmarshalText(b.Get([]byte("date")))
-			if date.Add(time.Hour * 24).Before(time.Now()) {
-				return nil
-			}
-			if value := b.Get([]byte("name")); value != nil {
-				name = string(value)
-			}
-		} else if b := tx.Bucket(Tokens).Bucket([]byte(token)); b != nil {
-			date := new(time.Time)
-			date.UnmarshalText(b.Get([]byte("date")))
-			if date.Add(time.Hour * 24).Before(time.Now()) {
+			if date.Add(tokenTTL).Before(time.Now()) {
 				return nil
 			}
 			if value := b.Get([]byte("name")); value != nil {
 				name = string(value)
 			}
-		} else {
-			log.Debug(fmt.Sprintf("Token %s (formatted: %s) not found", token, tokenFormatted))
 		}
 		return nil
 	})
-	log.Debug(fmt.Sprintf("Checking token %s (formatted: %s) finished. Token corresponds to name %s", token, tokenFormatted, name))
-	return
-}
-
-// TokenFilesByRepo returns all public/private/shared files of token owner from specified repo
-func TokenFilesByRepo(token string, repo string) (list []string) {
-	owner := TokenOwner(token)
-	if owner == "" {
-		log.Debug(fmt.Sprintf("(TokenFilesByRepo): Couldn't find owner of token %s", token))
-		return
-	}
-	log.Debug(fmt.Sprintf("(TokenFilesByRepo): Gathering all %+v's files from repo %+v...", owner, repo))
-	db.View(func(tx *bolt.Tx) error {
-		if b := tx.Bucket(Users).Bucket([]byte(owner)); b != nil {
-			if files := b.Bucket([]byte("files")); files != nil {
-				files.ForEach(func(k, v []byte) error {
-					if filesNumber := CheckRepo(owner, []string{repo}, string(k)); filesNumber > 0 {
-						list = append(list, string(k))
-					}
-					return nil
-				})
-			}
-		}
-		return nil
-	})
-	log.Debug(fmt.Sprintf("(TokenFilesByRepo): list of all %+v's files from repo %+v: %+v", owner, repo, list))
 	return
 }
 
 // Torrent retrieves torrent file for template from DB. If no torrent file found it returns nil.
-func Torrent(hash []byte) (val []byte) {
+func (s *boltStore) Torrent(hash []byte) (val []byte) {
 	db.View(func(tx *bolt.Tx) error {
 		if b := tx.Bucket(MyBucket).Bucket(hash); b != nil {
 			if value := b.Get([]byte("torrent")); value != nil {
@@ -1070,18 +983,13 @@ func Torrent(hash []byte) (val []byte) {
 	return
 }
 
-// UserFile searches a file among particular user's files. It returns list of hashes of files with required name.
-func UserFile(owner, file string) (list []string) {
-	if len(owner) == 0 {
-		owner = "subutai"
-	}
+// UserFiles returns IDs of files owned by or shared with user
+func (s *boltStore) UserFiles(user string) (list []string) {
 	db.View(func(tx *bolt.Tx) error {
-		if b := tx.Bucket(Users).Bucket([]byte(owner)); b != nil {
+		if b := tx.Bucket(Users).Bucket([]byte(user)); b != nil {
 			if files := b.Bucket([]byte("files")); files != nil {
 				files.ForEach(func(k, v []byte) error {
-					if NameByHash(string(k)) == file && utils.In([]string{owner}, FileField(string(k), "owner")) {
-						list = append(list, string(k))
-					}
+					list = append(list, string(k))
 					return nil
 				})
 			}
@@ -1091,8 +999,21 @@ func UserFile(owner, file string) (list []string) {
 	return
 }
 
+// Users returns names of all users
+func (s *boltStore) Users() (list []string) {
+	db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(Users).ForEach(func(k, v []byte) error {
+			if v == nil {
+				list = append(list, string(k))
+			}
+			return nil
+		})
+	})
+	return
+}
+
 // UserKey is replaced by UserKeys and left for compatibility. This function should be removed later.
-func UserKey(name string) (key string) {
+func (s *boltStore) UserKey(name string) (key string) {
 	db.View(func(tx *bolt.Tx) error {
 		if b := tx.Bucket(Users).Bucket([]byte(strings.ToLower(name))); b != nil {
 			if value := b.Get([]byte("key")); value != nil {
@@ -1105,7 +1026,7 @@ func UserKey(name string) (key string) {
 }
 
 // UserKeys returns list of users' GPG keys
-func UserKeys(name string) (keys []string) {
+func (s *boltStore) UserKeys(name string) (keys []string) {
 	db.View(func(tx *bolt.Tx) error {
 		if b := tx.Bucket(Users).Bucket([]byte(strings.ToLower(name))); b != nil {
 			if k := b.Bucket([]byte("keys")); k != nil {
@@ -1121,89 +1042,165 @@ func UserKeys(name string) (keys []string) {
 	return
 }
 
+// UserSSHKeys returns list of user's SSH public keys in authorized_keys format
+func (s *boltStore) UserSSHKeys(name string) (keys []string) {
+	db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(Users).Bucket([]byte(strings.ToLower(name))); b != nil {
+			if k := b.Bucket([]byte("sshkeys")); k != nil {
+				return k.ForEach(func(k, v []byte) error {
+					keys = append(keys, string(k))
+					return nil
+				})
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// AddUserSSHKey creates user if needed and adds SSH public key to the list of user's SSH keys
+func (s *boltStore) AddUserSSHKey(name, key string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(Users).CreateBucketIfNotExists([]byte(strings.ToLower(name)))
+		if err != nil {
+			return err
+		}
+		k, err := b.CreateBucketIfNotExists([]byte("sshkeys"))
+		if err != nil {
+			return err
+		}
+		return k.Put([]byte(strings.TrimSpace(key)), nil)
+	})
+}
+
+// RemoveUserSSHKey removes SSH public key from the list of user's SSH keys
+func (s *boltStore) RemoveUserSSHKey(name, key string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(Users).Bucket([]byte(strings.ToLower(name))); b != nil {
+			if k := b.Bucket([]byte("sshkeys")); k != nil {
+				return k.Delete([]byte(key))
+			}
+		}
+		return nil
+	})
+}
+
 // Write create record about file in DB
-func Write(owner, key, value string, options ...map[string]string) error {
+func (s *boltStore) Write(owner, key, value string, options ...map[string]string) error {
+	err := db.Update(func(tx *bolt.Tx) error {
+		return putFile(tx, owner, key, value, options...)
+	})
+	log.Check(log.WarnLevel, "Writing data to db", err)
+	return err
+}
+
+// Register writes record about uploaded file with its tags, visibility and owner's quota usage in one transaction
+func (s *boltStore) Register(a Artifact) error {
+	owner, scope, opposite := a.Owner, publicScope, privateScope
 	if len(owner) == 0 {
 		owner = "subutai"
 	}
+	if a.Private {
+		scope, opposite = privateScope, publicScope
+	}
 	err := db.Update(func(tx *bolt.Tx) error {
-		now, _ := time.Now().MarshalText()
-		// Associating files with user
-		b, _ := tx.Bucket(Users).CreateBucketIfNotExists([]byte(owner))
-		if b, err := b.CreateBucketIfNotExists([]byte("files")); err == nil {
-			if v := b.Get([]byte(key)); v == nil {
-				// log.Warn("Associating: " + owner + " with " + value + " (" + key + ")")
-				b.Put([]byte(key), []byte(value))
+		if err := putFile(tx, owner, a.ID, a.Name, a.options()); err != nil {
+			return err
+		}
+		if len(a.Tags) != 0 {
+			if err := addTags(tx, a.Tags, a.ID, a.Repo); err != nil {
+				return err
 			}
 		}
-		// Creating new record about file
-		if b, err := tx.Bucket(MyBucket).CreateBucket([]byte(key)); err == nil {
-			b.Put([]byte("date"), now)
-			b.Put([]byte("name"), []byte(value))
-			// Adding SearchIndex index for files
-			b, _ = tx.Bucket(SearchIndex).CreateBucketIfNotExists([]byte(strings.ToLower(value)))
-			b.Put(now, []byte(key))
+		removeShare(tx, a.ID, string(opposite))
+		addShare(tx, a.ID, string(scope))
+		return addUsage(tx, owner, a.Size)
+	})
+	log.Check(log.WarnLevel, "Registering "+a.Name+" in db", err)
+	return err
+}
+
+// putFile creates record about file in transaction
+func putFile(tx *bolt.Tx, owner, key, value string, options ...map[string]string) error {
+	if len(owner) == 0 {
+		owner = "subutai"
+	}
+	id := key
+	unindexFile(tx, id)
+	now, _ := time.Now().MarshalText()
+	// Associating files with user
+	b, _ := tx.Bucket(Users).CreateBucketIfNotExists([]byte(owner))
+	if b, err := b.CreateBucketIfNotExists([]byte("files")); err == nil {
+		if v := b.Get([]byte(key)); v == nil {
+			// log.Warn("Associating: " + owner + " with " + value + " (" + key + ")")
+			b.Put([]byte(key), []byte(value))
 		}
-		// Adding owners, shares and tags to files
-		if b := tx.Bucket(MyBucket).Bucket([]byte(key)); b != nil {
-			if c, err := b.CreateBucket([]byte("owner")); err == nil {
-				log.Info(fmt.Sprintf("Bucket owner created successfully"))
-				c.Put([]byte(owner), []byte("w"))
-			}
-			if _, err := b.CreateBucket([]byte("scope")); err == nil {
-				log.Info(fmt.Sprintf("Bucket scope created successfully"))
-			}
-			for i := range options {
-				for k, v := range options[i] {
-					switch k {
-					case "type":
-						if c, err := b.CreateBucketIfNotExists([]byte("type")); err == nil {
-							if c, err := c.CreateBucketIfNotExists([]byte(v)); err == nil {
-								c.Put([]byte(owner), []byte("w"))
-							}
+	}
+	// Creating new record about file
+	if b, err := tx.Bucket(MyBucket).CreateBucket([]byte(key)); err == nil {
+		b.Put([]byte("date"), now)
+		b.Put([]byte("name"), []byte(value))
+		// Adding SearchIndex index for files
+		b, _ = tx.Bucket(SearchIndex).CreateBucketIfNotExists([]byte(strings.ToLower(value)))
+		b.Put(now, []byte(key))
+	}
+	// Adding owners, shares and tags to files
+	if b := tx.Bucket(MyBucket).Bucket([]byte(key)); b != nil {
+		if c, err := b.CreateBucket([]byte("owner")); err == nil {
+			log.Info(fmt.Sprintf("Bucket owner created successfully"))
+			c.Put([]byte(owner), []byte("w"))
+		}
+		if _, err := b.CreateBucket([]byte("scope")); err == nil {
+			log.Info(fmt.Sprintf("Bucket scope created successfully"))
+		}
+		for i := range options {
+			for k, v := range options[i] {
+				switch k {
+				case "type":
+					if c, err := b.CreateBucketIfNotExists([]byte("type")); err == nil {
+						if c, err := c.CreateBucketIfNotExists([]byte(v)); err == nil {
+							c.Put([]byte(owner), []byte("w"))
 						}
-					case "md5", "sha256":
-						if c, err := b.CreateBucketIfNotExists([]byte("hash")); err == nil {
-							c.Put([]byte(k), []byte(v))
-							// Getting file size
-							if f, err := os.Open(config.Storage.Path + v); err == nil {
-								fi, _ := f.Stat()
-								f.Close()
-								b.Put([]byte("size"), []byte(fmt.Sprint(fi.Size())))
-							}
+					}
+				case "md5", "sha256":
+					if c, err := b.CreateBucketIfNotExists([]byte("hash")); err == nil {
+						c.Put([]byte(k), []byte(v))
+						// Getting file size
+						if f, err := os.Open(config.Storage.Path + v); err == nil {
+							fi, _ := f.Stat()
+							f.Close()
+							b.Put([]byte("size"), []byte(fmt.Sprint(fi.Size())))
 						}
-					case "tags":
-						if c, err := b.CreateBucketIfNotExists([]byte("tags")); err == nil && len(v) > 0 {
-							for _, v := range strings.Split(v, ",") {
-								tag := []byte(strings.ToLower(strings.TrimSpace(v)))
-								t, _ := tx.Bucket(Tags).CreateBucketIfNotExists([]byte("template"))
-								if tt := t.Get([]byte(tag)); tt != nil {
-									key = string(tt) + "," + key
-								}
-								c.Put(tag, []byte("w"))
-								t.Put([]byte(tag), []byte(key))
+					}
+				case "tags":
+					if c, err := b.CreateBucketIfNotExists([]byte("tags")); err == nil && len(v) > 0 {
+						for _, v := range strings.Split(v, ",") {
+							tag := []byte(strings.ToLower(strings.TrimSpace(v)))
+							t, _ := tx.Bucket(Tags).CreateBucketIfNotExists([]byte("template"))
+							if tt := t.Get([]byte(tag)); tt != nil {
+								key = string(tt) + "," + key
 							}
-						}
-					case "signature":
-						if c, err := b.CreateBucketIfNotExists([]byte("owner")); err == nil {
-							c.Put([]byte(owner), []byte(v))
-						}
-					default:
-						if b.Get([]byte(k)) == nil {
-							b.Put([]byte(k), []byte(v))
+							c.Put(tag, []byte("w"))
+							t.Put([]byte(tag), []byte(key))
 						}
 					}
+				case "signature":
+					if c, err := b.CreateBucketIfNotExists([]byte("owner")); err == nil {
+						c.Put([]byte(owner), []byte(v))
+					}
+				default:
+					if b.Get([]byte(k)) == nil {
+						b.Put([]byte(k), []byte(v))
+					}
 				}
 			}
 		}
-		return nil
-	})
-	log.Check(log.WarnLevel, "Writing data to db", err)
-	return err
+	}
+	return indexFile(tx, id)
 }
 
 // CheckRepoOfHash return the type of file by its hash
-func CheckRepoOfHash(hash string) (repo string) {
+func (s *boltStore) CheckRepoOfHash(hash string) (repo string) {
 	db.View(func(tx *bolt.Tx) error {
 		if b := tx.Bucket(MyBucket).Bucket([]byte(hash)); b != nil {
 			if b := b.Bucket([]byte("type")); b != nil {
@@ -1219,25 +1216,33 @@ func CheckRepoOfHash(hash string) (repo string) {
 }
 
 //AddTag add new key to bucket Tags
-func AddTag(tags []string, id string, repo string) error {
-	ID := id
+func (s *boltStore) AddTag(tags []string, id string, repo string) error {
 	db.Update(func(tx *bolt.Tx) error {
-		if b, _ := tx.Bucket(Tags).CreateBucketIfNotExists([]byte(repo)); b != nil {
-			for _, tag := range tags {
-				if value := b.Get([]byte(tag)); value != nil {
-					id = string(value) + "," + id
-				}
-				b.Put([]byte(tag), []byte(id))
-				id = ID
-			}
-		}
-		return nil
+		return addTags(tx, tags, id, repo)
 	})
 	return nil
 }
 
+// addTags appends file to tag index of repo in transaction
+func addTags(tx *bolt.Tx, tags []string, id string, repo string) error {
+	b, err := tx.Bucket(Tags).CreateBucketIfNotExists([]byte(repo))
+	if err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		list := id
+		if value := b.Get([]byte(tag)); value != nil {
+			list = string(value) + "," + id
+		}
+		if err = b.Put([]byte(tag), []byte(list)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // SearchByOneTag is performs search in bucket Tags by tag
-func SearchByOneTag(tag string, repo string) (list []string) {
+func (s *boltStore) SearchByOneTag(tag string, repo string) (list []string) {
 	db.View(func(tx *bolt.Tx) error {
 		if b := tx.Bucket(Tags).Bucket([]byte(repo)); b != nil {
 			b.ForEach(func(k, v []byte) error {
@@ -1255,87 +1260,3 @@ func SearchByOneTag(tag string, repo string) (list []string) {
 	return list
 }
 
-func Exists(str string, list []string) bool {
-	for _, l := range list {
-		if str == l {
-			return true
-		}
-	}
-	return false
-}
-
-// UnionByTags return list of the values by one of respective tags
-func UnionByTags(tags []string, repo string) (list []string) {
-	db.View(func(tx *bolt.Tx) error {
-		if b := tx.Bucket(Tags).Bucket([]byte(repo)); b != nil {
-			for _, tag := range tags {
-				b.ForEach(func(k, v []byte) error {
-					if tag == string(k) {
-						vv := strings.Split(string(v), ",")
-						for _, vvv := range vv {
-							if !Exists(vvv, list) {
-								list = append(list, vvv)
-							}
-						}
-					}
-					return nil
-				})
-			}
-		}
-		return nil
-	})
-	return list
-}
-
-// IntersectOfTags return IDs of files by all respective tags
-func IntersectOfTags(tags []string, repo string) (list []string) {
-	var list1, list2 []string
-	db.View(func(tx *bolt.Tx) error {
-		if b := tx.Bucket(Tags).Bucket([]byte(repo)); b != nil {
-			b.ForEach(func(k, v []byte) error {
-				if tags[0] == string(k) {
-					vv := strings.Split(string(v), ",")
-					for _, vvv := range vv {
-						list1 = append(list, vvv)
-					}
-				}
-				if tags[1] == string(k) {
-					vv := strings.Split(string(v), ",")
-					for _, vvv := range vv {
-						list2 = append(list, vvv)
-					}
-				}
-				return nil
-			})
-		}
-		return nil
-	})
-
-	//intersection
-	low, high := list1, list2
-	if len(list1) > len(list2) {
-		low = list2
-		high = list1
-	}
-	done := false
-	for i, l := range low {
-		for j, h := range high {
-			f1 := i + 1
-			f2 := j + 1
-			if l == h {
-				list = append(list, h)
-				if f1 < len(low) && f2 < len(high) {
-					if low[f1] != high[f2] {
-						done = true
-					}
-				}
-				high = high[:j+copy(high[j:], high[j+1:])]
-				break
-			}
-		}
-		if done {
-			break
-		}
-	}
-	return list
-}
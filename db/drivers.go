@@ -0,0 +1,7 @@
+package db
+
+// SQL drivers available for metadata store, selected by "driver" option of db section
+import (
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
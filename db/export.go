@@ -0,0 +1,489 @@
+package db
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/subutai-io/agent/log"
+	"github.com/subutai-io/cdn/config"
+)
+
+// Export format is JSON lines, one record per line. The first line is header:
+//
+//	{"kind":"header","format":"gorjun-export","version":1,"schema":4,"created":"2006-01-02T15:04:05Z"}
+//
+// It is followed by user records:
+//
+//	{"kind":"user","name":"jdoe","keys":["<armored PGP key>"],"revoked":{"<armored PGP key>":"<date>"},
+//	 "sshkeys":["ssh-ed25519 AAAA..."],"files":{"<file id>":"<file name>"},"quota":"2147483648","stored":"1024"}
+//
+// and file records:
+//
+//	{"kind":"file","id":"<file id>","name":"package.deb","date":"<date>","owners":{"jdoe":"w"},
+//	 "public":true,"scope":["alice"],"repos":{"apt":["jdoe"]},"hash":{"md5":"...","sha256":"..."},
+//	 "tags":["stable"],"fields":{"size":"1024","version":"1.0.0"},"blob":"package.deb"}
+//
+// Owner value is either "w" or armored signature of the file made by owner. Values which are not
+// covered by record fields are kept in "fields" and "buckets", so nothing is lost on the way.
+// Blob is the name of file content in storage directory, it is copied to or from blobs directory if requested.
+// Session tokens and auth challenges are not exported.
+const (
+	exportFormat  = "gorjun-export"
+	exportVersion = 1
+)
+
+type exportHeader struct {
+	Kind    string `json:"kind"`
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+	Schema  int    `json:"schema"`
+	Created string `json:"created"`
+}
+
+type exportUser struct {
+	Kind    string                       `json:"kind"`
+	Name    string                       `json:"name"`
+	Keys    []string                     `json:"keys,omitempty"`
+	Revoked map[string]string            `json:"revoked,omitempty"`
+	SSHKeys []string                     `json:"sshkeys,omitempty"`
+	Files   map[string]string            `json:"files,omitempty"`
+	Quota   string                       `json:"quota,omitempty"`
+	Stored  string                       `json:"stored,omitempty"`
+	Fields  map[string]string            `json:"fields,omitempty"`
+	Buckets map[string]map[string]string `json:"buckets,omitempty"`
+}
+
+type exportFile struct {
+	Kind    string                       `json:"kind"`
+	ID      string                       `json:"id"`
+	Name    string                       `json:"name"`
+	Date    string                       `json:"date,omitempty"`
+	Owners  map[string]string            `json:"owners,omitempty"`
+	Public  bool                         `json:"public"`
+	Scope   []string                     `json:"scope,omitempty"`
+	Repos   map[string][]string          `json:"repos,omitempty"`
+	Hash    map[string]string            `json:"hash,omitempty"`
+	Tags    []string                     `json:"tags,omitempty"`
+	Fields  map[string]string            `json:"fields,omitempty"`
+	Buckets map[string]map[string]string `json:"buckets,omitempty"`
+	Blob    string                       `json:"blob,omitempty"`
+}
+
+// Export writes catalog to w in JSON lines format. If blobs is not empty, content of files is copied to that directory.
+func Export(w io.Writer, blobs string) (users, files int, err error) {
+	if opened(); db == nil {
+		return 0, 0, errBoltOnly
+	}
+	if len(blobs) != 0 {
+		if err = os.MkdirAll(blobs, 0755); err != nil {
+			return
+		}
+	}
+	enc := json.NewEncoder(w)
+	err = db.View(func(tx *bolt.Tx) error {
+		version, _ := strconv.Atoi(string(tx.Bucket(Meta).Get(schemaKey)))
+		header := exportHeader{"header", exportFormat, exportVersion, version, time.Now().UTC().Format(time.RFC3339)}
+		if err := enc.Encode(header); err != nil {
+			return err
+		}
+		err := tx.Bucket(Users).ForEach(func(name, v []byte) error {
+			if b := tx.Bucket(Users).Bucket(name); b != nil {
+				users++
+				return enc.Encode(readUser(string(name), b))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(MyBucket).ForEach(func(id, v []byte) error {
+			b := tx.Bucket(MyBucket).Bucket(id)
+			if b == nil {
+				return nil
+			}
+			record := readFile(string(id), b)
+			if len(blobs) != 0 && len(record.Blob) != 0 {
+				if err := copyFile(config.Storage.Path+record.Blob, filepath.Join(blobs, record.Blob)); err != nil {
+					return fmt.Errorf("Exporting content of %s: %v", record.ID, err)
+				}
+			}
+			files++
+			return enc.Encode(record)
+		})
+	})
+	return
+}
+
+// Import reads catalog in JSON lines format and adds it to database in one transaction. Existing files are
+// skipped, existing users get keys and files they don't have yet, keys they revoked are not added back.
+// Export must have the same schema version as database. If blobs is not empty, content of files is copied
+// from that directory to storage and removed again if import fails. Quota usage of users who got new files
+// is recounted afterwards.
+func Import(r io.Reader, blobs string) (users, files int, err error) {
+	if opened(); db == nil {
+		return 0, 0, errBoltOnly
+	}
+	touched, copied := map[string]bool{}, []string{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 1024*1024), 64*1024*1024)
+	err = db.Update(func(tx *bolt.Tx) error {
+		line := 0
+		for scanner.Scan() {
+			line++
+			if len(strings.TrimSpace(scanner.Text())) == 0 {
+				continue
+			}
+			var kind struct {
+				Kind string `json:"kind"`
+			}
+			if err := json.Unmarshal(scanner.Bytes(), &kind); err != nil {
+				return fmt.Errorf("Line %d: %v", line, err)
+			}
+			if line == 1 && kind.Kind != "header" {
+				return fmt.Errorf("Line 1: header expected")
+			}
+			switch kind.Kind {
+			case "header":
+				var header exportHeader
+				json.Unmarshal(scanner.Bytes(), &header)
+				if header.Format != exportFormat || header.Version != exportVersion {
+					return fmt.Errorf("Unsupported export format %s version %d", header.Format, header.Version)
+				}
+				// Records are written as they are, so their layout must match the database
+				if current, _ := strconv.Atoi(string(tx.Bucket(Meta).Get(schemaKey))); header.Schema != current {
+					return fmt.Errorf("Export has schema version %d, database has %d, migrate the source database and export it again",
+						header.Schema, current)
+				}
+			case "user":
+				var record exportUser
+				if err := json.Unmarshal(scanner.Bytes(), &record); err != nil || len(record.Name) == 0 {
+					return fmt.Errorf("Line %d: malformed user record %v", line, err)
+				}
+				if err := writeUser(tx, record); err != nil {
+					return fmt.Errorf("Line %d: %v", line, err)
+				}
+				touched[record.Name] = true
+				users++
+			case "file":
+				var record exportFile
+				if err := json.Unmarshal(scanner.Bytes(), &record); err != nil || len(record.ID) == 0 {
+					return fmt.Errorf("Line %d: malformed file record %v", line, err)
+				}
+				if len(record.Blob) != 0 && (record.Blob != filepath.Base(record.Blob) || strings.Contains(record.Blob, "..")) {
+					return fmt.Errorf("Line %d: invalid blob name %q", line, record.Blob)
+				}
+				if tx.Bucket(MyBucket).Bucket([]byte(record.ID)) != nil {
+					log.Info("File " + record.ID + " already exists, skipping")
+					continue
+				}
+				if len(blobs) != 0 && len(record.Blob) != 0 {
+					if _, err := os.Stat(config.Storage.Path + record.Blob); os.IsNotExist(err) {
+						copied = append(copied, config.Storage.Path+record.Blob)
+						if err := copyFile(filepath.Join(blobs, record.Blob), config.Storage.Path+record.Blob); err != nil {
+							return fmt.Errorf("Line %d: importing content of %s: %v", line, record.ID, err)
+						}
+					}
+				}
+				if err := writeFile(tx, record); err != nil {
+					return fmt.Errorf("Line %d: %v", line, err)
+				}
+				for user := range record.Owners {
+					touched[user] = true
+				}
+				for _, user := range record.Scope {
+					touched[user] = true
+				}
+				files++
+			default:
+				log.Warn(fmt.Sprintf("Line %d: unknown record kind %s, skipping", line, kind.Kind))
+			}
+		}
+		return scanner.Err()
+	})
+	if err != nil {
+		// Records are rolled back, content copied for them isn't referenced by anything
+		for _, path := range copied {
+			os.Remove(path)
+		}
+		return 0, 0, err
+	}
+	for user := range touched {
+		opened().QuotaUsageStore(user, CountTotal(user))
+	}
+	return
+}
+
+func readUser(name string, b *bolt.Bucket) exportUser {
+	record := exportUser{Kind: "user", Name: name, Fields: map[string]string{}, Buckets: map[string]map[string]string{}}
+	b.ForEach(func(k, v []byte) error {
+		switch {
+		case v != nil && string(k) == "quota":
+			record.Quota = string(v)
+		case v != nil && string(k) == "stored":
+			record.Stored = string(v)
+		case v != nil:
+			record.Fields[string(k)] = string(v)
+		case string(k) == "keys":
+			record.Keys = bucketKeys(b.Bucket(k))
+		case string(k) == "sshkeys":
+			record.SSHKeys = bucketKeys(b.Bucket(k))
+		case string(k) == "revoked":
+			record.Revoked = bucketValues(b.Bucket(k))
+		case string(k) == "files":
+			record.Files = bucketValues(b.Bucket(k))
+		default:
+			record.Buckets[string(k)] = bucketValues(b.Bucket(k))
+		}
+		return nil
+	})
+	// Legacy key field duplicates one of keys, it is restored on import
+	if key, ok := record.Fields["key"]; ok {
+		if len(record.Keys) == 0 {
+			record.Keys = []string{key}
+		}
+		delete(record.Fields, "key")
+	}
+	return record
+}
+
+func writeUser(tx *bolt.Tx, record exportUser) error {
+	b, err := tx.Bucket(Users).CreateBucketIfNotExists([]byte(record.Name))
+	if err != nil {
+		return err
+	}
+	for k, v := range record.Fields {
+		if b.Get([]byte(k)) == nil {
+			b.Put([]byte(k), []byte(v))
+		}
+	}
+	if len(record.Quota) != 0 && b.Get([]byte("quota")) == nil {
+		b.Put([]byte("quota"), []byte(record.Quota))
+	}
+	if len(record.Stored) != 0 && b.Get([]byte("stored")) == nil {
+		b.Put([]byte("stored"), []byte(record.Stored))
+	}
+	// Revoked keys are merged first, so keys revoked on either side are not activated
+	if err = mergeBucket(b, "revoked", record.Revoked, false); err != nil {
+		return err
+	}
+	revoked := map[string]bool{}
+	if r := b.Bucket([]byte("revoked")); r != nil {
+		r.ForEach(func(key, v []byte) error {
+			revoked[fingerprint(string(key))] = true
+			return nil
+		})
+	}
+	buckets := map[string]map[string]string{"files": record.Files}
+	for name, values := range record.Buckets {
+		buckets[name] = values
+	}
+	buckets["keys"], buckets["sshkeys"] = map[string]string{}, map[string]string{}
+	for _, key := range record.Keys {
+		if !revoked[fingerprint(key)] {
+			buckets["keys"][key] = ""
+		}
+	}
+	for _, key := range record.Keys {
+		if _, ok := buckets["keys"][key]; ok && b.Get([]byte("key")) == nil {
+			b.Put([]byte("key"), []byte(key))
+		}
+	}
+	for _, key := range record.SSHKeys {
+		buckets["sshkeys"][key] = ""
+	}
+	for name, values := range buckets {
+		if err := mergeBucket(b, name, values, name == "keys" || name == "sshkeys"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readFile(id string, b *bolt.Bucket) exportFile {
+	record := exportFile{Kind: "file", ID: id, Fields: map[string]string{}, Buckets: map[string]map[string]string{}}
+	b.ForEach(func(k, v []byte) error {
+		switch {
+		case v != nil && string(k) == "name":
+			record.Name = string(v)
+		case v != nil && string(k) == "date":
+			record.Date = string(v)
+		case v != nil:
+			record.Fields[string(k)] = string(v)
+		case string(k) == "owner":
+			record.Owners = bucketValues(b.Bucket(k))
+		case string(k) == "hash":
+			record.Hash = bucketValues(b.Bucket(k))
+		case string(k) == "tags":
+			record.Tags = bucketKeys(b.Bucket(k))
+		case string(k) == "scope":
+			for user := range bucketValues(b.Bucket(k)) {
+				if user == string(publicScope) {
+					record.Public = true
+				} else if user != string(privateScope) {
+					record.Scope = append(record.Scope, user)
+				}
+			}
+		case string(k) == "type":
+			record.Repos = map[string][]string{}
+			b.Bucket(k).ForEach(func(repo, v []byte) error {
+				if c := b.Bucket(k).Bucket(repo); c != nil {
+					record.Repos[string(repo)] = bucketKeys(c)
+				}
+				return nil
+			})
+		default:
+			record.Buckets[string(k)] = bucketValues(b.Bucket(k))
+		}
+		return nil
+	})
+	for _, blob := range []string{record.Hash["md5"], record.Name} {
+		if _, err := os.Stat(config.Storage.Path + blob); len(blob) != 0 && err == nil {
+			record.Blob = blob
+			break
+		}
+	}
+	return record
+}
+
+func writeFile(tx *bolt.Tx, record exportFile) error {
+	b, err := tx.Bucket(MyBucket).CreateBucket([]byte(record.ID))
+	if err != nil {
+		return err
+	}
+	date := []byte(record.Date)
+	if len(date) == 0 {
+		date, _ = time.Now().MarshalText()
+	}
+	b.Put([]byte("name"), []byte(record.Name))
+	b.Put([]byte("date"), date)
+	for k, v := range record.Fields {
+		b.Put([]byte(k), []byte(v))
+	}
+	scope := map[string]string{string(privateScope): "w"}
+	if record.Public {
+		scope = map[string]string{string(publicScope): "w"}
+	}
+	for _, user := range record.Scope {
+		scope[user] = "w"
+	}
+	tags := map[string]string{}
+	for _, tag := range record.Tags {
+		tags[tag] = "w"
+	}
+	buckets := map[string]map[string]string{"owner": record.Owners, "scope": scope, "hash": record.Hash, "tags": tags}
+	for name, values := range record.Buckets {
+		buckets[name] = values
+	}
+	for name, values := range buckets {
+		if err := mergeBucket(b, name, values, false); err != nil {
+			return err
+		}
+	}
+	types, err := b.CreateBucketIfNotExists([]byte("type"))
+	if err != nil {
+		return err
+	}
+	for repo, owners := range record.Repos {
+		values := map[string]string{}
+		for _, owner := range owners {
+			values[owner] = "w"
+		}
+		if err := mergeBucket(types, repo, values, false); err != nil {
+			return err
+		}
+		if t, err := tx.Bucket(Tags).CreateBucketIfNotExists([]byte(repo)); err == nil {
+			for _, tag := range record.Tags {
+				if value := t.Get([]byte(tag)); value != nil {
+					t.Put([]byte(tag), []byte(string(value)+","+record.ID))
+				} else {
+					t.Put([]byte(tag), []byte(record.ID))
+				}
+			}
+		}
+	}
+	// Files shared with users and owned by them are listed in their files bucket
+	for user := range scope {
+		if u := tx.Bucket(Users).Bucket([]byte(user)); u != nil {
+			mergeBucket(u, "files", map[string]string{record.ID: record.Name}, false)
+		}
+	}
+	for owner := range record.Owners {
+		if u, err := tx.Bucket(Users).CreateBucketIfNotExists([]byte(owner)); err == nil {
+			mergeBucket(u, "files", map[string]string{record.ID: record.Name}, false)
+		}
+	}
+	index, err := tx.Bucket(SearchIndex).CreateBucketIfNotExists([]byte(strings.ToLower(record.Name)))
+	if err != nil {
+		return err
+	}
+	if err = index.Put(date, []byte(record.ID)); err != nil {
+		return err
+	}
+	return indexFile(tx, record.ID)
+}
+
+// mergeBucket adds values missing in nested bucket, keys of lists like "keys" are stored with nil values
+func mergeBucket(b *bolt.Bucket, name string, values map[string]string, list bool) error {
+	if len(values) == 0 {
+		return nil
+	}
+	c, err := b.CreateBucketIfNotExists([]byte(name))
+	if err != nil {
+		return err
+	}
+	for k, v := range values {
+		if found, _ := c.Cursor().Seek([]byte(k)); string(found) == k {
+			continue
+		}
+		value := []byte(v)
+		if list {
+			value = nil
+		}
+		if err := c.Put([]byte(k), value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func bucketKeys(b *bolt.Bucket) (list []string) {
+	b.ForEach(func(k, v []byte) error {
+		list = append(list, string(k))
+		return nil
+	})
+	return
+}
+
+func bucketValues(b *bolt.Bucket) map[string]string {
+	values := map[string]string{}
+	b.ForEach(func(k, v []byte) error {
+		values[string(k)] = string(v)
+		return nil
+	})
+	return values
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
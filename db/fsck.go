@@ -0,0 +1,274 @@
+package db
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/subutai-io/agent/log"
+	"github.com/subutai-io/cdn/config"
+)
+
+// Kinds of problems reported by Fsck
+const (
+	OrphanBlob   = "orphan-blob"   // file in storage directory which doesn't belong to any record
+	MissingBlob  = "missing-blob"  // record of file which content is missing in storage directory
+	StaleSearch  = "stale-search"  // search index entry pointing to deleted file
+	DanglingFile = "dangling-file" // entry of user's files pointing to deleted file
+	StaleTag     = "stale-tag"     // tag index entry pointing to deleted file
+	WrongQuota   = "wrong-quota"   // stored quota usage differs from total size of user's files
+)
+
+// orphanGrace is the age of files in storage directory below which they are not reported as orphans,
+// content of uploads is written before its record is registered
+const orphanGrace = time.Hour
+
+// Generated lists files which repos generate in storage directory, they don't have records. Repos add their files on init.
+var Generated = map[string]bool{}
+
+// Problem describes inconsistency between database and storage directory
+type Problem struct {
+	Kind     string `json:"kind"`
+	ID       string `json:"id,omitempty"`
+	User     string `json:"user,omitempty"`
+	Name     string `json:"name,omitempty"`
+	Detail   string `json:"detail,omitempty"`
+	Repaired bool   `json:"repaired"`
+}
+
+func (p Problem) String() string {
+	s := p.Kind
+	for _, v := range []string{p.User, p.ID, p.Name, p.Detail} {
+		if len(v) != 0 {
+			s += " " + v
+		}
+	}
+	if p.Repaired {
+		s += " (repaired)"
+	}
+	return s
+}
+
+// Report is the result of Fsck
+type Report struct {
+	Files    int       `json:"files"`
+	Blobs    int       `json:"blobs"`
+	Users    int       `json:"users"`
+	Repair   bool      `json:"repair"`
+	Problems []Problem `json:"problems"`
+}
+
+// Unrepaired returns number of problems left in database or storage
+func (r Report) Unrepaired() (n int) {
+	for _, p := range r.Problems {
+		if !p.Repaired {
+			n++
+		}
+	}
+	return
+}
+
+// Fsck checks consistency of records of files, users' file lists, search and tag indexes, quota usage
+// and content of storage directory. Nothing is changed unless repair is true: then orphan blobs are removed
+// from disk, records of files with missing content are deleted, stale index entries are dropped and
+// quota usage is recounted. Files modified within orphanGrace may belong to uploads in progress, they are skipped.
+func Fsck(repair bool) (report Report, err error) {
+	report.Repair = repair
+	blobs, err := ioutil.ReadDir(config.Storage.Path)
+	if err != nil {
+		return report, err
+	}
+	known := map[string]bool{}
+	for name := range Generated {
+		known[name] = true
+	}
+	for _, id := range opened().Files() {
+		report.Files++
+		info := Info(id)
+		found := false
+		for _, blob := range []string{info["md5"], info["name"], info["Filename"]} {
+			if len(blob) == 0 {
+				continue
+			}
+			known[blob] = true
+			if _, err := os.Stat(config.Storage.Path + blob); err == nil {
+				found = true
+			}
+		}
+		if found {
+			continue
+		}
+		p := Problem{Kind: MissingBlob, ID: id, Name: info["name"]}
+		if repair {
+			deleteRecord(id)
+			p.Repaired = len(Info(id)) == 0
+		}
+		report.Problems = append(report.Problems, p)
+	}
+	for _, blob := range blobs {
+		if blob.IsDir() {
+			continue
+		}
+		report.Blobs++
+		if known[blob.Name()] || time.Since(blob.ModTime()) < orphanGrace {
+			continue
+		}
+		p := Problem{Kind: OrphanBlob, Name: blob.Name(), Detail: strconv.FormatInt(blob.Size(), 10) + " bytes"}
+		if repair {
+			p.Repaired = !log.Check(log.WarnLevel, "Removing orphan blob "+blob.Name(), os.Remove(config.Storage.Path+blob.Name()))
+		}
+		report.Problems = append(report.Problems, p)
+	}
+	report.Problems = append(report.Problems, opened().Check(repair)...)
+	for _, user := range opened().Users() {
+		report.Users++
+		real := CountTotal(user)
+		stored, ok := opened().QuotaUsage(user)
+		if !ok || stored == real {
+			continue
+		}
+		p := Problem{Kind: WrongQuota, User: user, Detail: fmt.Sprintf("stored %d, real %d", stored, real)}
+		if repair {
+			opened().QuotaUsageStore(user, real)
+			p.Repaired = true
+		}
+		report.Problems = append(report.Problems, p)
+	}
+	for _, p := range report.Problems {
+		log.Info("Fsck: " + p.String())
+	}
+	return report, nil
+}
+
+// deleteRecord removes record of file for every owner and repo
+func deleteRecord(id string) {
+	repos := FileField(id, "type")
+	for _, owner := range FileField(id, "owner") {
+		for _, repo := range repos {
+			Delete(owner, repo, id)
+		}
+	}
+}
+
+// Files returns IDs of all file records
+func (s *boltStore) Files() (list []string) {
+	db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(MyBucket).ForEach(func(id, v []byte) error {
+			if v == nil {
+				list = append(list, string(id))
+			}
+			return nil
+		})
+	})
+	return
+}
+
+// Check finds search index, users' files and tag index entries pointing to missing files and drops them if repair is true
+func (s *boltStore) Check(repair bool) (list []Problem) {
+	check := db.View
+	if repair {
+		check = db.Update
+	}
+	err := check(func(tx *bolt.Tx) error {
+		files := tx.Bucket(MyBucket)
+		exists := func(id []byte) bool { return files.Bucket(id) != nil }
+		// SearchIndex/<lower-cased name>/<date> = <file id>
+		search := tx.Bucket(SearchIndex)
+		empty := [][]byte{}
+		search.ForEach(func(name, v []byte) error {
+			b := search.Bucket(name)
+			if b == nil {
+				return nil
+			}
+			stale := [][]byte{}
+			b.ForEach(func(date, id []byte) error {
+				if !exists(id) {
+					list = append(list, Problem{Kind: StaleSearch, ID: string(id), Name: string(name), Repaired: repair})
+					stale = append(stale, date)
+				}
+				return nil
+			})
+			if repair {
+				for _, date := range stale {
+					b.Delete(date)
+				}
+				if k, _ := b.Cursor().First(); k == nil {
+					empty = append(empty, name)
+				}
+			}
+			return nil
+		})
+		for _, name := range empty {
+			search.DeleteBucket(name)
+		}
+		// Users/<user>/files/<file id> = <file name>
+		users := tx.Bucket(Users)
+		users.ForEach(func(user, v []byte) error {
+			b := lookup(users, string(user), "files")
+			if b == nil {
+				return nil
+			}
+			dangling := [][]byte{}
+			b.ForEach(func(id, name []byte) error {
+				if !exists(id) {
+					list = append(list, Problem{Kind: DanglingFile, User: string(user), ID: string(id), Name: string(name), Repaired: repair})
+					dangling = append(dangling, id)
+				}
+				return nil
+			})
+			if repair {
+				for _, id := range dangling {
+					b.Delete(id)
+				}
+			}
+			return nil
+		})
+		// Tags/<tag>/<file id> = "w" and Tags/<repo>/<tag> = <comma separated file ids>
+		tags := tx.Bucket(Tags)
+		tags.ForEach(func(name, v []byte) error {
+			b := tags.Bucket(name)
+			if b == nil {
+				return nil
+			}
+			changed := map[string][]string{}
+			b.ForEach(func(k, v []byte) error {
+				if string(v) == "w" {
+					if !exists(k) {
+						list = append(list, Problem{Kind: StaleTag, ID: string(k), Name: string(name), Repaired: repair})
+						changed[string(k)] = nil
+					}
+					return nil
+				}
+				ids, kept := strings.Split(string(v), ","), []string{}
+				for _, id := range ids {
+					if exists([]byte(id)) {
+						kept = append(kept, id)
+					} else {
+						list = append(list, Problem{Kind: StaleTag, ID: id, Name: string(name) + "/" + string(k), Repaired: repair})
+					}
+				}
+				if len(kept) != len(ids) {
+					changed[string(k)] = kept
+				}
+				return nil
+			})
+			if repair {
+				for k, kept := range changed {
+					if len(kept) == 0 {
+						b.Delete([]byte(k))
+					} else {
+						b.Put([]byte(k), []byte(strings.Join(kept, ",")))
+					}
+				}
+			}
+			return nil
+		})
+		return nil
+	})
+	log.Check(log.WarnLevel, "Checking indexes", err)
+	return
+}
@@ -0,0 +1,147 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/boltdb/bolt"
+	"github.com/subutai-io/agent/log"
+)
+
+// Index keeps secondary indexes of files, so listings don't have to check every file in separate transaction:
+//
+//	repo/<repo>/<id>                     - files of repo
+//	owner/<repo>/<owner>/<id>            - files uploaded to repo by owner
+//	version/<repo>/<name>/<version>/<id> - files of repo by lower-cased name and version
+//
+// Indexes are updated together with file record in Write, Edit and Delete. Files in trash are not indexed.
+var Index = []byte("Index")
+
+// nested returns bucket at path creating missing buckets
+func nested(b *bolt.Bucket, path ...string) (*bolt.Bucket, error) {
+	var err error
+	for _, name := range path {
+		if b, err = b.CreateBucketIfNotExists([]byte(name)); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// lookup returns bucket at path or nil if some of buckets is missing
+func lookup(b *bolt.Bucket, path ...string) *bolt.Bucket {
+	for _, name := range path {
+		if b == nil {
+			return nil
+		}
+		b = b.Bucket([]byte(name))
+	}
+	return b
+}
+
+// indexPaths returns index entries of file according to its record in MyBucket
+func indexPaths(tx *bolt.Tx, id string) (paths [][]string) {
+	b := tx.Bucket(MyBucket).Bucket([]byte(id))
+	if b == nil || b.Get([]byte("trashed")) != nil {
+		return
+	}
+	types := b.Bucket([]byte("type"))
+	if types == nil {
+		return
+	}
+	name := strings.ToLower(string(b.Get([]byte("name"))))
+	version := string(b.Get([]byte("version")))
+	types.ForEach(func(repo, v []byte) error {
+		if v != nil {
+			return nil
+		}
+		paths = append(paths, []string{"repo", string(repo)})
+		types.Bucket(repo).ForEach(func(owner, v []byte) error {
+			paths = append(paths, []string{"owner", string(repo), string(owner)})
+			return nil
+		})
+		if len(name) != 0 {
+			paths = append(paths, []string{"version", string(repo), name, version})
+		}
+		return nil
+	})
+	return
+}
+
+// indexFile adds file to indexes
+func indexFile(tx *bolt.Tx, id string) error {
+	for _, path := range indexPaths(tx, id) {
+		b, err := nested(tx.Bucket(Index), path...)
+		if err != nil {
+			return err
+		}
+		if err = b.Put([]byte(id), []byte("w")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unindexFile removes file from indexes, it must be called before file record is changed
+func unindexFile(tx *bolt.Tx, id string) {
+	for _, path := range indexPaths(tx, id) {
+		if b := lookup(tx.Bucket(Index), path...); b != nil {
+			b.Delete([]byte(id))
+		}
+	}
+}
+
+// reindexAll drops indexes and builds them from records of all files
+func reindexAll(tx *bolt.Tx) (files int, err error) {
+	if err = tx.DeleteBucket(Index); err != nil && err != bolt.ErrBucketNotFound {
+		return
+	}
+	if _, err = tx.CreateBucket(Index); err != nil {
+		return
+	}
+	err = tx.Bucket(MyBucket).ForEach(func(id, v []byte) error {
+		if v != nil {
+			return nil
+		}
+		files++
+		return indexFile(tx, string(id))
+	})
+	return
+}
+
+// indexKeys returns keys of index bucket at path
+func indexKeys(path ...string) (list []string) {
+	db.View(func(tx *bolt.Tx) error {
+		if b := lookup(tx.Bucket(Index), path...); b != nil {
+			list = bucketKeys(b)
+		}
+		return nil
+	})
+	return
+}
+
+// RepoFiles returns IDs of all files in repo
+func (s *boltStore) RepoFiles(repo string) []string {
+	return indexKeys("repo", repo)
+}
+
+// OwnerFiles returns IDs of files uploaded to repo by owner
+func (s *boltStore) OwnerFiles(repo, owner string) []string {
+	return indexKeys("owner", repo, owner)
+}
+
+// VersionFiles returns IDs of files in repo with name and version, name is case insensitive
+func (s *boltStore) VersionFiles(repo, name, version string) []string {
+	return indexKeys("version", repo, strings.ToLower(name), version)
+}
+
+// Reindex rebuilds secondary indexes from records of files
+func (s *boltStore) Reindex() error {
+	return db.Update(func(tx *bolt.Tx) error {
+		files, err := reindexAll(tx)
+		if err == nil {
+			log.Info(fmt.Sprintf("Indexes are rebuilt for %d files", files))
+		}
+		return err
+	})
+}
@@ -0,0 +1,249 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/subutai-io/agent/log"
+	"github.com/subutai-io/cdn/config"
+)
+
+var (
+	// Meta keeps information about database itself, like schema version
+	Meta = []byte("Meta")
+
+	schemaKey = []byte("schema")
+	errDryRun = fmt.Errorf("Dry run")
+)
+
+// migration converts data stored in database to the layout of particular schema version.
+// Migration receives dry flag to skip changes outside of database, changes inside are rolled back anyway.
+type migration struct {
+	version int
+	name    string
+	apply   func(tx *bolt.Tx, dry bool) (changes int, err error)
+}
+
+// migrations must be ordered by version, new migrations are appended to the end of the list
+var migrations = []migration{
+	{1, "Flatten legacy share scopes and mark files as public or private", migrateScopes},
+	{2, "Move legacy user keys into keys bucket", migrateUserKeys},
+	{3, "Remove auth IDs stored in plain format", migrateAuthID},
+	{4, "Rename apt packages stored by md5 to their names", migrateDebNames},
+	{5, "Build secondary indexes of files", migrateIndexes},
+	{6, "Drop session tokens stored before lookups were limited to token hashes", migrateTokens},
+}
+
+// SchemaVersion returns version of data layout stored in database, zero means that database was never migrated
+func SchemaVersion() (version int) {
+	if opened(); db == nil {
+		return LatestSchema()
+	}
+	db.View(func(tx *bolt.Tx) error {
+		version, _ = strconv.Atoi(string(tx.Bucket(Meta).Get(schemaKey)))
+		return nil
+	})
+	return
+}
+
+// LatestSchema returns schema version supported by this build
+func LatestSchema() int {
+	return migrations[len(migrations)-1].version
+}
+
+// Migrate applies pending migrations one by one, every migration runs in its own transaction.
+// If dry is true, changes are only reported and rolled back. If backup is true, copy of database
+// is saved next to it before the first migration. SQL store needs no migrations.
+func Migrate(dry, backup bool) error {
+	if opened(); db == nil {
+		log.Debug("SQL store creates its schema on start, nothing to migrate")
+		return nil
+	}
+	current := SchemaVersion()
+	if current > LatestSchema() {
+		return fmt.Errorf("Database schema version %d is newer than supported version %d", current, LatestSchema())
+	}
+	if current == LatestSchema() {
+		log.Debug(fmt.Sprintf("Database schema is up to date: %d", current))
+		return nil
+	}
+	if backup && !dry {
+		path := fmt.Sprintf("%s.schema%d-%s", config.DB.Path, current, time.Now().Format("20060102150405"))
+		if err := BackupFile(path); err != nil {
+			return fmt.Errorf("Backing up database: %v", err)
+		}
+		log.Info("Database is backed up to " + path)
+	}
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		err := db.Update(func(tx *bolt.Tx) error {
+			changes, err := m.apply(tx, dry)
+			if err != nil {
+				return err
+			}
+			log.Info(fmt.Sprintf("Migration %d \"%s\": %d changes", m.version, m.name, changes))
+			if dry {
+				return errDryRun
+			}
+			return tx.Bucket(Meta).Put(schemaKey, []byte(strconv.Itoa(m.version)))
+		})
+		if err != nil && err != errDryRun {
+			return fmt.Errorf("Migration %d \"%s\" failed: %v", m.version, m.name, err)
+		}
+	}
+	return nil
+}
+
+// migrateScopes converts scopes stored as nested buckets to flat list of users and sets
+// public or private marker, which was previously done on the fly by RebuildShare.
+func migrateScopes(tx *bolt.Tx, dry bool) (changes int, err error) {
+	files := tx.Bucket(MyBucket)
+	err = files.ForEach(func(hash, v []byte) error {
+		c := files.Bucket(hash)
+		if c == nil {
+			return nil
+		}
+		scope := c.Bucket([]byte("scope"))
+		if scope == nil || scope.Get(publicScope) != nil || scope.Get(privateScope) != nil {
+			return nil
+		}
+		public := true
+		nested := [][]byte{}
+		users := map[string][]byte{}
+		scope.ForEach(func(k, v []byte) error {
+			if v != nil {
+				return nil
+			}
+			nested = append(nested, k)
+			return scope.Bucket(k).ForEach(func(user, value []byte) error {
+				if string(user) == string(k) {
+					public = false
+				} else {
+					users[string(user)] = value
+				}
+				return nil
+			})
+		})
+		for _, k := range nested {
+			if err := scope.DeleteBucket(k); err != nil {
+				return err
+			}
+		}
+		for user, value := range users {
+			if scope.Get([]byte(user)) == nil {
+				scope.Put([]byte(user), value)
+			}
+		}
+		if public {
+			scope.Put(publicScope, []byte("w"))
+		} else {
+			scope.Put(privateScope, []byte("w"))
+		}
+		changes++
+		return nil
+	})
+	return
+}
+
+// migrateUserKeys copies legacy key field of users registered before multiple keys were supported into keys bucket
+func migrateUserKeys(tx *bolt.Tx, dry bool) (changes int, err error) {
+	users := tx.Bucket(Users)
+	err = users.ForEach(func(name, v []byte) error {
+		b := users.Bucket(name)
+		if b == nil || b.Get([]byte("key")) == nil || b.Bucket([]byte("keys")) != nil {
+			return nil
+		}
+		keys, err := b.CreateBucket([]byte("keys"))
+		if err != nil {
+			return err
+		}
+		changes++
+		return keys.Put(b.Get([]byte("key")), nil)
+	})
+	return
+}
+
+// migrateAuthID removes auth IDs which were stored as plain keys before they were hashed
+func migrateAuthID(tx *bolt.Tx, dry bool) (changes int, err error) {
+	b := tx.Bucket(AuthID)
+	legacy := [][]byte{}
+	b.ForEach(func(k, v []byte) error {
+		if v != nil {
+			legacy = append(legacy, k)
+		}
+		return nil
+	})
+	for _, k := range legacy {
+		if err = b.Delete(k); err != nil {
+			return
+		}
+		changes++
+	}
+	return
+}
+
+// migrateDebNames renames apt packages which were stored under their md5 hash to package names. Files are renamed
+// only after the transaction is committed, so a failed migration leaves storage untouched and is retried as a whole.
+func migrateDebNames(tx *bolt.Tx, dry bool) (changes int, err error) {
+	files := tx.Bucket(MyBucket)
+	err = files.ForEach(func(id, v []byte) error {
+		b := files.Bucket(id)
+		if b == nil || b.Bucket([]byte("type")) == nil || b.Bucket([]byte("type")).Bucket([]byte("apt")) == nil {
+			return nil
+		}
+		h := b.Bucket([]byte("hash"))
+		name := string(b.Get([]byte("name")))
+		if h == nil || h.Get([]byte("md5")) == nil || len(name) == 0 {
+			return nil
+		}
+		old := config.Storage.Path + string(h.Get([]byte("md5")))
+		if _, err := os.Stat(old); err != nil {
+			return nil
+		}
+		if _, err := os.Stat(config.Storage.Path + name); err == nil {
+			return nil
+		}
+		changes++
+		if dry {
+			return nil
+		}
+		tx.OnCommit(func() {
+			log.Check(log.WarnLevel, "Renaming "+old+" to "+name, os.Rename(old, config.Storage.Path+name))
+		})
+		return nil
+	})
+	return
+}
+
+// migrateIndexes builds indexes of files written before they were maintained
+func migrateIndexes(tx *bolt.Tx, dry bool) (changes int, err error) {
+	return reindexAll(tx)
+}
+
+// migrateTokens removes session tokens stored before token lookups stopped accepting stored keys as tokens.
+// Keys of legacy plain tokens can't be told apart from hashes, so all sessions are dropped and users get new tokens.
+func migrateTokens(tx *bolt.Tx, dry bool) (changes int, err error) {
+	b := tx.Bucket(Tokens)
+	list := [][]byte{}
+	b.ForEach(func(k, v []byte) error {
+		list = append(list, k)
+		return nil
+	})
+	for _, k := range list {
+		changes++
+		if b.Bucket(k) != nil {
+			err = b.DeleteBucket(k)
+		} else {
+			err = b.Delete(k)
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
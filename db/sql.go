@@ -0,0 +1,967 @@
+package db
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/subutai-io/agent/log"
+	"github.com/subutai-io/cdn/config"
+)
+
+// sqlSchema creates tables of SQL store. Nested buckets of bolt store are represented by separate tables,
+// public and private scope markers are kept in "scope" column of files table.
+var sqlSchema = []string{
+	`CREATE TABLE IF NOT EXISTS files (id VARCHAR(255) PRIMARY KEY, name TEXT NOT NULL, date VARCHAR(64) NOT NULL,
+		scope VARCHAR(16) NOT NULL DEFAULT '', torrent TEXT)`,
+	`CREATE INDEX IF NOT EXISTS files_name ON files (name)`,
+	`CREATE TABLE IF NOT EXISTS file_fields (file_id VARCHAR(255) NOT NULL, field VARCHAR(255) NOT NULL, value TEXT NOT NULL,
+		PRIMARY KEY (file_id, field))`,
+	`CREATE TABLE IF NOT EXISTS file_hashes (file_id VARCHAR(255) NOT NULL, algorithm VARCHAR(16) NOT NULL, value VARCHAR(255) NOT NULL,
+		PRIMARY KEY (file_id, algorithm))`,
+	`CREATE INDEX IF NOT EXISTS file_hashes_value ON file_hashes (value)`,
+	`CREATE TABLE IF NOT EXISTS file_owners (file_id VARCHAR(255) NOT NULL, owner VARCHAR(255) NOT NULL, signature TEXT NOT NULL,
+		PRIMARY KEY (file_id, owner))`,
+	`CREATE TABLE IF NOT EXISTS file_shares (file_id VARCHAR(255) NOT NULL, name VARCHAR(255) NOT NULL,
+		PRIMARY KEY (file_id, name))`,
+	`CREATE TABLE IF NOT EXISTS file_types (file_id VARCHAR(255) NOT NULL, repo VARCHAR(64) NOT NULL, owner VARCHAR(255) NOT NULL,
+		PRIMARY KEY (file_id, repo, owner))`,
+	`CREATE INDEX IF NOT EXISTS file_types_repo ON file_types (repo, owner)`,
+	`CREATE TABLE IF NOT EXISTS file_tags (file_id VARCHAR(255) NOT NULL, tag VARCHAR(255) NOT NULL,
+		PRIMARY KEY (file_id, tag))`,
+	`CREATE TABLE IF NOT EXISTS tag_index (repo VARCHAR(64) NOT NULL, tag VARCHAR(255) NOT NULL, file_id VARCHAR(255) NOT NULL,
+		seq INTEGER NOT NULL, PRIMARY KEY (repo, tag, seq))`,
+	`CREATE TABLE IF NOT EXISTS users (name VARCHAR(255) PRIMARY KEY, key TEXT, quota VARCHAR(32), stored VARCHAR(32))`,
+	`CREATE TABLE IF NOT EXISTS user_keys (name VARCHAR(255) NOT NULL, key_hash VARCHAR(64) NOT NULL, key TEXT NOT NULL,
+		revoked VARCHAR(64), PRIMARY KEY (name, key_hash))`,
+	`CREATE TABLE IF NOT EXISTS user_sshkeys (name VARCHAR(255) NOT NULL, key_hash VARCHAR(64) NOT NULL, key TEXT NOT NULL,
+		PRIMARY KEY (name, key_hash))`,
+	`CREATE TABLE IF NOT EXISTS user_files (name VARCHAR(255) NOT NULL, file_id VARCHAR(255) NOT NULL, file_name TEXT NOT NULL,
+		PRIMARY KEY (name, file_id))`,
+	`CREATE TABLE IF NOT EXISTS tokens (hash VARCHAR(255) PRIMARY KEY, name VARCHAR(255) NOT NULL, date VARCHAR(64) NOT NULL)`,
+	`CREATE TABLE IF NOT EXISTS authids (hash VARCHAR(255) PRIMARY KEY, name VARCHAR(255) NOT NULL, date VARCHAR(64) NOT NULL)`,
+}
+
+// sqlStore keeps metadata in SQL database through database/sql, so several gorjun processes can share it.
+// Driver must be registered by importing its package, see drivers.go.
+type sqlStore struct {
+	db     *sql.DB
+	dollar bool
+}
+
+func newSQLStore(driver, dsn string) (*sqlStore, error) {
+	// SQLite allows one writer at a time, waiting writers retry for a while instead of failing with "database is locked"
+	if driver == "sqlite3" && !strings.Contains(dsn, "_busy_timeout") {
+		if strings.Contains(dsn, "?") {
+			dsn += "&_busy_timeout=5000"
+		} else {
+			dsn += "?_busy_timeout=5000"
+		}
+	}
+	conn, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if driver == "sqlite3" {
+		conn.SetMaxOpenConns(1)
+	}
+	if err = conn.Ping(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	os.MkdirAll(config.Storage.Path, 0755)
+	s := &sqlStore{db: conn, dollar: driver == "postgres" || driver == "pgx"}
+	for _, query := range sqlSchema {
+		if _, err = conn.Exec(query); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("Creating schema: %v", err)
+		}
+	}
+	return s, nil
+}
+
+// rebind converts "?" placeholders to "$N" for drivers which require numbered placeholders
+func (s *sqlStore) rebind(query string) string {
+	if !s.dollar {
+		return query
+	}
+	var out strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			out.WriteString("$" + strconv.Itoa(n))
+		} else {
+			out.WriteRune(r)
+		}
+	}
+	return out.String()
+}
+
+func (s *sqlStore) exec(query string, args ...interface{}) error {
+	_, err := s.db.Exec(s.rebind(query), args...)
+	log.Check(log.WarnLevel, "Executing "+strings.Fields(query)[0]+" query", err)
+	return err
+}
+
+// value returns the first column of the first row, empty string and false if there are no rows
+func (s *sqlStore) value(query string, args ...interface{}) (string, bool) {
+	var v sql.NullString
+	err := s.db.QueryRow(s.rebind(query), args...).Scan(&v)
+	if err == sql.ErrNoRows {
+		return "", false
+	}
+	if log.Check(log.WarnLevel, "Querying store", err) {
+		return "", false
+	}
+	return v.String, true
+}
+
+// column returns the first column of all rows
+func (s *sqlStore) column(query string, args ...interface{}) (list []string) {
+	rows, err := s.db.Query(s.rebind(query), args...)
+	if log.Check(log.WarnLevel, "Querying store", err) {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var v sql.NullString
+		if rows.Scan(&v) == nil {
+			list = append(list, v.String)
+		}
+	}
+	return
+}
+
+// pairs returns the first two columns of all rows as map
+func (s *sqlStore) pairs(query string, args ...interface{}) map[string]string {
+	list := map[string]string{}
+	rows, err := s.db.Query(s.rebind(query), args...)
+	if log.Check(log.WarnLevel, "Querying store", err) {
+		return list
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var k, v sql.NullString
+		if rows.Scan(&k, &v) == nil {
+			list[k.String] = v.String
+		}
+	}
+	return list
+}
+
+// txColumn returns the first column of all rows selected in transaction
+func (s *sqlStore) txColumn(tx *sql.Tx, query string, args ...interface{}) (list []string, err error) {
+	rows, err := tx.Query(s.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var v sql.NullString
+		if err = rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		list = append(list, v.String)
+	}
+	return list, rows.Err()
+}
+
+// tx runs function in transaction, which is committed if function returns nil
+func (s *sqlStore) tx(f func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err = f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) txExec(tx *sql.Tx, query string, args ...interface{}) error {
+	_, err := tx.Exec(s.rebind(query), args...)
+	return err
+}
+
+// affected executes query in transaction and reports whether it changed any rows
+func (s *sqlStore) affected(tx *sql.Tx, query string, args ...interface{}) (bool, error) {
+	result, err := tx.Exec(s.rebind(query), args...)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// insert adds row unless row with the same primary key exists
+func (s *sqlStore) insert(tx *sql.Tx, table string, columns []string, args ...interface{}) error {
+	marks := strings.TrimSuffix(strings.Repeat("?, ", len(args)), ", ")
+	return s.txExec(tx, "INSERT INTO "+table+" VALUES ("+marks+") ON CONFLICT ("+strings.Join(columns, ", ")+") DO NOTHING", args...)
+}
+
+// upsert sets value of column in row identified by key columns, row is created if needed
+func (s *sqlStore) upsert(tx *sql.Tx, table string, columns []string, args ...interface{}) error {
+	marks := strings.TrimSuffix(strings.Repeat("?, ", len(args)), ", ")
+	return s.txExec(tx, "INSERT INTO "+table+" VALUES ("+marks+") ON CONFLICT ("+strings.Join(columns, ", ")+") DO UPDATE SET value = excluded.value", args...)
+}
+
+func keyHash(key string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(key)))
+}
+
+func now() string {
+	date, _ := time.Now().MarshalText()
+	return string(date)
+}
+
+func fileSize(name string) (string, bool) {
+	if fi, err := os.Stat(config.Storage.Path + name); err == nil {
+		return fmt.Sprint(fi.Size()), true
+	}
+	return "", false
+}
+
+func (s *sqlStore) Write(owner, key, value string, options ...map[string]string) error {
+	err := s.tx(func(tx *sql.Tx) error {
+		return s.write(tx, owner, key, value, options...)
+	})
+	log.Check(log.WarnLevel, "Writing data to db", err)
+	return err
+}
+
+func (s *sqlStore) write(tx *sql.Tx, owner, key, value string, options ...map[string]string) error {
+	if len(owner) == 0 {
+		owner = "subutai"
+	}
+	if err := s.insert(tx, "users", []string{"name"}, owner, nil, nil, nil); err != nil {
+		return err
+	}
+	if err := s.insert(tx, "user_files", []string{"name", "file_id"}, owner, key, value); err != nil {
+		return err
+	}
+	if err := s.insert(tx, "files", []string{"id"}, key, value, now(), "", nil); err != nil {
+		return err
+	}
+	var owners int
+	tx.QueryRow(s.rebind("SELECT COUNT(*) FROM file_owners WHERE file_id = ?"), key).Scan(&owners)
+	if owners == 0 {
+		if err := s.txExec(tx, "INSERT INTO file_owners VALUES (?, ?, ?)", key, owner, "w"); err != nil {
+			return err
+		}
+	}
+	for i := range options {
+		for k, v := range options[i] {
+			var err error
+			switch k {
+			case "type":
+				err = s.insert(tx, "file_types", []string{"file_id", "repo", "owner"}, key, v, owner)
+			case "md5", "sha256":
+				if err = s.upsert(tx, "file_hashes", []string{"file_id", "algorithm"}, key, k, v); err == nil {
+					if size, ok := fileSize(v); ok {
+						err = s.upsert(tx, "file_fields", []string{"file_id", "field"}, key, "size", size)
+					}
+				}
+			case "tags":
+				for _, tag := range strings.Split(v, ",") {
+					if tag = strings.ToLower(strings.TrimSpace(tag)); len(tag) == 0 {
+						continue
+					}
+					if err = s.insert(tx, "file_tags", []string{"file_id", "tag"}, key, tag); err == nil {
+						err = s.addTag(tx, "template", tag, key)
+					}
+				}
+			case "signature":
+				err = s.txExec(tx, "UPDATE file_owners SET signature = ? WHERE file_id = ? AND owner = ?", v, key, owner)
+				if err == nil {
+					err = s.insert(tx, "file_owners", []string{"file_id", "owner"}, key, owner, v)
+				}
+			default:
+				err = s.insert(tx, "file_fields", []string{"file_id", "field"}, key, k, v)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *sqlStore) Edit(owner, key, value string, options ...map[string]string) {
+	if len(owner) == 0 {
+		owner = "subutai"
+	}
+	err := s.tx(func(tx *sql.Tx) error {
+		if err := s.insert(tx, "users", []string{"name"}, owner, nil, nil, nil); err != nil {
+			return err
+		}
+		if err := s.insert(tx, "user_files", []string{"name", "file_id"}, owner, key, value); err != nil {
+			return err
+		}
+		var n int
+		if tx.QueryRow(s.rebind("SELECT COUNT(*) FROM files WHERE id = ?"), key).Scan(&n); n == 0 {
+			return nil
+		}
+		if err := s.insert(tx, "file_owners", []string{"file_id", "owner"}, key, owner, "w"); err != nil {
+			return err
+		}
+		for i := range options {
+			for k, v := range options[i] {
+				var err error
+				switch k {
+				case "type":
+					err = s.insert(tx, "file_types", []string{"file_id", "repo", "owner"}, key, v, owner)
+				case "md5", "sha256":
+					if err = s.upsert(tx, "file_hashes", []string{"file_id", "algorithm"}, key, k, v); err == nil {
+						if size, ok := fileSize(v); ok {
+							err = s.upsert(tx, "file_fields", []string{"file_id", "field"}, key, "size", size)
+						}
+					}
+				case "tags":
+					for _, tag := range strings.Split(v, ",") {
+						if tag = strings.ToLower(strings.TrimSpace(tag)); len(tag) != 0 {
+							err = s.insert(tx, "file_tags", []string{"file_id", "tag"}, key, tag)
+						}
+					}
+				case "signature":
+					if len(v) > 0 {
+						err = s.txExec(tx, "UPDATE file_owners SET signature = ? WHERE file_id = ? AND owner = ?", v, key, owner)
+					}
+				default:
+					err = s.upsert(tx, "file_fields", []string{"file_id", "field"}, key, k, v)
+				}
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	log.Check(log.WarnLevel, "Editing data in db", err)
+}
+
+func (s *sqlStore) Delete(owner, repo, key string) (total int) {
+	owned := s.CheckRepo(owner, []string{}, key)
+	md5, _ := s.Hash(key)
+	total = s.CheckRepo("", []string{}, key)
+	s.tx(func(tx *sql.Tx) error {
+		s.txExec(tx, "DELETE FROM file_types WHERE file_id = ? AND repo = ? AND owner = ?", key, repo, owner)
+		if owned == 1 {
+			s.txExec(tx, "DELETE FROM file_shares WHERE file_id = ? AND name = ?", key, owner)
+			s.txExec(tx, "DELETE FROM file_owners WHERE file_id = ? AND owner = ?", key, owner)
+			log.Info(fmt.Sprintf("Deleting %s from %s's files", key, owner))
+			s.txExec(tx, "DELETE FROM user_files WHERE name = ? AND file_id = ?", owner, key)
+		}
+		// Removing file only if no file owners left
+		if total == 1 || key != md5 {
+			log.Info(fmt.Sprintf("Deleting file %s completely", key))
+			for _, table := range []string{"file_fields", "file_hashes", "file_owners", "file_shares", "file_types", "file_tags"} {
+				s.txExec(tx, "DELETE FROM "+table+" WHERE file_id = ?", key)
+			}
+			s.txExec(tx, "DELETE FROM tag_index WHERE file_id = ?", key)
+			return s.txExec(tx, "DELETE FROM files WHERE id = ?", key)
+		}
+		return nil
+	})
+	return
+}
+
+func (s *sqlStore) Info(id string) map[string]string {
+	list := s.pairs("SELECT field, value FROM file_fields WHERE file_id = ?", id)
+	row := s.db.QueryRow(s.rebind("SELECT name, date, torrent FROM files WHERE id = ?"), id)
+	var name, date, torrent sql.NullString
+	if row.Scan(&name, &date, &torrent) != nil {
+		return map[string]string{}
+	}
+	list["name"], list["date"] = name.String, date.String
+	if torrent.Valid {
+		list["torrent"] = torrent.String
+	}
+	hashes := s.pairs("SELECT algorithm, value FROM file_hashes WHERE file_id = ?", id)
+	if len(hashes) != 0 {
+		list["md5"], list["sha256"] = hashes["md5"], hashes["sha256"]
+	}
+	list["id"] = id
+	return list
+}
+
+func (s *sqlStore) NameByHash(hash string) string {
+	name, _ := s.value("SELECT name FROM files WHERE id = ?", hash)
+	return name
+}
+
+func (s *sqlStore) Hash(key string) (md5, sha256 string) {
+	hashes := s.pairs("SELECT algorithm, value FROM file_hashes WHERE file_id = ?", key)
+	return hashes["md5"], hashes["sha256"]
+}
+
+func (s *sqlStore) FileField(hash, field string) []string {
+	list := []string{}
+	switch field {
+	case "owner":
+		list = append(list, s.column("SELECT owner FROM file_owners WHERE file_id = ?", hash)...)
+	case "scope":
+		if scope, _ := s.value("SELECT scope FROM files WHERE id = ?", hash); scope == "public" {
+			list = append(list, string(publicScope))
+		} else if scope == "private" {
+			list = append(list, string(privateScope))
+		}
+		list = append(list, s.column("SELECT name FROM file_shares WHERE file_id = ?", hash)...)
+	case "type":
+		list = append(list, s.column("SELECT DISTINCT repo FROM file_types WHERE file_id = ?", hash)...)
+	case "hash":
+		list = append(list, s.column("SELECT algorithm FROM file_hashes WHERE file_id = ?", hash)...)
+	case "tags":
+		list = append(list, s.column("SELECT tag FROM file_tags WHERE file_id = ?", hash)...)
+	case "name", "date":
+		if v, ok := s.value("SELECT "+field+" FROM files WHERE id = ?", hash); ok {
+			list = append(list, v)
+		}
+	default:
+		if v, ok := s.value("SELECT value FROM file_fields WHERE file_id = ? AND field = ?", hash, field); ok {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+func (s *sqlStore) FileSignatures(hash string) map[string]string {
+	return s.pairs("SELECT owner, signature FROM file_owners WHERE file_id = ? AND signature <> 'w'", hash)
+}
+
+func (s *sqlStore) CheckRepo(owner string, repo []string, hash string) (val int) {
+	if len(repo) == 0 {
+		repo = []string{"apt", "template", "raw"}
+	}
+	if len(owner) > 0 && !s.CheckShare(hash, owner) {
+		return 0
+	}
+	repos := s.column("SELECT DISTINCT repo FROM file_types WHERE file_id = ?", hash)
+	for _, r := range repo {
+		for _, v := range repos {
+			if r == v {
+				val++
+			}
+		}
+	}
+	return
+}
+
+func (s *sqlStore) CheckRepoOfHash(hash string) string {
+	repos := s.column("SELECT DISTINCT repo FROM file_types WHERE file_id = ? ORDER BY repo", hash)
+	if len(repos) == 0 {
+		return ""
+	}
+	return repos[len(repos)-1]
+}
+
+func (s *sqlStore) CountMd5(hash string) int {
+	n, _ := s.value("SELECT COUNT(*) FROM file_hashes WHERE algorithm = 'md5' AND value = ?", hash)
+	count, _ := strconv.Atoi(n)
+	return count
+}
+
+func (s *sqlStore) SearchName(query string) []string {
+	return s.column("SELECT id FROM files WHERE LOWER(name) LIKE ? ORDER BY LOWER(name), date", "%"+strings.ToLower(query)+"%")
+}
+
+func (s *sqlStore) LastHash(name, t string) string {
+	for _, id := range s.column(`SELECT id FROM files WHERE LOWER(name) = ?
+		AND id NOT IN (SELECT file_id FROM file_fields WHERE field = 'trashed') ORDER BY date DESC`, strings.ToLower(name)) {
+		if s.CheckRepo("", []string{t}, id) > 0 {
+			return id
+		}
+	}
+	return ""
+}
+
+func (s *sqlStore) RepoFiles(repo string) []string {
+	return s.column(`SELECT DISTINCT file_id FROM file_types WHERE repo = ?
+		AND file_id NOT IN (SELECT file_id FROM file_fields WHERE field = 'trashed') ORDER BY file_id`, repo)
+}
+
+func (s *sqlStore) OwnerFiles(repo, owner string) []string {
+	return s.column(`SELECT file_id FROM file_types WHERE repo = ? AND owner = ?
+		AND file_id NOT IN (SELECT file_id FROM file_fields WHERE field = 'trashed') ORDER BY file_id`, repo, owner)
+}
+
+func (s *sqlStore) VersionFiles(repo, name, version string) []string {
+	return s.column(`SELECT DISTINCT t.file_id FROM file_types t JOIN files f ON f.id = t.file_id
+		LEFT JOIN file_fields v ON v.file_id = t.file_id AND v.field = 'version'
+		WHERE t.repo = ? AND LOWER(f.name) = ? AND COALESCE(v.value, '') = ?
+		AND t.file_id NOT IN (SELECT file_id FROM file_fields WHERE field = 'trashed') ORDER BY t.file_id`, repo, strings.ToLower(name), version)
+}
+
+func (s *sqlStore) TrashFile(id, user string) error {
+	return s.tx(func(tx *sql.Tx) error {
+		var n int
+		if tx.QueryRow(s.rebind("SELECT COUNT(*) FROM files WHERE id = ?"), id).Scan(&n); n == 0 {
+			return fmt.Errorf("File not found")
+		}
+		if err := s.upsert(tx, "file_fields", []string{"file_id", "field"}, id, "trashed", now()); err != nil {
+			return err
+		}
+		return s.upsert(tx, "file_fields", []string{"file_id", "field"}, id, "trashed-by", user)
+	})
+}
+
+func (s *sqlStore) RestoreFile(id string) error {
+	if _, ok := s.value("SELECT value FROM file_fields WHERE file_id = ? AND field = 'trashed'", id); !ok {
+		return fmt.Errorf("File not found in trash")
+	}
+	return s.exec("DELETE FROM file_fields WHERE file_id = ? AND field IN ('trashed', 'trashed-by')", id)
+}
+
+func (s *sqlStore) TrashedFiles() map[string]time.Time {
+	list := make(map[string]time.Time)
+	for id, trashed := range s.pairs("SELECT file_id, value FROM file_fields WHERE field = 'trashed'") {
+		date := time.Time{}
+		date.UnmarshalText([]byte(trashed))
+		list[id] = date
+	}
+	return list
+}
+
+// Reindex does nothing, SQL store keeps its indexes itself
+func (s *sqlStore) Reindex() error { return nil }
+
+func (s *sqlStore) SaveTorrent(hash, torrent []byte) {
+	s.exec("UPDATE files SET torrent = ? WHERE id = ?", string(torrent), string(hash))
+}
+
+func (s *sqlStore) Torrent(hash []byte) []byte {
+	if torrent, ok := s.value("SELECT torrent FROM files WHERE id = ? AND torrent IS NOT NULL", string(hash)); ok {
+		return []byte(torrent)
+	}
+	return nil
+}
+
+func (s *sqlStore) CheckShare(hash, user string) bool {
+	scope, ok := s.value("SELECT scope FROM files WHERE id = ?", hash)
+	if !ok {
+		return false
+	}
+	if scope == "public" {
+		return true
+	}
+	if _, ok := s.value("SELECT name FROM file_shares WHERE file_id = ? AND name = ?", hash, user); ok {
+		return true
+	}
+	_, ok = s.value("SELECT owner FROM file_owners WHERE file_id = ? AND owner = ?", hash, user)
+	return ok
+}
+
+func (s *sqlStore) IsPublic(hash string) bool {
+	scope, _ := s.value("SELECT scope FROM files WHERE id = ?", hash)
+	return scope == "public"
+}
+
+func (s *sqlStore) AddShare(hash, owner, user string) {
+	s.tx(func(tx *sql.Tx) error {
+		return s.share(tx, hash, user)
+	})
+}
+
+func (s *sqlStore) share(tx *sql.Tx, hash, user string) error {
+	var n int
+	if tx.QueryRow(s.rebind("SELECT COUNT(*) FROM files WHERE id = ?"), hash).Scan(&n); n == 0 {
+		return nil
+	}
+	switch user {
+	case string(publicScope):
+		return s.txExec(tx, "UPDATE files SET scope = 'public' WHERE id = ?", hash)
+	case string(privateScope):
+		return s.txExec(tx, "UPDATE files SET scope = 'private' WHERE id = ?", hash)
+	}
+	if err := s.insert(tx, "file_shares", []string{"file_id", "name"}, hash, user); err != nil {
+		return err
+	}
+	if tx.QueryRow(s.rebind("SELECT COUNT(*) FROM users WHERE name = ?"), user).Scan(&n); n == 0 {
+		return nil
+	}
+	var name string
+	tx.QueryRow(s.rebind("SELECT name FROM files WHERE id = ?"), hash).Scan(&name)
+	return s.insert(tx, "user_files", []string{"name", "file_id"}, user, hash, name)
+}
+
+func (s *sqlStore) RemoveShare(hash, owner, user string) {
+	s.tx(func(tx *sql.Tx) error {
+		return s.unshare(tx, hash, user)
+	})
+}
+
+func (s *sqlStore) unshare(tx *sql.Tx, hash, user string) error {
+	switch user {
+	case string(publicScope):
+		return s.txExec(tx, "UPDATE files SET scope = '' WHERE id = ? AND scope = 'public'", hash)
+	case string(privateScope):
+		return s.txExec(tx, "UPDATE files SET scope = '' WHERE id = ? AND scope = 'private'", hash)
+	}
+	if err := s.txExec(tx, "DELETE FROM file_shares WHERE file_id = ? AND name = ?", hash, user); err != nil {
+		return err
+	}
+	return s.txExec(tx, "DELETE FROM user_files WHERE name = ? AND file_id = ?", user, hash)
+}
+
+func (s *sqlStore) GetFileScope(hash, owner string) []string {
+	return append([]string{}, s.column("SELECT name FROM file_shares WHERE file_id = ?", hash)...)
+}
+
+// addTag appends file to the list of files with tag in repo, order of files is kept by sequence number.
+// Insert is retried with the next number if another process has taken the same one concurrently.
+func (s *sqlStore) addTag(tx *sql.Tx, repo, tag, id string) error {
+	for i := 0; i < 10; i++ {
+		ok, err := s.affected(tx, `INSERT INTO tag_index SELECT ?, ?, ?, COALESCE(MAX(seq), 0) + 1 FROM tag_index
+			WHERE repo = ? AND tag = ? ON CONFLICT (repo, tag, seq) DO NOTHING`, repo, tag, id, repo, tag)
+		if ok || err != nil {
+			return err
+		}
+	}
+	return fmt.Errorf("Adding %s to tag %s: too many concurrent updates", id, tag)
+}
+
+func (s *sqlStore) AddTag(tags []string, id, repo string) error {
+	return s.tx(func(tx *sql.Tx) error {
+		for _, tag := range tags {
+			if err := s.addTag(tx, repo, tag, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *sqlStore) RemoveTags(key, list string) error {
+	return s.tx(func(tx *sql.Tx) error {
+		for _, v := range strings.Split(list, ",") {
+			tag := strings.ToLower(strings.TrimSpace(v))
+			if err := s.txExec(tx, "DELETE FROM file_tags WHERE file_id = ? AND tag = ?", key, tag); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *sqlStore) Tag(query string) ([]string, error) {
+	list := s.column("SELECT file_id FROM file_tags WHERE tag = ? ORDER BY file_id", strings.ToLower(query))
+	if len(list) == 0 {
+		return list, fmt.Errorf("Tag not found")
+	}
+	return list, nil
+}
+
+func (s *sqlStore) SearchByOneTag(tag, repo string) []string {
+	return s.column("SELECT file_id FROM tag_index WHERE repo = ? AND tag = ? ORDER BY seq", repo, tag)
+}
+
+func (s *sqlStore) Users() []string {
+	return s.column("SELECT name FROM users ORDER BY name")
+}
+
+func (s *sqlStore) UserFiles(user string) []string {
+	return s.column("SELECT file_id FROM user_files WHERE name = ? ORDER BY file_id", user)
+}
+
+func (s *sqlStore) RegisterUser(name, key []byte) error {
+	user := strings.ToLower(string(name))
+	return s.tx(func(tx *sql.Tx) error {
+		revoked, err := s.txColumn(tx, "SELECT key FROM user_keys WHERE name = ? AND revoked IS NOT NULL", user)
+		if err != nil {
+			return err
+		}
+		for _, k := range revoked {
+			if fingerprint(k) == fingerprint(string(key)) {
+				log.Warn("Refusing to register revoked key for user " + user)
+				return fmt.Errorf("Key has been revoked")
+			}
+		}
+		if err := s.insert(tx, "users", []string{"name"}, user, string(key), nil, nil); err != nil {
+			return err
+		}
+		if err := s.txExec(tx, "UPDATE users SET key = ? WHERE name = ?", string(key), user); err != nil {
+			return err
+		}
+		return s.insert(tx, "user_keys", []string{"name", "key_hash"}, user, keyHash(string(key)), string(key), nil)
+	})
+}
+
+func (s *sqlStore) RevokeUserKey(name, key string) error {
+	user := strings.ToLower(name)
+	return s.tx(func(tx *sql.Tx) error {
+		var legacy sql.NullString
+		if err := tx.QueryRow(s.rebind("SELECT key FROM users WHERE name = ?"), user).Scan(&legacy); err != nil {
+			return fmt.Errorf("User not found")
+		}
+		var n int
+		tx.QueryRow(s.rebind("SELECT COUNT(*) FROM user_keys WHERE name = ? AND key_hash = ? AND revoked IS NULL"), user, keyHash(key)).Scan(&n)
+		if n == 0 {
+			return fmt.Errorf("Key not found")
+		}
+		active, err := s.txColumn(tx, "SELECT key FROM user_keys WHERE name = ? AND revoked IS NULL", user)
+		if err != nil {
+			return err
+		}
+		// Copies of the same key armored differently are revoked together
+		for _, k := range active {
+			if fingerprint(k) != fingerprint(key) {
+				continue
+			}
+			if err := s.txExec(tx, "UPDATE user_keys SET revoked = ? WHERE name = ? AND key_hash = ?", now(), user, keyHash(k)); err != nil {
+				return err
+			}
+		}
+		if legacy.Valid && fingerprint(legacy.String) == fingerprint(key) {
+			var active sql.NullString
+			tx.QueryRow(s.rebind("SELECT key FROM user_keys WHERE name = ? AND revoked IS NULL ORDER BY key"), user).Scan(&active)
+			if err := s.txExec(tx, "UPDATE users SET key = ? WHERE name = ?", active, user); err != nil {
+				return err
+			}
+		}
+		log.Info("Key of user " + user + " has been revoked")
+		return nil
+	})
+}
+
+func (s *sqlStore) RevokedKeys(name string) map[string]time.Time {
+	keys := make(map[string]time.Time)
+	for key, revoked := range s.pairs("SELECT key, revoked FROM user_keys WHERE name = ? AND revoked IS NOT NULL", strings.ToLower(name)) {
+		date := time.Time{}
+		date.UnmarshalText([]byte(revoked))
+		keys[key] = date
+	}
+	return keys
+}
+
+func (s *sqlStore) UserKey(name string) string {
+	key, _ := s.value("SELECT key FROM users WHERE name = ?", strings.ToLower(name))
+	return key
+}
+
+func (s *sqlStore) UserKeys(name string) []string {
+	return s.column("SELECT key FROM user_keys WHERE name = ? AND revoked IS NULL ORDER BY key", strings.ToLower(name))
+}
+
+func (s *sqlStore) UserSSHKeys(name string) []string {
+	return s.column("SELECT key FROM user_sshkeys WHERE name = ? ORDER BY key", strings.ToLower(name))
+}
+
+func (s *sqlStore) AddUserSSHKey(name, key string) error {
+	user, key := strings.ToLower(name), strings.TrimSpace(key)
+	return s.tx(func(tx *sql.Tx) error {
+		if err := s.insert(tx, "users", []string{"name"}, user, nil, nil, nil); err != nil {
+			return err
+		}
+		return s.insert(tx, "user_sshkeys", []string{"name", "key_hash"}, user, keyHash(key), key)
+	})
+}
+
+func (s *sqlStore) RemoveUserSSHKey(name, key string) error {
+	return s.exec("DELETE FROM user_sshkeys WHERE name = ? AND key_hash = ?", strings.ToLower(name), keyHash(key))
+}
+
+func (s *sqlStore) QuotaGet(user string) int {
+	quota, ok := s.value("SELECT quota FROM users WHERE name = ?", user)
+	if !ok {
+		return 0
+	}
+	if len(quota) == 0 {
+		return config.DefaultQuota()
+	}
+	value, _ := strconv.Atoi(quota)
+	return value
+}
+
+func (s *sqlStore) QuotaSet(user, quota string) {
+	s.exec("UPDATE users SET quota = ? WHERE name = ?", quota, user)
+}
+
+func (s *sqlStore) QuotaUsage(user string) (int, bool) {
+	stored, ok := s.value("SELECT stored FROM users WHERE name = ? AND stored IS NOT NULL", user)
+	value, _ := strconv.Atoi(stored)
+	return value, ok
+}
+
+func (s *sqlStore) QuotaUsageStore(user string, stored int) {
+	s.exec("UPDATE users SET stored = ? WHERE name = ?", strconv.Itoa(stored), user)
+}
+
+func (s *sqlStore) QuotaUsageAdd(user string, value int) {
+	s.tx(func(tx *sql.Tx) error {
+		return s.addUsage(tx, user, value)
+	})
+}
+
+// addUsage changes quota usage of user by value, usage is counted from user's files if it wasn't stored yet.
+// Usage is changed by the database itself, so uploads from several processes don't overwrite each other's changes.
+func (s *sqlStore) addUsage(tx *sql.Tx, user string, value int) error {
+	increment := func() (bool, error) {
+		return s.affected(tx, "UPDATE users SET stored = CAST(CAST(stored AS BIGINT) + ? AS VARCHAR(32)) WHERE name = ? AND stored IS NOT NULL", value, user)
+	}
+	if ok, err := increment(); ok || err != nil {
+		return err
+	}
+	ok, err := s.affected(tx, `UPDATE users SET stored = CAST((SELECT COALESCE(SUM(CAST(f.value AS BIGINT)), 0) FROM user_files u
+		JOIN file_fields f ON f.file_id = u.file_id AND f.field = 'size' WHERE u.name = ?) + ? AS VARCHAR(32))
+		WHERE name = ? AND stored IS NULL`, user, value, user)
+	if !ok && err == nil {
+		// Another process has counted usage meanwhile
+		_, err = increment()
+	}
+	return err
+}
+
+func (s *sqlStore) Register(a Artifact) error {
+	owner, scope, opposite := a.Owner, publicScope, privateScope
+	if len(owner) == 0 {
+		owner = "subutai"
+	}
+	if a.Private {
+		scope, opposite = privateScope, publicScope
+	}
+	err := s.tx(func(tx *sql.Tx) error {
+		if err := s.write(tx, owner, a.ID, a.Name, a.options()); err != nil {
+			return err
+		}
+		for _, tag := range a.Tags {
+			if err := s.addTag(tx, a.Repo, tag, a.ID); err != nil {
+				return err
+			}
+		}
+		if err := s.unshare(tx, a.ID, string(opposite)); err != nil {
+			return err
+		}
+		if err := s.share(tx, a.ID, string(scope)); err != nil {
+			return err
+		}
+		return s.addUsage(tx, owner, a.Size)
+	})
+	log.Check(log.WarnLevel, "Registering "+a.Name+" in db", err)
+	return err
+}
+
+func (s *sqlStore) SaveAuthID(name, token string) {
+	s.exec("INSERT INTO authids VALUES (?, ?, ?)", keyHash(token), name, now())
+}
+
+func (s *sqlStore) CheckAuthID(token string) (name string) {
+	err := s.tx(func(tx *sql.Tx) error {
+		var user, created string
+		if tx.QueryRow(s.rebind("SELECT name, date FROM authids WHERE hash = ?"), keyHash(token)).Scan(&user, &created) != nil {
+			return nil
+		}
+		// Challenge is accepted only by the process whose DELETE removed it, other processes sharing the store
+		// may have read the same row before
+		if ok, err := s.affected(tx, "DELETE FROM authids WHERE hash = ?", keyHash(token)); !ok || err != nil {
+			return err
+		}
+		date := new(time.Time)
+		date.UnmarshalText([]byte(created))
+		if date.Add(authIDTTL).After(time.Now()) {
+			name = user
+		}
+		return nil
+	})
+	if log.Check(log.WarnLevel, "Checking auth ID", err) {
+		return ""
+	}
+	return
+}
+
+func (s *sqlStore) CleanAuthID() {
+	for hash, created := range s.pairs("SELECT hash, date FROM authids") {
+		date := new(time.Time)
+		date.UnmarshalText([]byte(created))
+		if date.Add(authIDTTL).Before(time.Now()) {
+			s.exec("DELETE FROM authids WHERE hash = ?", hash)
+		}
+	}
+}
+
+func (s *sqlStore) SaveToken(name, token string) {
+	s.exec("INSERT INTO tokens VALUES (?, ?, ?)", token, name, now())
+}
+
+func (s *sqlStore) TokenOwner(token string) string {
+	var name, created string
+	if s.db.QueryRow(s.rebind("SELECT name, date FROM tokens WHERE hash = ?"), keyHash(token)).Scan(&name, &created) != nil {
+		return ""
+	}
+	date := new(time.Time)
+	date.UnmarshalText([]byte(created))
+	if date.Add(tokenTTL).Before(time.Now()) {
+		return ""
+	}
+	return name
+}
+
+func (s *sqlStore) GetUserToken(user string) string {
+	for hash, created := range s.pairs("SELECT hash, date FROM tokens WHERE name = ?", user) {
+		date := new(time.Time)
+		date.UnmarshalText([]byte(created))
+		if date.Add(tokenTTL).After(time.Now()) {
+			return hash
+		}
+	}
+	return ""
+}
+
+func (s *sqlStore) CleanTokens() {
+	for hash, created := range s.pairs("SELECT hash, date FROM tokens") {
+		date := new(time.Time)
+		date.UnmarshalText([]byte(created))
+		if date.Add(tokenTTL).Before(time.Now()) {
+			s.exec("DELETE FROM tokens WHERE hash = ?", hash)
+		}
+	}
+}
+
+func (s *sqlStore) Files() []string {
+	return s.column("SELECT id FROM files ORDER BY id")
+}
+
+// Check finds users' files and tag entries pointing to missing files, search uses files table directly
+func (s *sqlStore) Check(repair bool) (list []Problem) {
+	for _, row := range []struct {
+		kind, table, user, name string
+	}{
+		{DanglingFile, "user_files", "name", "file_name"},
+		{StaleTag, "file_tags", "''", "tag"},
+		{StaleTag, "tag_index", "''", "tag"},
+	} {
+		first := len(list)
+		rows, err := s.db.Query("SELECT file_id, " + row.user + ", " + row.name + " FROM " + row.table + " WHERE file_id NOT IN (SELECT id FROM files)")
+		if log.Check(log.WarnLevel, "Checking "+row.table, err) {
+			continue
+		}
+		for rows.Next() {
+			var id, user, name sql.NullString
+			if rows.Scan(&id, &user, &name) == nil {
+				list = append(list, Problem{Kind: row.kind, ID: id.String, User: user.String, Name: name.String})
+			}
+		}
+		rows.Close()
+		if repair && s.exec("DELETE FROM "+row.table+" WHERE file_id NOT IN (SELECT id FROM files)") == nil {
+			for i := first; i < len(list); i++ {
+				list[i].Repaired = true
+			}
+		}
+	}
+	return
+}
+
+// CleanSearchIndex does nothing, search in SQL store uses files table directly
+func (s *sqlStore) CleanSearchIndex() {}
+
+func (s *sqlStore) CleanUserFiles() {
+	s.exec("DELETE FROM user_files WHERE file_id NOT IN (SELECT id FROM files)")
+}
+
+func (s *sqlStore) Close() {
+	s.db.Close()
+}
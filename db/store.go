@@ -0,0 +1,510 @@
+package db
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/subutai-io/agent/log"
+	"github.com/subutai-io/cdn/config"
+	"github.com/subutai-io/cdn/utils"
+	"golang.org/x/crypto/openpgp"
+)
+
+// Store keeps metadata of files, users and sessions. Package level functions delegate to the store
+// selected by "driver" option in [db] config section: bolt file is used by default, any database/sql
+// driver may be used to share one store between several gorjun processes.
+type Store interface {
+	Register(a Artifact) error
+	Write(owner, key, value string, options ...map[string]string) error
+	Edit(owner, key, value string, options ...map[string]string)
+	Delete(owner, repo, key string) int
+	Info(id string) map[string]string
+	NameByHash(hash string) string
+	Hash(key string) (md5, sha256 string)
+	FileField(hash, field string) []string
+	FileSignatures(hash string) map[string]string
+	CheckRepo(owner string, repo []string, hash string) int
+	CheckRepoOfHash(hash string) string
+	CountMd5(hash string) int
+	SearchName(query string) []string
+	LastHash(name, t string) string
+	RepoFiles(repo string) []string
+	OwnerFiles(repo, owner string) []string
+	VersionFiles(repo, name, version string) []string
+	Reindex() error
+	Files() []string
+	TrashFile(id, user string) error
+	RestoreFile(id string) error
+	TrashedFiles() map[string]time.Time
+	Check(repair bool) []Problem
+	SaveTorrent(hash, torrent []byte)
+	Torrent(hash []byte) []byte
+
+	CheckShare(hash, user string) bool
+	IsPublic(hash string) bool
+	AddShare(hash, owner, user string)
+	RemoveShare(hash, owner, user string)
+	GetFileScope(hash, owner string) []string
+
+	AddTag(tags []string, id, repo string) error
+	RemoveTags(key, list string) error
+	Tag(query string) ([]string, error)
+	SearchByOneTag(tag, repo string) []string
+
+	Users() []string
+	UserFiles(user string) []string
+	RegisterUser(name, key []byte) error
+	RevokeUserKey(name, key string) error
+	RevokedKeys(name string) map[string]time.Time
+	UserKey(name string) string
+	UserKeys(name string) []string
+	UserSSHKeys(name string) []string
+	AddUserSSHKey(name, key string) error
+	RemoveUserSSHKey(name, key string) error
+
+	QuotaGet(user string) int
+	QuotaSet(user, quota string)
+	QuotaUsage(user string) (int, bool)
+	QuotaUsageStore(user string, stored int)
+	QuotaUsageAdd(user string, value int)
+
+	SaveAuthID(name, token string)
+	CheckAuthID(token string) string
+	CleanAuthID()
+	SaveToken(name, token string)
+	TokenOwner(token string) string
+	GetUserToken(user string) string
+	CleanTokens()
+
+	CleanSearchIndex()
+	CleanUserFiles()
+	Close()
+}
+
+// Artifact describes uploaded file for Register
+type Artifact struct {
+	ID      string
+	Name    string
+	Owner   string
+	Repo    string
+	Info    map[string]string // fields of file record, see Write
+	Tags    []string          // tags added to tag index of repo
+	Private bool
+	Size    int // size added to owner's quota usage
+}
+
+// options returns fields of file record including its repo
+func (a Artifact) options() map[string]string {
+	options := map[string]string{"type": a.Repo}
+	for k, v := range a.Info {
+		options[k] = v
+	}
+	return options
+}
+
+var (
+	store Store
+	once  sync.Once
+)
+
+// opened returns the store, which is opened on first use, so subcommands not touching the database
+// don't wait for the lock held by running server
+func opened() Store {
+	once.Do(func() {
+		store = initStore()
+	})
+	return store
+}
+
+func initStore() Store {
+	if len(config.DB.Driver) == 0 || config.DB.Driver == "bolt" {
+		return newBoltStore()
+	}
+	s, err := newSQLStore(config.DB.Driver, config.DB.Dsn)
+	log.Check(log.FatalLevel, "Opening "+config.DB.Driver+" store", err)
+	return s
+}
+
+// errBoltOnly is returned by maintenance functions working with bolt file directly
+var errBoltOnly = fmt.Errorf("Operation is supported only by bolt store, use tools of %s database instead", config.DB.Driver)
+
+// Register writes record about uploaded file, its tags, visibility and owner's quota usage atomically,
+// so crash during upload doesn't leave file without scope or with wrong quota usage
+func Register(a Artifact) error { return opened().Register(a) }
+
+// AddShare adds user to share scope of file if the file wasn't shared with him yet
+func AddShare(hash, owner, user string) { opened().AddShare(hash, owner, user) }
+
+// CheckAuthID returns the name of user who requested auth challenge. Every challenge can be used only once.
+func CheckAuthID(token string) string { return opened().CheckAuthID(token) }
+
+// CheckRepo returns number of repos from the list which contain the file available to owner
+func CheckRepo(owner string, repo []string, hash string) int {
+	return opened().CheckRepo(owner, repo, hash)
+}
+
+// CheckShare returns true if user has access to file, otherwise - false
+func CheckShare(hash, user string) bool { return opened().CheckShare(hash, user) }
+
+// CleanAuthID removes expired auth challenges
+func CleanAuthID() { opened().CleanAuthID() }
+
+// CleanSearchIndex removes search index entries of deleted files
+func CleanSearchIndex() { opened().CleanSearchIndex() }
+
+// CleanTokens removes expired tokens
+func CleanTokens() { opened().CleanTokens() }
+
+// CleanUserFiles removes deleted files from users' file lists
+func CleanUserFiles() { opened().CleanUserFiles() }
+
+// Close closes the store
+func Close() {
+	if store != nil {
+		store.Close()
+	}
+}
+
+// CountMd5 counts all artifacts that have MD5 equal to hash
+func CountMd5(hash string) int { return opened().CountMd5(hash) }
+
+// Delete removes record about file from DB
+func Delete(owner, repo, key string) int { return opened().Delete(owner, repo, key) }
+
+// Edit record about file in DB
+func Edit(owner, key, value string, options ...map[string]string) {
+	opened().Edit(owner, key, value, options...)
+}
+
+// FileField provides list of file's field properties
+func FileField(hash, field string) []string { return opened().FileField(hash, field) }
+
+// FileSignatures returns map with file's owners and their signatures
+func FileSignatures(hash string) map[string]string { return opened().FileSignatures(hash) }
+
+// GetFileScope shows users with whom owner shared a file with particular hash
+func GetFileScope(hash, owner string) []string { return opened().GetFileScope(hash, owner) }
+
+// GetUserToken returns valid token of user
+func GetUserToken(user string) string { return opened().GetUserToken(user) }
+
+// Hash returns MD5 and SHA256 hashes by ID
+func Hash(key string) (md5, sha256 string) { return opened().Hash(key) }
+
+// Info returns all fields of file record
+func Info(id string) map[string]string { return opened().Info(id) }
+
+// IsPublic returns true if file is publicly accessible
+func IsPublic(hash string) bool { return opened().IsPublic(hash) }
+
+// LastHash returns hash of the last uploaded file
+func LastHash(name, t string) string { return opened().LastHash(name, t) }
+
+// NameByHash returns file's name by its ID
+func NameByHash(hash string) string { return opened().NameByHash(hash) }
+
+// QuotaGet returns value of user's disk quota
+func QuotaGet(user string) int { return opened().QuotaGet(user) }
+
+// QuotaSet sets changes default storage quota for user
+func QuotaSet(user, quota string) { opened().QuotaSet(user, quota) }
+
+// RegisterUser creates user if needed and adds key to the list of user's keys.
+// Keys that were revoked earlier are refused, keys are compared by fingerprint, so armoring doesn't matter.
+func RegisterUser(name, key []byte) error { return opened().RegisterUser(name, key) }
+
+// RevokeUserKey removes key and its other copies with the same fingerprint from the list of user's active keys
+// and remembers the moment of revocation
+func RevokeUserKey(name, key string) error { return opened().RevokeUserKey(name, key) }
+
+// RevokedKeys returns user's revoked keys with the date of revocation
+func RevokedKeys(name string) map[string]time.Time { return opened().RevokedKeys(name) }
+
+// RemoveShare removes user from share scope of file if the file was shared with him
+func RemoveShare(hash, owner, user string) { opened().RemoveShare(hash, owner, user) }
+
+// RemoveTags deletes tag from index and file information
+func RemoveTags(key, list string) error { return opened().RemoveTags(key, list) }
+
+// SaveAuthID stores hash of auth challenge together with user name and creation date
+func SaveAuthID(name, token string) { opened().SaveAuthID(name, token) }
+
+// SaveToken stores hash of session token together with user name and creation date
+func SaveToken(name, token string) { opened().SaveToken(name, token) }
+
+// SaveTorrent saves torrent file for particular template
+func SaveTorrent(hash, torrent []byte) { opened().SaveTorrent(hash, torrent) }
+
+// SearchName searches for all (public/private) files of all users that have "query" substring in their names
+func SearchName(query string) []string { return opened().SearchName(query) }
+
+// RepoFiles returns IDs of all files in repo
+func RepoFiles(repo string) []string { return opened().RepoFiles(repo) }
+
+// OwnerFiles returns IDs of files uploaded to repo by owner
+func OwnerFiles(repo, owner string) []string { return opened().OwnerFiles(repo, owner) }
+
+// VersionFiles returns IDs of files in repo with name and version
+func VersionFiles(repo, name, version string) []string {
+	return opened().VersionFiles(repo, name, version)
+}
+
+// Reindex rebuilds secondary indexes of files
+func Reindex() error { return opened().Reindex() }
+
+// TrashFile moves file to trash, it disappears from listings and downloads until it is restored or purged
+func TrashFile(id, user string) error { return opened().TrashFile(id, user) }
+
+// RestoreFile returns file from trash
+func RestoreFile(id string) error { return opened().RestoreFile(id) }
+
+// TrashedFiles returns IDs of files in trash with the date of deletion
+func TrashedFiles() map[string]time.Time { return opened().TrashedFiles() }
+
+// Trashed returns true if file is in trash
+func Trashed(id string) bool { return len(FileField(id, "trashed")) != 0 }
+
+// Tag returns a list of artifacts that contains requested tags
+func Tag(query string) ([]string, error) { return opened().Tag(query) }
+
+// TokenOwner returns the owner of the given token
+func TokenOwner(token string) string { return opened().TokenOwner(token) }
+
+// Torrent retrieves torrent file for template. If no torrent file found it returns nil.
+func Torrent(hash []byte) []byte { return opened().Torrent(hash) }
+
+// UserKey is replaced by UserKeys and left for compatibility. This function should be removed later.
+func UserKey(name string) string { return opened().UserKey(name) }
+
+// UserKeys returns list of users' GPG keys
+func UserKeys(name string) []string { return opened().UserKeys(name) }
+
+// UserSSHKeys returns list of user's SSH public keys in authorized_keys format
+func UserSSHKeys(name string) []string { return opened().UserSSHKeys(name) }
+
+// AddUserSSHKey creates user if needed and adds SSH public key to the list of user's SSH keys
+func AddUserSSHKey(name, key string) error { return opened().AddUserSSHKey(name, key) }
+
+// RemoveUserSSHKey removes SSH public key from the list of user's SSH keys
+func RemoveUserSSHKey(name, key string) error { return opened().RemoveUserSSHKey(name, key) }
+
+// Write create record about file in DB
+func Write(owner, key, value string, options ...map[string]string) error {
+	return opened().Write(owner, key, value, options...)
+}
+
+// CheckRepoOfHash return the type of file by its hash
+func CheckRepoOfHash(hash string) string { return opened().CheckRepoOfHash(hash) }
+
+// AddTag add new key to tags index
+func AddTag(tags []string, id string, repo string) error { return opened().AddTag(tags, id, repo) }
+
+// SearchByOneTag is performs search in tags index by tag
+func SearchByOneTag(tag string, repo string) []string { return opened().SearchByOneTag(tag, repo) }
+
+// CountTotal counts user's total quota usage
+func CountTotal(user string) (total int) {
+	for _, id := range opened().UserFiles(user) {
+		size, _ := strconv.Atoi(Info(id)["size"])
+		total += size
+	}
+	return
+}
+
+func MakePublic(hash, owner string) {
+	log.Debug(fmt.Sprintf("MakePublic(%+v, %+v) started", hash, owner))
+	RemoveShare(hash, owner, string(privateScope))
+	AddShare(hash, owner, string(publicScope))
+	log.Debug(fmt.Sprintf("MakePublic(%+v, %+v) ended", hash, owner))
+}
+
+func MakePrivate(hash, owner string) {
+	log.Debug(fmt.Sprintf("MakePrivate(%+v, %+v) started", hash, owner))
+	RemoveShare(hash, owner, string(publicScope))
+	AddShare(hash, owner, string(privateScope))
+	log.Debug(fmt.Sprintf("MakePrivate(%+v, %+v) ended", hash, owner))
+}
+
+func OwnerHadThisFile(owner, md5 string) (has bool) {
+	for _, id := range opened().UserFiles(owner) {
+		m, _ := Hash(id)
+		log.Info(fmt.Sprintf("OwnerHadThisFile: checking file %s - md5 == %s against (owner: %s, md5: %s)", id, m, owner, md5))
+		if md5 == m {
+			has = true
+		}
+	}
+	log.Info(fmt.Sprintf("OwnerHadThisFile: %v", has))
+	return
+}
+
+// OwnerFilesByRepo returns all public files of owner from specified repo
+func OwnerFilesByRepo(owner string, repo string) (list []string) {
+	log.Debug(fmt.Sprintf("(OwnerFilesByRepo): Gathering all %+v's files from repo %+v...", owner, repo))
+	for _, id := range opened().OwnerFiles(repo, owner) {
+		if IsPublic(id) {
+			list = append(list, id)
+		}
+	}
+	log.Debug(fmt.Sprintf("(OwnerFilesByRepo): list of all %+v's files from repo %+v: %+v", owner, repo, list))
+	return
+}
+
+func IsFileExists(filename string) bool {
+	files, _ := ioutil.ReadDir(config.Storage.Path)
+	for _, file := range files {
+		if file.Name() == filename {
+			return true
+		}
+	}
+	return false
+}
+
+// QuotaLeft returns user's quota left space
+func QuotaLeft(user string) int {
+	quota, stored := QuotaGet(user), QuotaUsageGet(user)
+	if quota == -1 {
+		return -1
+	} else if quota <= stored {
+		return 0
+	}
+	return quota - stored
+}
+
+// QuotaUsageCorrect updates saved values of quota usage according to file index table
+func QuotaUsageCorrect() {
+	for _, user := range opened().Users() {
+		rVal := CountTotal(user)
+		if sVal, ok := opened().QuotaUsage(user); !ok && rVal != 0 || ok && sVal != rVal {
+			log.Info("Correcting quota usage for user " + user)
+			log.Info("Stored value: " + strconv.Itoa(sVal) + ", real value: " + strconv.Itoa(rVal))
+			opened().QuotaUsageStore(user, rVal)
+		}
+	}
+}
+
+// QuotaUsageGet returns value of used disk quota
+func QuotaUsageGet(user string) int {
+	if stored, ok := opened().QuotaUsage(user); ok {
+		return stored
+	}
+	stored := CountTotal(user)
+	opened().QuotaUsageStore(user, stored)
+	return stored
+}
+
+// QuotaUsageSet accepts size of added/removed file and updates quota usage for user
+func QuotaUsageSet(user string, value int) {
+	if _, ok := opened().QuotaUsage(user); !ok {
+		opened().QuotaUsageStore(user, CountTotal(user))
+	}
+	opened().QuotaUsageAdd(user, value)
+}
+
+// TokenFilesByRepo returns all public/private/shared files of token owner from specified repo
+func TokenFilesByRepo(token string, repo string) (list []string) {
+	owner := TokenOwner(token)
+	if owner == "" {
+		log.Debug("(TokenFilesByRepo): Couldn't find owner of token")
+		return
+	}
+	return UserFilesByRepo(owner, repo)
+}
+
+// UserFilesByRepo returns all public/private/shared files available to user from specified repo
+func UserFilesByRepo(owner string, repo string) (list []string) {
+	if owner == "" {
+		return
+	}
+	log.Debug(fmt.Sprintf("(UserFilesByRepo): Gathering all %+v's files from repo %+v...", owner, repo))
+	list = utils.Intersect(opened().UserFiles(owner), opened().RepoFiles(repo))
+	log.Debug(fmt.Sprintf("(UserFilesByRepo): list of all %+v's files from repo %+v: %+v", owner, repo, list))
+	return
+}
+
+// UserFile searches a file among particular user's files. It returns list of hashes of files with required name,
+// files in trash are skipped.
+func UserFile(owner, file string) (list []string) {
+	if len(owner) == 0 {
+		owner = "subutai"
+	}
+	for _, id := range opened().UserFiles(owner) {
+		if NameByHash(id) == file && !Trashed(id) && utils.In([]string{owner}, FileField(id, "owner")) {
+			list = append(list, id)
+		}
+	}
+	return
+}
+
+func Exists(str string, list []string) bool {
+	for _, l := range list {
+		if str == l {
+			return true
+		}
+	}
+	return false
+}
+
+// UnionByTags return list of the values by one of respective tags
+func UnionByTags(tags []string, repo string) (list []string) {
+	for _, tag := range tags {
+		for _, id := range SearchByOneTag(tag, repo) {
+			if !Exists(id, list) {
+				list = append(list, id)
+			}
+		}
+	}
+	return list
+}
+
+// IntersectOfTags return IDs of files by all respective tags
+func IntersectOfTags(tags []string, repo string) (list []string) {
+	var list1, list2 []string
+	for _, vvv := range SearchByOneTag(tags[0], repo) {
+		list1 = append(list, vvv)
+	}
+	for _, vvv := range SearchByOneTag(tags[1], repo) {
+		list2 = append(list, vvv)
+	}
+
+	//intersection
+	low, high := list1, list2
+	if len(list1) > len(list2) {
+		low = list2
+		high = list1
+	}
+	done := false
+	for i, l := range low {
+		for j, h := range high {
+			f1 := i + 1
+			f2 := j + 1
+			if l == h {
+				list = append(list, h)
+				if f1 < len(low) && f2 < len(high) {
+					if low[f1] != high[f2] {
+						done = true
+					}
+				}
+				high = high[:j+copy(high[j:], high[j+1:])]
+				break
+			}
+		}
+		if done {
+			break
+		}
+	}
+	return list
+}
+
+// fingerprint returns hex encoded fingerprint of armored PGP key, so the same key armored differently
+// is recognized. Text of the key is returned if it can't be read.
+func fingerprint(key string) string {
+	entity, err := openpgp.ReadArmoredKeyRing(strings.NewReader(key))
+	if err != nil || len(entity) == 0 {
+		return key
+	}
+	return fmt.Sprintf("%x", entity[0].PrimaryKey.Fingerprint)
+}
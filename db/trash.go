@@ -0,0 +1,58 @@
+package db
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Deleted files are moved to trash first: record of file gets "trashed" date and "trashed-by" user fields
+// and is dropped from indexes, so it disappears from listings and downloads. The file can be restored
+// until it is purged after retention period configured in [storage] section.
+
+// TrashFile marks file as deleted by user
+func (s *boltStore) TrashFile(id, user string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(MyBucket).Bucket([]byte(id))
+		if b == nil {
+			return fmt.Errorf("File not found")
+		}
+		unindexFile(tx, id)
+		now, _ := time.Now().MarshalText()
+		if err := b.Put([]byte("trashed"), now); err != nil {
+			return err
+		}
+		return b.Put([]byte("trashed-by"), []byte(user))
+	})
+}
+
+// RestoreFile returns file from trash
+func (s *boltStore) RestoreFile(id string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(MyBucket).Bucket([]byte(id))
+		if b == nil || b.Get([]byte("trashed")) == nil {
+			return fmt.Errorf("File not found in trash")
+		}
+		b.Delete([]byte("trashed"))
+		b.Delete([]byte("trashed-by"))
+		return indexFile(tx, id)
+	})
+}
+
+// TrashedFiles returns IDs of files in trash with the date of deletion
+func (s *boltStore) TrashedFiles() map[string]time.Time {
+	list := make(map[string]time.Time)
+	db.View(func(tx *bolt.Tx) error {
+		files := tx.Bucket(MyBucket)
+		return files.ForEach(func(id, v []byte) error {
+			if b := files.Bucket(id); b != nil && b.Get([]byte("trashed")) != nil {
+				date := time.Time{}
+				date.UnmarshalText(b.Get([]byte("trashed")))
+				list[string(id)] = date
+			}
+			return nil
+		})
+	})
+	return list
+}
@@ -0,0 +1,124 @@
+// Package deb822 parses and formats control data of Debian packages in RFC 822 like format described in deb822(5)
+// and compares versions of packages.
+package deb822
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// OrderField is the record field keeping order of control fields stored by Record
+const OrderField = "control-fields"
+
+// Field is a control field. Value of multi-line field keeps continuation lines with their leading whitespace.
+type Field struct {
+	Name  string
+	Value string
+}
+
+// Paragraph is a list of control fields in their original order
+type Paragraph []Field
+
+// Parse reads the first paragraph of control data. Comment lines are skipped, parsing stops at the first
+// blank line after any field.
+func Parse(data []byte) (Paragraph, error) {
+	var p Paragraph
+	seen := map[string]bool{}
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(line, " \t\r")
+		switch {
+		case strings.HasPrefix(line, "#"):
+			continue
+		case len(line) == 0:
+			if len(p) != 0 {
+				return p, nil
+			}
+			continue
+		case line[0] == ' ' || line[0] == '\t':
+			if len(p) == 0 {
+				return nil, fmt.Errorf("Line %d: continuation line without field", n+1)
+			}
+			p[len(p)-1].Value += "\n" + line
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("Line %d: field name is not followed by colon", n+1)
+		}
+		name := line[:i]
+		if seen[strings.ToLower(name)] {
+			return nil, fmt.Errorf("Line %d: duplicate field %s", n+1, name)
+		}
+		seen[strings.ToLower(name)] = true
+		p = append(p, Field{Name: name, Value: strings.TrimSpace(line[i+1:])})
+	}
+	if len(p) == 0 {
+		return nil, fmt.Errorf("Control data is empty")
+	}
+	return p, nil
+}
+
+// Get returns value of field, names are compared case-insensitively
+func (p Paragraph) Get(name string) string {
+	for _, f := range p {
+		if strings.EqualFold(f.Name, name) {
+			return f.Value
+		}
+	}
+	return ""
+}
+
+// Names returns names of fields in their order
+func (p Paragraph) Names() []string {
+	names := make([]string, len(p))
+	for i, f := range p {
+		names[i] = f.Name
+	}
+	return names
+}
+
+// String formats paragraph as control data ending with newline
+func (p Paragraph) String() string {
+	var out strings.Builder
+	for _, f := range p {
+		out.WriteString(f.Name + ":")
+		if len(f.Value) != 0 && !strings.HasPrefix(f.Value, "\n") {
+			out.WriteString(" ")
+		}
+		out.WriteString(f.Value + "\n")
+	}
+	return out.String()
+}
+
+// Record stores fields in file record under their names and their order under OrderField
+func (p Paragraph) Record(info map[string]string) {
+	for _, f := range p {
+		info[f.Name] = f.Value
+	}
+	info[OrderField] = strings.Join(p.Names(), ",")
+}
+
+// FromRecord restores paragraph stored by Record. Records stored before the order was kept give
+// fields with capitalized names in alphabetical order.
+func FromRecord(info map[string]string) Paragraph {
+	var names []string
+	if order := info[OrderField]; len(order) != 0 {
+		names = strings.Split(order, ",")
+	} else {
+		for k := range info {
+			if len(k) != 0 && unicode.IsUpper(rune(k[0])) {
+				names = append(names, k)
+			}
+		}
+		sort.Strings(names)
+	}
+	var p Paragraph
+	for _, name := range names {
+		if v, ok := info[name]; ok {
+			p = append(p, Field{Name: name, Value: v})
+		}
+	}
+	return p
+}
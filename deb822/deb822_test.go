@@ -0,0 +1,72 @@
+package deb822
+
+import (
+	"reflect"
+	"testing"
+)
+
+const control = `Package: hello
+Version: 2.10-2
+Architecture: amd64
+Depends: libc6:amd64 (>= 2.14)
+Homepage: https://www.gnu.org/software/hello/
+Description: example package based on GNU hello
+ The GNU hello program produces a familiar, friendly greeting.
+ .
+ Seriously, though: this is an example.
+
+Package: ignored
+`
+
+func TestParse(t *testing.T) {
+	p, err := Parse([]byte(control))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Paragraph{
+		{"Package", "hello"},
+		{"Version", "2.10-2"},
+		{"Architecture", "amd64"},
+		{"Depends", "libc6:amd64 (>= 2.14)"},
+		{"Homepage", "https://www.gnu.org/software/hello/"},
+		{"Description", "example package based on GNU hello\n The GNU hello program produces a familiar, friendly greeting.\n .\n Seriously, though: this is an example."},
+	}
+	if !reflect.DeepEqual(p, want) {
+		t.Errorf("Parse() = %q, want %q", p, want)
+	}
+	if got := p.String(); got+"\nPackage: ignored\n" != control {
+		t.Errorf("String() = %q", got)
+	}
+	if p.Get("depends") != "libc6:amd64 (>= 2.14)" {
+		t.Errorf("Get(depends) = %q", p.Get("depends"))
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, data := range []string{
+		"",
+		" continuation\n",
+		"Package hello\n",
+		"Package: a\npackage: b\n",
+	} {
+		if _, err := Parse([]byte(data)); err == nil {
+			t.Errorf("Parse(%q) accepted malformed control data", data)
+		}
+	}
+}
+
+func TestRecord(t *testing.T) {
+	p, _ := Parse([]byte(control))
+	info := map[string]string{"id": "some-id", "Filename": "hello_2.10-2_amd64.deb"}
+	p.Record(info)
+	if info[OrderField] != "Package,Version,Architecture,Depends,Homepage,Description" {
+		t.Errorf("Record() order = %q", info[OrderField])
+	}
+	if got := FromRecord(info); !reflect.DeepEqual(got, p) {
+		t.Errorf("FromRecord() = %q, want %q", got, p)
+	}
+	legacy := map[string]string{"id": "some-id", "Version": "1", "Package": "a"}
+	if got := FromRecord(legacy); !reflect.DeepEqual(got, Paragraph{{"Package", "a"}, {"Version", "1"}}) {
+		t.Errorf("FromRecord() of legacy record = %q", got)
+	}
+}
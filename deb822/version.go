@@ -0,0 +1,99 @@
+package deb822
+
+import (
+	"strconv"
+	"strings"
+)
+
+// CompareVersions compares Debian package versions [epoch:]upstream[-revision] as dpkg does and returns
+// -1, 0 or 1 if a is older, equal or newer than b. Tilde sorts before anything, even the end of version,
+// so 1.0~rc1 is older than 1.0.
+func CompareVersions(a, b string) int {
+	ea, ua, ra := splitVersion(a)
+	eb, ub, rb := splitVersion(b)
+	if ea != eb {
+		return sign(ea - eb)
+	}
+	if c := compareParts(ua, ub); c != 0 {
+		return c
+	}
+	return compareParts(ra, rb)
+}
+
+// splitVersion returns epoch, upstream version and revision of Debian version
+func splitVersion(v string) (epoch int, upstream, revision string) {
+	v = strings.TrimSpace(v)
+	if i := strings.Index(v, ":"); i >= 0 {
+		epoch, _ = strconv.Atoi(v[:i])
+		v = v[i+1:]
+	}
+	if i := strings.LastIndex(v, "-"); i >= 0 {
+		return epoch, v[:i], v[i+1:]
+	}
+	return epoch, v, ""
+}
+
+// order is the weight of character in non-digit part of version: tilde goes first, then the end of part,
+// letters and other characters
+func order(s string) int {
+	switch {
+	case len(s) == 0 || isDigit(s[0]):
+		return 0
+	case s[0] == '~':
+		return -1
+	case s[0] >= 'a' && s[0] <= 'z' || s[0] >= 'A' && s[0] <= 'Z':
+		return int(s[0])
+	}
+	return int(s[0]) + 256
+}
+
+// compareParts compares upstream versions or revisions by alternating non-digit and digit runs
+func compareParts(a, b string) int {
+	for len(a) != 0 || len(b) != 0 {
+		for len(a) != 0 && !isDigit(a[0]) || len(b) != 0 && !isDigit(b[0]) {
+			if oa, ob := order(a), order(b); oa != ob {
+				return sign(oa - ob)
+			}
+			a, b = skip(a), skip(b)
+		}
+		a, b = strings.TrimLeft(a, "0"), strings.TrimLeft(b, "0")
+		diff := 0
+		for len(a) != 0 && isDigit(a[0]) && len(b) != 0 && isDigit(b[0]) {
+			if diff == 0 {
+				diff = int(a[0]) - int(b[0])
+			}
+			a, b = a[1:], b[1:]
+		}
+		if len(a) != 0 && isDigit(a[0]) {
+			return 1
+		}
+		if len(b) != 0 && isDigit(b[0]) {
+			return -1
+		}
+		if diff != 0 {
+			return sign(diff)
+		}
+	}
+	return 0
+}
+
+func skip(s string) string {
+	if len(s) == 0 {
+		return s
+	}
+	return s[1:]
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	}
+	return 0
+}
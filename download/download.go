@@ -8,14 +8,17 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/blang/semver"
 	"github.com/subutai-io/agent/log"
+	"github.com/subutai-io/cdn/auth"
 	"github.com/subutai-io/cdn/config"
 	"github.com/subutai-io/cdn/db"
+	"github.com/subutai-io/cdn/deb822"
 	"github.com/subutai-io/cdn/utils"
 )
 
@@ -25,6 +28,7 @@ type ListItem struct {
 	Hash          hashsums          `json:"hash"`
 	Size          int               `json:"size"`
 	Name          string            `json:"name,omitempty"`
+	Package       string            `json:"package,omitempty"`
 	Tags          []string          `json:"tags,omitempty"`
 	Owner         []string          `json:"owner,omitempty"`
 	Parent        string            `json:"parent,omitempty"`
@@ -36,6 +40,7 @@ type ListItem struct {
 	Signature     map[string]string `json:"signature,omitempty"`
 	Description   string            `json:"description,omitempty"`
 	Architecture  string            `json:"architecture,omitempty"`
+	Control       string            `json:"control,omitempty"`
 	Date          time.Time         `json:"upload-date-formatted"`
 	Timestamp     string            `json:"upload-date-timestamp,omitempty"`
 }
@@ -48,7 +53,7 @@ type hashsums struct {
 // Handler provides download functionality for all artifacts.
 func Handler(repo string, w http.ResponseWriter, r *http.Request) {
 	id := r.URL.Query().Get("id")
-	token := strings.ToLower(r.URL.Query().Get("token"))
+	token := auth.RequestToken(r)
 	name := r.URL.Query().Get("name")
 	tag := r.URL.Query().Get("tag")
 
@@ -79,7 +84,7 @@ func Handler(repo string, w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	if len(db.NameByHash(id)) > 0 && !db.IsPublic(id) && !db.CheckShare(id, db.TokenOwner(strings.ToLower(r.URL.Query().Get("token")))) {
+	if len(db.NameByHash(id)) > 0 && (db.Trashed(id) || !db.IsPublic(id) && !db.CheckShare(id, auth.RequestOwner(r))) {
 		w.WriteHeader(http.StatusNotFound)
 		w.Write([]byte("Not found"))
 		return
@@ -150,7 +155,7 @@ func Info(repo string, r *http.Request) []byte {
 	subname := r.URL.Query().Get("subname")
 	page := r.URL.Query().Get("page")
 	owner := strings.ToLower(r.URL.Query().Get("owner"))
-	token := strings.ToLower(r.URL.Query().Get("token"))
+	token := auth.RequestToken(r)
 	version := r.URL.Query().Get("version")
 	verified := r.URL.Query().Get("verified")
 	version = utils.ProcessVersion(version)
@@ -160,7 +165,8 @@ func Info(repo string, r *http.Request) []byte {
 	if id != "" && name != "" && db.NameByHash(id) != name {
 		return nil
 	}
-	if token != "" && db.TokenOwner(token) == "" {
+	user := auth.RequestOwner(r)
+	if token != "" && user == "" {
 		token = ""
 		log.Debug(fmt.Sprintf("Info: provided token is invalid"))
 	}
@@ -174,9 +180,9 @@ func Info(repo string, r *http.Request) []byte {
 				list = []string{id}
 			} else if owner == "" && token != "" {
 				log.Info("Case 2")
-				list = utils.Intersect([]string{id}, utils.Intersect(db.SearchName(name), db.OwnerFilesByRepo(db.TokenOwner(token), repo)))
+				list = utils.Intersect([]string{id}, utils.Intersect(db.SearchName(name), db.OwnerFilesByRepo(user, repo)))
 				if len(list) == 0 {
-					list = utils.Intersect([]string{id}, utils.Intersect(db.SearchName(name), db.TokenFilesByRepo(token, repo)))
+					list = utils.Intersect([]string{id}, utils.Intersect(db.SearchName(name), db.UserFilesByRepo(user, repo)))
 					if len(list) == 0 {
 						list = utils.Intersect([]string{id}, db.SearchName(name))
 					}
@@ -186,7 +192,7 @@ func Info(repo string, r *http.Request) []byte {
 				list = utils.Intersect([]string{id}, db.OwnerFilesByRepo(owner, repo))
 			} else {
 				log.Info("Case 4")
-				list = utils.Intersect([]string{id}, utils.Union(db.OwnerFilesByRepo(owner, repo), utils.Intersect(db.TokenFilesByRepo(db.GetUserToken(owner), repo), db.TokenFilesByRepo(token, repo))))
+				list = utils.Intersect([]string{id}, utils.Union(db.OwnerFilesByRepo(owner, repo), utils.Intersect(activeUserFiles(owner, repo), db.UserFilesByRepo(user, repo))))
 			}
 		} else {
 			list = []string{id}
@@ -196,7 +202,7 @@ func Info(repo string, r *http.Request) []byte {
 			log.Warn(fmt.Sprintf("Both id and name were not provided"))
 			return nil
 		}
-		if owner != "" && token != "" && db.TokenOwner(token) != owner {
+		if owner != "" && token != "" && user != owner {
 			return nil
 		}
 		log.Info(fmt.Sprintf("name was provided"))
@@ -207,16 +213,16 @@ func Info(repo string, r *http.Request) []byte {
 				verified = "true"
 			} else if owner == "" && token != "" {
 				log.Info("Case 2")
-				list = utils.Intersect(db.SearchName(name), db.TokenFilesByRepo(token, repo))
+				list = utils.Intersect(db.SearchName(name), db.UserFilesByRepo(user, repo))
 				onlyTokenOwner := make([]string, 0)
 				for _, k := range list {
-					if db.FileField(k, "owner")[0] == db.TokenOwner(token) {
+					if db.FileField(k, "owner")[0] == user {
 						onlyTokenOwner = append(onlyTokenOwner, k)
 					}
 				}
 				list = onlyTokenOwner
 				if len(list) == 0 {
-					list = utils.Intersect(db.SearchName(name), db.TokenFilesByRepo(token, repo))
+					list = utils.Intersect(db.SearchName(name), db.UserFilesByRepo(user, repo))
 					if len(list) == 0 {
 						list = db.SearchName(name)
 						verified = "true"
@@ -227,7 +233,7 @@ func Info(repo string, r *http.Request) []byte {
 				list = db.OwnerFilesByRepo(owner, repo)
 			} else {
 				log.Info("Case 4")
-				list = utils.Intersect(db.SearchName(name), utils.Union(db.OwnerFilesByRepo(owner, repo), utils.Intersect(db.TokenFilesByRepo(db.GetUserToken(owner), repo), db.TokenFilesByRepo(token, repo))))
+				list = utils.Intersect(db.SearchName(name), utils.Union(db.OwnerFilesByRepo(owner, repo), utils.Intersect(activeUserFiles(owner, repo), db.UserFilesByRepo(user, repo))))
 			}
 		} else {
 			list = db.SearchName(name)
@@ -255,15 +261,13 @@ func Info(repo string, r *http.Request) []byte {
 	if len(pstr) == 2 {
 		p[1], _ = strconv.Atoi(pstr[1])
 	}
-	latestVersion, _ := semver.Make("")
 	log.Info(fmt.Sprintf("info: list to be checked: "))
 	for i, k := range list {
 		log.Info(fmt.Sprintf("info: item %d: %s (filename: %s)", i, k, db.NameByHash(k)))
 	}
+	inRepo := utils.Set(db.RepoFiles(repo))
 	for _, k := range list {
-		if (!db.IsPublic(k) && !db.CheckShare(k, db.TokenOwner(token))) ||
-			(db.IsPublic(k) && len(owner) > 0 && db.CheckRepo(owner, []string{repo}, k) == 0) ||
-			db.CheckRepo("", []string{repo}, k) == 0 {
+		if !inRepo[k] || (!db.IsPublic(k) && !db.CheckShare(k, user)) {
 			continue
 		}
 		if p[0]--; p[0] > 0 {
@@ -271,12 +275,10 @@ func Info(repo string, r *http.Request) []byte {
 		}
 		item := FormatItem(db.Info(k), repo)
 		if (id == "" || id == item.ID) &&
-			((subname != "" && strings.Contains(item.Name, subname)) || name == item.Name || strings.HasPrefix(name, item.Name + "-subutai-template")) &&
+			((subname != "" && strings.Contains(item.Name, subname)) || name == item.Name || repo == "apt" && name == item.Package || strings.HasPrefix(name, item.Name + "-subutai-template")) &&
 			(version == "" || (version != "" && item.Version == version)) {
 			items = []ListItem{item}
-			itemVersion, _ := semver.Make(item.Version)
-			if itemVersion.GTE(latestVersion) {
-				latestVersion = itemVersion
+			if itemLatestVersion.ID == "" || compareVersions(repo, item.Version, itemLatestVersion.Version) >= 0 {
 				itemLatestVersion = item
 			}
 		}
@@ -285,7 +287,7 @@ func Info(repo string, r *http.Request) []byte {
 		}
 	}
 	if len(items) == 1 {
-		if version == "" && repo == "template" && itemLatestVersion.ID != "" {
+		if version == "" && (repo == "template" || repo == "apt") && itemLatestVersion.ID != "" {
 			items[0] = itemLatestVersion
 		}
 		items[0].Signature = db.FileSignatures(items[0].ID)
@@ -310,13 +312,14 @@ func List(repo string, r *http.Request) []byte {
 	page := r.URL.Query().Get("page")
 	subname := r.URL.Query().Get("subname")
 	owner := strings.ToLower(r.URL.Query().Get("owner"))
-	token := strings.ToLower(r.URL.Query().Get("token"))
+	token := auth.RequestToken(r)
 	version := r.URL.Query().Get("version")
 	verified := r.URL.Query().Get("verified")
 	if name == "" {
 		name = subname
 	}
-	if token != "" && db.TokenOwner(token) == "" {
+	user := auth.RequestOwner(r)
+	if token != "" && user == "" {
 		token = ""
 		log.Debug(fmt.Sprintf("List: provided token is invalid"))
 	}
@@ -332,8 +335,8 @@ func List(repo string, r *http.Request) []byte {
 		log.Info("Case 4")
 		list = utils.Union(db.OwnerFilesByRepo(owner, repo),
 			utils.Intersect(
-				db.TokenFilesByRepo(db.GetUserToken(owner), repo),
-				db.TokenFilesByRepo(token, repo)))
+				activeUserFiles(owner, repo),
+				db.UserFilesByRepo(user, repo)))
 	}
 	list = utils.Unique(list)
 	if tag != "" {
@@ -350,12 +353,11 @@ func List(repo string, r *http.Request) []byte {
 	for i, k := range list {
 		log.Info(fmt.Sprintf("list: item %d: %s (filename: %s)", i, k, db.NameByHash(k)))
 	}
+	inRepo := utils.Set(db.RepoFiles(repo))
 	for i, k := range list {
 		log.Debug(fmt.Sprintf("checking file #%+v: %+v", i, k))
-		if (!db.IsPublic(k) && !db.CheckShare(k, db.TokenOwner(token))) ||
-			(db.IsPublic(k) && len(owner) > 0 && db.CheckRepo(owner, []string{repo}, k) == 0) ||
-			db.CheckRepo("", []string{repo}, k) == 0 {
-			log.Debug(fmt.Sprintf("File %+v (name: %+v, owner: %+v, token: %+v) is ignored: %+v || %+v || %+v", k, db.NameByHash(k), owner, db.TokenOwner(token), !db.IsPublic(k) && !db.CheckShare(k, db.TokenOwner(token)), db.IsPublic(k) && len(owner) > 0 && db.CheckRepo(owner, []string{repo}, k) == 0, db.CheckRepo("", []string{repo}, k) == 0))
+		if !inRepo[k] || (!db.IsPublic(k) && !db.CheckShare(k, user)) {
+			log.Debug(fmt.Sprintf("File %+v (owner: %+v, token: %+v) is ignored", k, owner, user))
 			continue
 		}
 		if p[0]--; p[0] > 0 {
@@ -363,11 +365,11 @@ func List(repo string, r *http.Request) []byte {
 		}
 		item := FormatItem(db.Info(k), repo)
 		log.Debug(fmt.Sprintf("File #%+v (hash: %+v) in formatted way: %+v", i, k, item))
-		if (name == "" || (name != "" && ((subname != "" && strings.Contains(item.Name, subname)) || name == item.Name || strings.HasPrefix(name, item.Name+"-subutai-template")))) &&
-			(version == "" || (version != "" && (item.Version == version || (version == "latest" && checkVersion(items, item) != -1)))) &&
+		if (name == "" || (name != "" && ((subname != "" && strings.Contains(item.Name, subname)) || name == item.Name || repo == "apt" && name == item.Package || strings.HasPrefix(name, item.Name+"-subutai-template")))) &&
+			(version == "" || (version != "" && (item.Version == version || (version == "latest" && checkVersion(repo, items, item) != -1)))) &&
 			(verified != "true" || utils.In(item.Owner, []string{"subutai", "jenkins", "docker", "travis", "appveyor", "devops"})) {
 			if version == "latest" {
-				positionOlderItem := checkVersion(items, item)
+				positionOlderItem := checkVersion(repo, items, item)
 				if positionOlderItem != len(items) {
 					items = append(items[:positionOlderItem], items[positionOlderItem+1:]...)
 				}
@@ -378,7 +380,17 @@ func List(repo string, r *http.Request) []byte {
 			break
 		}
 	}
-
+	if repo == "apt" {
+		sort.SliceStable(items, func(i, j int) bool {
+			if items[i].Package != items[j].Package {
+				return items[i].Package < items[j].Package
+			}
+			if items[i].Architecture != items[j].Architecture {
+				return items[i].Architecture < items[j].Architecture
+			}
+			return deb822.CompareVersions(items[i].Version, items[j].Version) < 0
+		})
+	}
 	log.Info(fmt.Sprintf("list: final list: "))
 	for i, k := range items {
 		log.Info(fmt.Sprintf("list: item %d: %s (filename: %s)", i, k.ID, db.NameByHash(k.ID)))
@@ -395,25 +407,33 @@ func List(repo string, r *http.Request) []byte {
 
 func GetVerified(list []string, name, repo, versionTemplate string) ListItem {
 	log.Debug(fmt.Sprintf("Getting file \"%+v\" from verified users", name))
-	latestVersion, _ := semver.Make("")
+	latestVersion := ""
 	var itemLatestVersion ListItem
 	log.Debug(fmt.Sprintf("Iterating through list:\n["))
 	for _, k := range list {
 		log.Debug(fmt.Sprintf("------------- %+v (name: %+v)", k, db.NameByHash(k)))
 	}
 	log.Debug(fmt.Sprintf("\n]"))
+	inRepo := utils.Set(db.RepoFiles(repo))
 	for _, k := range list {
-		if info := db.Info(k); db.CheckRepo("", []string{repo}, k) > 0 {
+		if info := db.Info(k); inRepo[k] {
 			log.Debug(fmt.Sprintf("info[\"name\"] %+v == %+v name (%+v)", info["name"], name, info["name"] == name))
-			if info["name"] == name || (strings.HasPrefix(info["name"], name+"-subutai-template") && repo == "template") {
+			if info["name"] == name || (strings.HasPrefix(info["name"], name+"-subutai-template") && repo == "template") ||
+				(info["Package"] == name && repo == "apt") {
 				for _, owner := range db.FileField(info["id"], "owner") {
-					itemVersion, _ := semver.Make(info["version"])
+					itemVersion := info["version"]
+					if repo == "apt" {
+						itemVersion = info["Version"]
+					} else {
+						v, _ := semver.Make(itemVersion)
+						itemVersion = v.String()
+					}
 					if utils.In([]string{owner}, []string{"subutai", "jenkins", "docker", "travis", "appveyor", "devops"}) {
-						if itemVersion.GTE(latestVersion) && len(versionTemplate) == 0 {
+						if (itemLatestVersion.ID == "" || compareVersions(repo, itemVersion, latestVersion) >= 0) && len(versionTemplate) == 0 {
 							log.Debug(fmt.Sprintf("First if %+v", k))
 							latestVersion = itemVersion
 							itemLatestVersion = FormatItem(db.Info(k), repo)
-						} else if versionTemplate == itemVersion.String() {
+						} else if versionTemplate == itemVersion {
 							log.Debug(fmt.Sprintf("Second if %+v", k))
 							itemLatestVersion = FormatItem(db.Info(k), repo)
 						}
@@ -456,10 +476,12 @@ func FormatItem(info map[string]string, repo string) ListItem {
 	}
 	item.Size, _ = strconv.Atoi(info["size"])
 	if repo == "apt" {
+		item.Package = info["Package"]
 		item.Version = info["Version"]
 		item.Architecture = info["Architecture"]
 		item.Size, _ = strconv.Atoi(info["Size"])
 		item.Hash.Sha256 = info["SHA256"]
+		item.Control = deb822.FromRecord(info).String()
 	}
 	if len(item.Hash.Md5) == 0 {
 		item.Hash.Md5 = item.ID
@@ -469,15 +491,22 @@ func FormatItem(info map[string]string, repo string) ListItem {
 }
 
 
-func checkVersion(items []ListItem, item ListItem) int {
+// sameArtifact returns true if items are versions of the same artifact. Apt packages are grouped by package
+// name and architecture, as item name is the name of .deb file there; other artifacts by name and owner.
+func sameArtifact(repo string, a, b ListItem) bool {
+	if repo == "apt" {
+		return a.Package == b.Package && a.Architecture == b.Architecture
+	}
+	return a.Name == b.Name && len(a.Owner) > 0 && len(b.Owner) > 0 && a.Owner[0] == b.Owner[0]
+}
+
+func checkVersion(repo string, items []ListItem, item ListItem) int {
 	exists := false
 	for i, v := range items {
-		if v.Name == item.Name && (len(v.Owner) > 0 && len(item.Owner) > 0 && v.Owner[0] == item.Owner[0]) {
+		if sameArtifact(repo, v, item) {
 			exists = true
-			vVersion, _ := semver.Make(v.Version)
-			itemVersion, _ := semver.Make(item.Version)
-			if itemVersion.GTE(vVersion) {
-				log.Info(fmt.Sprintf("i = %d, vVersion: %+v, itemVersion: %+v, v: %+v <---> item: %+v", i, vVersion, itemVersion, v, item))
+			if compareVersions(repo, item.Version, v.Version) >= 0 {
+				log.Info(fmt.Sprintf("i = %d, vVersion: %+v, itemVersion: %+v, v: %+v <---> item: %+v", i, v.Version, item.Version, v, item))
 				return i
 			}
 		}
@@ -487,3 +516,22 @@ func checkVersion(items []ListItem, item ListItem) int {
 	}
 	return -1
 }
+
+// activeUserFiles returns files available to user from repo if user has valid session token
+func activeUserFiles(user, repo string) []string {
+	if len(db.GetUserToken(user)) == 0 {
+		return nil
+	}
+	return db.UserFilesByRepo(user, repo)
+}
+
+// compareVersions compares versions of artifacts in repo, Debian version rules are used for apt packages
+// and semantic versioning for others. Versions which are not valid semver are treated as 0.0.0.
+func compareVersions(repo, a, b string) int {
+	if repo == "apt" {
+		return deb822.CompareVersions(a, b)
+	}
+	va, _ := semver.Make(a)
+	vb, _ := semver.Make(b)
+	return va.Compare(vb)
+}
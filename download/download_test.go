@@ -1,6 +1,7 @@
 package download
 
 import (
+	"strings"
 	"testing"
 	"github.com/subutai-io/agent/log"
 	"fmt"
@@ -78,6 +79,7 @@ func TestFormatItem(t *testing.T) {
 
 func Test_checkVersion(t *testing.T) {
 	type args struct {
+		repo  string
 		items []ListItem
 		item  ListItem
 	}
@@ -90,6 +92,10 @@ func Test_checkVersion(t *testing.T) {
 		{name: "Test_checkVersion-1"},
 		{name: "Test_checkVersion-2"},
 		{name: "Test_checkVersion-3"},
+		{name: "Test_checkVersion-4", args: args{repo: "apt"}},
+		{name: "Test_checkVersion-5", args: args{repo: "apt"}},
+		{name: "Test_checkVersion-6", args: args{repo: "apt"}},
+		{name: "Test_checkVersion-7", args: args{repo: "apt"}},
 		// TODO: Add test cases.
 	}
 	tests[0].args.items = append(tests[0].args.items, ListItem{Name: "debian-stretch", Owner: []string{"subutai"}, Version: "0.4.1"})
@@ -105,12 +111,28 @@ func Test_checkVersion(t *testing.T) {
 	tests[3].args.items = append(tests[3].args.items, ListItem{Name: "debian-stretch", Owner: []string{"subutai"}, Version: "0.4.2"})
 	tests[3].args.item = ListItem{Name: "debian-stretch", Owner: []string{"subutai"}, Version: "0.4.3"}
 	tests[3].want = 1
+	deb := func(pkg, version, arch string) ListItem {
+		name := pkg + "_" + version[strings.Index(version, ":")+1:] + "_" + arch + ".deb"
+		return FormatItem(map[string]string{"id": name, "name": name, "Package": pkg, "Version": version, "Architecture": arch}, "apt")
+	}
+	tests[4].args.items = append(tests[4].args.items, deb("hello", "1:2.3~rc1-0ubuntu2", "amd64"))
+	tests[4].args.item = deb("hello", "1:2.3-0ubuntu1", "amd64")
+	tests[4].want = 0
+	tests[5].args.items = append(tests[5].args.items, deb("hello", "1:2.3-0ubuntu1", "amd64"))
+	tests[5].args.item = deb("hello", "2.4-1", "amd64")
+	tests[5].want = -1
+	tests[6].args.items = append(tests[6].args.items, deb("hello", "1:2.3-0ubuntu1", "amd64"))
+	tests[6].args.item = deb("hello", "1:2.4-1", "arm64")
+	tests[6].want = 1
+	tests[7].args.items = append(tests[7].args.items, deb("hello-doc", "1.0-1", "all"))
+	tests[7].args.item = deb("hello", "1.0-1", "all")
+	tests[7].want = 1
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			log.Warn(fmt.Sprintf("Starting test"))
 			log.Warn(fmt.Sprintf("tt.args.items = %+v", tt.args.items))
 			log.Warn(fmt.Sprintf("tt.args.item = %+v", tt.args.item))
-			if got := checkVersion(tt.args.items, tt.args.item); got != tt.want {
+			if got := checkVersion(tt.args.repo, tt.args.items, tt.args.item); got != tt.want {
 				t.Errorf("checkVersion() = %v, want %v", got, tt.want)
 			}
 		})
@@ -2,9 +2,14 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"os"
 	"strings"
 	"time"
 
@@ -18,6 +23,7 @@ import (
 	"github.com/subutai-io/cdn/raw"
 	"github.com/subutai-io/cdn/template"
 	"github.com/subutai-io/cdn/upload"
+	"github.com/subutai-io/cdn/utils"
 )
 
 var version = "6.3.0"
@@ -30,10 +36,44 @@ var (
 
 func RunTask() {
 	gocron.Every(6).Hours().Do(apt.GenerateReleaseFile)
+	if len(config.DB.Backupdir) > 0 && config.DB.Backupinterval > 0 {
+		gocron.Every(uint64(config.DB.Backupinterval)).Hours().Do(db.ScheduledBackup)
+	}
+	if config.Storage.Trashretention > 0 {
+		gocron.Every(1).Hour().Do(upload.PurgeTrash)
+	}
 	<-gocron.Start()
 }
 func main() {
 	defer db.Close()
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "migrate":
+			migrate(os.Args[2:])
+			return
+		case "backup":
+			backupCmd(os.Args[2:])
+			return
+		case "restore":
+			restoreCmd(os.Args[2:])
+			return
+		case "export":
+			exportCmd(os.Args[2:])
+			return
+		case "import":
+			importCmd(os.Args[2:])
+			return
+		case "fsck":
+			fsck(os.Args[2:])
+			return
+		case "reindex":
+			log.Check(log.FatalLevel, "Rebuilding indexes", db.Reindex())
+			return
+		}
+	}
+	if config.DB.Automigrate {
+		log.Check(log.FatalLevel, "Migrating database", db.Migrate(false, config.DB.Backup))
+	}
 	// defer torrent.Close()
 	// go torrent.SeedLocal()
 	go RunTask()
@@ -74,6 +114,11 @@ func main() {
 	http.HandleFunc("/kurjun/rest/apt/upload", apt.Upload)
 	http.HandleFunc("/kurjun/rest/apt/download", apt.Download)
 	http.HandleFunc("/kurjun/rest/apt/generate", apt.Generate)
+	http.HandleFunc("/kurjun/rest/apt/key", apt.Key)
+	http.HandleFunc("/kurjun/rest/apt/contents", apt.Contents)
+	http.HandleFunc("/kurjun/rest/apt/snapshot", apt.Snapshot)
+	http.HandleFunc("/kurjun/rest/apt/snapshot/promote", apt.Promote)
+	http.HandleFunc("/kurjun/rest/apt/snapshot/unpublish", apt.Unpublish)
 
 	http.HandleFunc("/kurjun/rest/raw/", raw.Download)
 	http.HandleFunc("/kurjun/rest/raw/info", raw.Info)
@@ -95,6 +140,10 @@ func main() {
 
 	http.HandleFunc("/kurjun/rest/auth/key", auth.Key)
 	http.HandleFunc("/kurjun/rest/auth/keys", auth.Keys)
+	http.HandleFunc("/kurjun/rest/auth/keys/info", auth.KeyList)
+	http.HandleFunc("/kurjun/rest/auth/keys/revoke", auth.RevokeKey)
+	http.HandleFunc("/kurjun/rest/auth/keys/rotate", auth.RotateKey)
+	http.HandleFunc("/kurjun/rest/auth/keys/ssh", auth.SSHKeys)
 	http.HandleFunc("/kurjun/rest/auth/sign", auth.Sign)
 	http.HandleFunc("/kurjun/rest/auth/owner", auth.Owner)
 	http.HandleFunc("/kurjun/rest/auth/token", auth.Token)
@@ -104,7 +153,10 @@ func main() {
 	http.HandleFunc("/kurjun/rest/healthcheck", healthcheck)
 	http.HandleFunc("/kurjun/rest/share", upload.Share)
 	http.HandleFunc("/kurjun/rest/quota", upload.Quota)
+	http.HandleFunc("/kurjun/rest/trash", upload.Trash)
+	http.HandleFunc("/kurjun/rest/trash/restore", upload.Restore)
 	http.HandleFunc("/kurjun/rest/about", about)
+	http.HandleFunc("/kurjun/rest/backup", backup)
 
 	if testMode {
 		http.HandleFunc("/kurjun/rest/shutdown", shutdown)
@@ -112,20 +164,158 @@ func main() {
 
 	srv = &http.Server{
 		Addr:    ":" + config.Network.Port,
-		Handler: nil,
+		Handler: auth.Middleware(http.DefaultServeMux),
 	}
 
 	srv.ListenAndServe()
 
 }
 
+// migrate runs database migrations from command line: gorjun migrate [-dry-run] [-backup=false]
+func migrate(args []string) {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dry := flags.Bool("dry-run", false, "report pending changes without applying them")
+	backup := flags.Bool("backup", config.DB.Backup, "save copy of database before migration")
+	flags.Parse(args)
+	log.Info(fmt.Sprintf("Database schema version: %d, latest: %d", db.SchemaVersion(), db.LatestSchema()))
+	log.Check(log.FatalLevel, "Migrating database", db.Migrate(*dry, *backup))
+}
+
+// backupCmd saves database snapshot to file or stdout: gorjun backup [-token token] [file]. Snapshot is downloaded
+// from running server, which holds the lock of database file, the file is read directly only if server doesn't respond.
+func backupCmd(args []string) {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	token := flags.String("token", "", "token of subutai or Hub user to download backup from running server")
+	flags.Parse(args)
+	path := flags.Arg(0)
+	req, err := http.NewRequest("GET", "http://127.0.0.1:"+config.Network.Port+"/kurjun/rest/backup", nil)
+	log.Check(log.FatalLevel, "Preparing backup request", err)
+	req.Header.Set("token", *token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Debug("Server is not running, backing up database file: " + err.Error())
+		if len(path) == 0 || path == "-" {
+			_, err := db.Backup(os.Stdout)
+			log.Check(log.FatalLevel, "Backing up database", err)
+			return
+		}
+		log.Check(log.FatalLevel, "Backing up database to "+path, db.BackupFile(path))
+		log.Info("Database is backed up to " + path)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Fatal("Downloading backup from running server: " + resp.Status)
+	}
+	if len(path) == 0 || path == "-" {
+		_, err := io.Copy(os.Stdout, resp.Body)
+		log.Check(log.FatalLevel, "Downloading backup from running server", err)
+		return
+	}
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	log.Check(log.FatalLevel, "Creating backup file "+path, err)
+	if _, err = io.Copy(out, resp.Body); err == nil {
+		err = out.Close()
+	} else {
+		out.Close()
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	log.Check(log.FatalLevel, "Downloading backup from running server to "+path, err)
+	log.Info("Database is backed up to " + path)
+}
+
+// restoreCmd replaces database with snapshot: gorjun restore <file>. Server must be stopped.
+func restoreCmd(args []string) {
+	if len(args) == 0 {
+		log.Fatal("Please specify snapshot file to restore")
+	}
+	log.Check(log.FatalLevel, "Restoring database from "+args[0], db.Restore(args[0]))
+}
+
+// exportCmd writes catalog in JSON lines format: gorjun export [-blobs dir] [file]
+func exportCmd(args []string) {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	blobs := flags.String("blobs", "", "directory to copy content of files to")
+	flags.Parse(args)
+	out := os.Stdout
+	if path := flags.Arg(0); len(path) != 0 && path != "-" {
+		f, err := os.Create(path)
+		log.Check(log.FatalLevel, "Creating export file "+path, err)
+		defer f.Close()
+		out = f
+	}
+	users, files, err := db.Export(out, *blobs)
+	log.Check(log.FatalLevel, "Exporting catalog", err)
+	log.Info(fmt.Sprintf("Exported %d users and %d files", users, files))
+}
+
+// importCmd adds catalog exported by another instance: gorjun import [-blobs dir] [file]
+func importCmd(args []string) {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	blobs := flags.String("blobs", "", "directory to copy content of files from")
+	flags.Parse(args)
+	in := os.Stdin
+	if path := flags.Arg(0); len(path) != 0 && path != "-" {
+		f, err := os.Open(path)
+		log.Check(log.FatalLevel, "Opening import file "+path, err)
+		defer f.Close()
+		in = f
+	}
+	users, files, err := db.Import(in, *blobs)
+	log.Check(log.FatalLevel, "Importing catalog", err)
+	log.Info(fmt.Sprintf("Imported %d users and %d files", users, files))
+}
+
+// fsck checks database against storage directory: gorjun fsck [-repair] [-json]
+func fsck(args []string) {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	repair := flags.Bool("repair", false, "fix found problems instead of only reporting them")
+	asJSON := flags.Bool("json", false, "write report in JSON format")
+	flags.Parse(args)
+	report, err := db.Fsck(*repair)
+	log.Check(log.FatalLevel, "Checking database", err)
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+	} else {
+		for _, p := range report.Problems {
+			fmt.Println(p)
+		}
+		fmt.Printf("Checked %d files, %d blobs, %d users: %d problems, %d not repaired\n",
+			report.Files, report.Blobs, report.Users, len(report.Problems), report.Unrepaired())
+	}
+	if report.Unrepaired() != 0 {
+		db.Close()
+		os.Exit(1)
+	}
+}
+
+// backup streams consistent database snapshot to administrators while server keeps serving requests
+func backup(w http.ResponseWriter, r *http.Request) {
+	if owner := auth.RequestOwner(r); owner != "Hub" && owner != "subutai" {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("Not authorized"))
+		log.Warn(utils.ClientIP(r) + " - rejecting unauthorized backup request")
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"my.db."+time.Now().Format("20060102150405")+"\"")
+	size, err := db.Backup(w)
+	if !log.Check(log.WarnLevel, "Streaming database backup", err) {
+		log.Info(fmt.Sprintf("%s - database backup of %d bytes sent", utils.ClientIP(r), size))
+	}
+}
+
 func shutdown(w http.ResponseWriter, r *http.Request) {
 	log.Info("Shutting down the server")
 	stop <- true
 }
 
 func about(w http.ResponseWriter, r *http.Request) {
-	if strings.Split(r.RemoteAddr, ":")[0] == "127.0.0.1" {
+	if utils.Local(r) {
 		_, err := w.Write([]byte(version))
 		log.Check(log.DebugLevel, "Writing Kurjun version", err)
 	} else {
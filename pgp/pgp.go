@@ -2,27 +2,91 @@ package pgp
 
 import (
 	"bytes"
+	"crypto"
+	_ "crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/subutai-io/agent/log"
 	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
 	"golang.org/x/crypto/openpgp/clearsign"
+	"golang.org/x/crypto/openpgp/packet"
 
 	"github.com/subutai-io/cdn/db"
 )
 
+// Verify checks clearsigned message with user's active keys and returns signed content.
+// Empty string is returned if none of the keys produced the signature.
 func Verify(name, message string) string {
+	content, _ := Signer(name, message)
+	return content
+}
+
+// Signer works like Verify, but it also returns the armored key which produced the signature.
+// Expired keys and keys with revocation signatures are skipped.
+func Signer(name, message string) (content, key string) {
 	for _, key := range db.UserKeys(name) {
 		entity, err := openpgp.ReadArmoredKeyRing(bytes.NewBufferString(key))
-		log.Check(log.WarnLevel, "Reading user public key", err)
+		if log.Check(log.WarnLevel, "Reading user public key", err) {
+			continue
+		}
 
 		if block, _ := clearsign.Decode([]byte(message)); block != nil {
-			_, err = openpgp.CheckDetachedSignature(entity, bytes.NewBuffer(block.Bytes), block.ArmoredSignature.Body)
-			if !log.Check(log.WarnLevel, "Checking signature", err) {
-				return string(block.Bytes)
+			signer, err := openpgp.CheckDetachedSignature(entity, bytes.NewBuffer(block.Bytes), block.ArmoredSignature.Body)
+			if log.Check(log.WarnLevel, "Checking signature", err) {
+				continue
 			}
+			if !Active(signer, time.Now()) {
+				log.Warn("Signature of " + name + " was made by expired or revoked key")
+				continue
+			}
+			return string(block.Bytes), key
 		}
 	}
-	return ""
+	return "", ""
+}
+
+// Active returns false if the key has revocation signature or its self-signature is expired at the moment.
+func Active(entity *openpgp.Entity, moment time.Time) bool {
+	if entity == nil || len(entity.Revocations) > 0 {
+		return false
+	}
+	if expires := expiry(entity); !expires.IsZero() && moment.After(expires) {
+		return false
+	}
+	return true
+}
+
+// Expiry returns the moment when key expires. Zero time means that the key never expires.
+func Expiry(key string) time.Time {
+	entity, err := openpgp.ReadArmoredKeyRing(bytes.NewBufferString(key))
+	if log.Check(log.WarnLevel, "Reading user public key", err) || len(entity) == 0 {
+		return time.Time{}
+	}
+	return expiry(entity[0])
+}
+
+// expiry returns the moment when primary key expires, zero time means that the key never expires. Lifetime is counted
+// from creation of the key, not of self-signature carrying it, so refreshed self-signature doesn't prolong the key.
+func expiry(entity *openpgp.Entity) time.Time {
+	sig := selfSignature(entity)
+	if sig == nil || sig.KeyLifetimeSecs == nil || *sig.KeyLifetimeSecs == 0 {
+		return time.Time{}
+	}
+	return entity.PrimaryKey.CreationTime.Add(time.Duration(*sig.KeyLifetimeSecs) * time.Second)
+}
+
+// Revoked returns true if the key carries revocation signature.
+func Revoked(key string) bool {
+	entity, err := openpgp.ReadArmoredKeyRing(bytes.NewBufferString(key))
+	if log.Check(log.WarnLevel, "Reading user public key", err) || len(entity) == 0 {
+		return false
+	}
+	return len(entity[0].Revocations) > 0
 }
 
 func Fingerprint(key string) []byte {
@@ -34,3 +98,95 @@ func Fingerprint(key string) []byte {
 	}
 	return []byte("")
 }
+
+// SigningKey reads armored secret keyring from file and returns the key which has identity containing
+// given string, for example e-mail address. The first key of keyring is returned if identity is empty.
+// Encrypted private keys, including subkeys, are decrypted with passphrase.
+func SigningKey(path, identity, passphrase string) (*openpgp.Entity, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	keyring, err := openpgp.ReadArmoredKeyRing(f)
+	if err != nil {
+		return nil, err
+	}
+	for _, entity := range keyring {
+		if entity.PrivateKey == nil || !Active(entity, time.Now()) {
+			continue
+		}
+		for name := range entity.Identities {
+			if !strings.Contains(name, identity) {
+				continue
+			}
+			if entity.PrivateKey.Encrypted {
+				if err := entity.PrivateKey.Decrypt([]byte(passphrase)); err != nil {
+					return nil, fmt.Errorf("Decrypting key %s: %v", name, err)
+				}
+			}
+			for _, subkey := range entity.Subkeys {
+				if subkey.PrivateKey != nil && subkey.PrivateKey.Encrypted {
+					if err := subkey.PrivateKey.Decrypt([]byte(passphrase)); err != nil {
+						return nil, fmt.Errorf("Decrypting subkey %s of %s: %v", subkey.PublicKey.KeyIdString(), name, err)
+					}
+				}
+			}
+			return entity, nil
+		}
+	}
+	return nil, fmt.Errorf("Active secret key of %q not found in %s", identity, path)
+}
+
+// SignKey returns private key making signatures on behalf of entity: the first valid signing subkey,
+// or the primary key if there is no such subkey. openpgp chooses the key for detached signatures the same way.
+func SignKey(entity *openpgp.Entity, now time.Time) (*packet.PrivateKey, error) {
+	key := entity.PrivateKey
+	for _, subkey := range entity.Subkeys {
+		if subkey.Sig.FlagsValid && subkey.Sig.FlagSign && subkey.PublicKey.PubKeyAlgo.CanSign() && !subkey.Sig.KeyExpired(now) {
+			key = subkey.PrivateKey
+			break
+		}
+	}
+	if key == nil {
+		return nil, fmt.Errorf("Private part of signing key is missing")
+	}
+	return key, nil
+}
+
+// DetachSign writes armored detached signature of data made by private key
+func DetachSign(w io.Writer, key *packet.PrivateKey, data []byte) error {
+	sig := &packet.Signature{
+		SigType:      packet.SigTypeBinary,
+		PubKeyAlgo:   key.PubKeyAlgo,
+		Hash:         crypto.SHA256,
+		CreationTime: time.Now(),
+		IssuerKeyId:  &key.KeyId,
+	}
+	h := sig.Hash.New()
+	h.Write(data)
+	if err := sig.Sign(h, key, nil); err != nil {
+		return err
+	}
+	out, err := armor.Encode(w, openpgp.SignatureType, nil)
+	if err != nil {
+		return err
+	}
+	if err = sig.Serialize(out); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// selfSignature returns self-signature of primary identity, it carries key lifetime.
+func selfSignature(entity *openpgp.Entity) (sig *packet.Signature) {
+	for _, identity := range entity.Identities {
+		if identity.SelfSignature == nil {
+			continue
+		}
+		if sig == nil || identity.SelfSignature.IsPrimaryId != nil && *identity.SelfSignature.IsPrimaryId {
+			sig = identity.SelfSignature
+		}
+	}
+	return
+}
@@ -0,0 +1,48 @@
+package pgp
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+func TestActive(t *testing.T) {
+	entity, err := openpgp.NewEntity("test", "", "test@example.com", nil)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	lifetime := uint32(3600)
+	for _, identity := range entity.Identities {
+		identity.SelfSignature.KeyLifetimeSecs = &lifetime
+	}
+	created := entity.PrimaryKey.CreationTime
+	tests := []struct {
+		name      string
+		moment    time.Time
+		revoked   bool
+		refreshed time.Duration
+		want      bool
+	}{
+		{"TestActive-1", created.Add(time.Minute), false, 0, true},
+		{"TestActive-2", created.Add(2 * time.Hour), false, 0, false},
+		{"TestActive-3", created.Add(time.Minute), true, 0, false},
+		{"TestActive-4", created.Add(2 * time.Hour), false, 90 * time.Minute, false},
+		// TODO: Add test cases.
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entity.Revocations = nil
+			for _, identity := range entity.Identities {
+				identity.SelfSignature.CreationTime = created.Add(tt.refreshed)
+			}
+			if tt.revoked {
+				entity.Revocations = []*packet.Signature{{SigType: packet.SigTypeKeyRevocation}}
+			}
+			if got := Active(entity, tt.moment); got != tt.want {
+				t.Errorf("Active() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@ package raw
 
 import (
 	"net/http"
+	"os"
 	"strings"
 
 	uuid "github.com/satori/go.uuid"
@@ -9,6 +10,7 @@ import (
 
 	"net/url"
 
+	"github.com/subutai-io/cdn/config"
 	"github.com/subutai-io/cdn/db"
 	"github.com/subutai-io/cdn/download"
 	"github.com/subutai-io/cdn/upload"
@@ -36,17 +38,29 @@ func Upload(w http.ResponseWriter, r *http.Request) {
 		info["tag"] = tags
 		_, header, _ := r.FormFile("file")
 		my_uuid, _ := uuid.NewV4()
-		id := my_uuid.String()
+		artifact := db.Artifact{
+			ID:      my_uuid.String(),
+			Name:    header.Filename,
+			Owner:   owner,
+			Repo:    "raw",
+			Info:    info,
+			Private: len(r.MultipartForm.Value["private"]) > 0 && r.MultipartForm.Value["private"][0] == "true",
+		}
 		if tags != "" {
-			db.AddTag(strings.Split(tags, ","), id, "raw")
+			artifact.Tags = strings.Split(tags, ",")
+		}
+		if f, err := os.Stat(config.Storage.Path + md5); err == nil {
+			artifact.Size = int(f.Size())
 		}
-		db.Write(owner, id, header.Filename, info)
-		if len(r.MultipartForm.Value["private"]) > 0 && r.MultipartForm.Value["private"][0] == "true" {
-			log.Info("Sharing " + md5 + " with " + owner)
-			db.MakePrivate(id, owner)
-		} else {
-			db.MakePublic(id, owner)
+		if err := db.Register(artifact); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Failed to register file"))
+			if db.CountMd5(md5) == 0 {
+				os.Remove(config.Storage.Path + md5)
+			}
+			return
 		}
+		id := artifact.ID
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte(id))
 		log.Info(header.Filename + " saved to raw repo by " + owner)
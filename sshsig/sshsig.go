@@ -0,0 +1,127 @@
+// Package sshsig verifies signatures made by "ssh-keygen -Y sign" with users' registered SSH keys.
+package sshsig
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/pem"
+	"fmt"
+	"hash"
+
+	"github.com/subutai-io/agent/log"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/subutai-io/cdn/db"
+)
+
+// Namespace must be passed to "ssh-keygen -Y sign -n" by clients, so signatures made for other purposes can't be reused.
+const Namespace = "gorjun"
+
+const magic = "SSHSIG"
+
+type envelope struct {
+	Version   uint32
+	PublicKey []byte
+	Namespace string
+	Reserved  []byte
+	Hash      string
+	Signature []byte
+}
+
+type signedData struct {
+	Namespace string
+	Reserved  []byte
+	Hash      string
+	Digest    []byte
+}
+
+// Verify checks armored SSH signature of message with user's SSH keys and returns true if one of them produced it.
+func Verify(name, message, signature string) bool {
+	sig, key, err := parse(signature)
+	if log.Check(log.WarnLevel, "Parsing SSH signature", err) {
+		return false
+	}
+	for _, k := range db.UserSSHKeys(name) {
+		registered, _, _, _, err := ssh.ParseAuthorizedKey([]byte(k))
+		if log.Check(log.WarnLevel, "Reading user SSH key", err) {
+			continue
+		}
+		if bytes.Equal(registered.Marshal(), key.Marshal()) {
+			return !log.Check(log.WarnLevel, "Checking SSH signature", check(sig, key, []byte(message)))
+		}
+	}
+	return false
+}
+
+// Armored returns true if text looks like SSH signature
+func Armored(text string) bool {
+	return bytes.Contains([]byte(text), []byte("-----BEGIN SSH SIGNATURE-----"))
+}
+
+// Fingerprint returns SHA256 fingerprint of public key in authorized_keys format, the same as printed by "ssh-keygen -l"
+func Fingerprint(key string) string {
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key))
+	if log.Check(log.WarnLevel, "Reading SSH key", err) {
+		return ""
+	}
+	return ssh.FingerprintSHA256(pub)
+}
+
+// Supported returns true if key is valid ed25519, ECDSA or RSA public key in authorized_keys format
+func Supported(key string) bool {
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key))
+	if err != nil {
+		return false
+	}
+	switch pub.Type() {
+	case ssh.KeyAlgoED25519, ssh.KeyAlgoRSA, ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521:
+		return true
+	}
+	return false
+}
+
+func parse(signature string) (sig envelope, key ssh.PublicKey, err error) {
+	block, _ := pem.Decode([]byte(signature))
+	if block == nil || block.Type != "SSH SIGNATURE" {
+		return sig, nil, fmt.Errorf("Not an armored SSH signature")
+	}
+	if !bytes.HasPrefix(block.Bytes, []byte(magic)) {
+		return sig, nil, fmt.Errorf("Missing SSHSIG preamble")
+	}
+	if err = ssh.Unmarshal(block.Bytes[len(magic):], &sig); err != nil {
+		return sig, nil, err
+	}
+	if sig.Version != 1 {
+		return sig, nil, fmt.Errorf("Unsupported SSH signature version %d", sig.Version)
+	}
+	if sig.Namespace != Namespace {
+		return sig, nil, fmt.Errorf("SSH signature is made for namespace %q instead of %q", sig.Namespace, Namespace)
+	}
+	key, err = ssh.ParsePublicKey(sig.PublicKey)
+	return sig, key, err
+}
+
+func check(sig envelope, key ssh.PublicKey, message []byte) error {
+	var h hash.Hash
+	switch sig.Hash {
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	default:
+		return fmt.Errorf("Unsupported hash algorithm %s", sig.Hash)
+	}
+	h.Write(message)
+	blob := new(ssh.Signature)
+	if err := ssh.Unmarshal(sig.Signature, blob); err != nil {
+		return err
+	}
+	data := append([]byte(magic), ssh.Marshal(signedData{
+		Namespace: sig.Namespace,
+		Reserved:  sig.Reserved,
+		Hash:      sig.Hash,
+		Digest:    h.Sum(nil),
+	})...)
+	return key.Verify(data, blob)
+}
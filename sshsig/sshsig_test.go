@@ -0,0 +1,62 @@
+package sshsig
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/pem"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func sign(t *testing.T, signer ssh.Signer, namespace, message string) string {
+	digest := sha512.Sum512([]byte(message))
+	data := append([]byte(magic), ssh.Marshal(signedData{Namespace: namespace, Hash: "sha512", Digest: digest[:]})...)
+	sig, err := signer.Sign(rand.Reader, data)
+	if err != nil {
+		t.Fatalf("Failed to sign message: %v", err)
+	}
+	blob := append([]byte(magic), ssh.Marshal(envelope{
+		Version:   1,
+		PublicKey: signer.PublicKey().Marshal(),
+		Namespace: namespace,
+		Hash:      "sha512",
+		Signature: ssh.Marshal(sig),
+	})...)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "SSH SIGNATURE", Bytes: blob}))
+}
+
+func TestCheck(t *testing.T) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatalf("Failed to create signer: %v", err)
+	}
+	tests := []struct {
+		name      string
+		signature string
+		message   string
+		wantErr   bool
+	}{
+		{"TestCheck-1", sign(t, signer, Namespace, "challenge"), "challenge", false},
+		{"TestCheck-2", sign(t, signer, Namespace, "challenge"), "another challenge", true},
+		{"TestCheck-3", sign(t, signer, "file", "challenge"), "challenge", true},
+		{"TestCheck-4", "-----BEGIN PGP SIGNATURE-----", "challenge", true},
+		// TODO: Add test cases.
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sig, key, err := parse(tt.signature)
+			if err == nil {
+				err = check(sig, key, []byte(tt.message))
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("check() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -24,6 +24,7 @@ import (
 
 	"code.cloudfoundry.org/archiver/extractor"
 	"github.com/jhoonb/archivex"
+	"github.com/subutai-io/cdn/auth"
 	"github.com/subutai-io/cdn/config"
 	"github.com/subutai-io/cdn/db"
 	"github.com/subutai-io/cdn/download"
@@ -155,8 +156,6 @@ func Upload(w http.ResponseWriter, r *http.Request) {
 			}
 			log.Info("Deleting uploaded template")
 			if db.Delete(owner, "template", md5) < 1 {
-				f, _ := os.Stat(config.Storage.Path + md5)
-				db.QuotaUsageSet(owner, -int(f.Size()))
 				os.Remove(config.Storage.Path + md5)
 			}
 			return
@@ -172,24 +171,36 @@ func Upload(w http.ResponseWriter, r *http.Request) {
 				}
 			}
 		}
-		db.Write(owner, t.ID, filename, map[string]string{
-			"type":           "template",
-			"arch":           t.Architecture,
-			"md5":            md5,
-			"sha256":         sha256,
-			"tags":           strings.Join(t.Tags, ","),
-			"parent":         t.Parent,
-			"parent-version": t.ParentVersion,
-			"parent-owner":   t.ParentOwner,
-			"version":        t.Version,
-			"prefsize":       t.Prefsize,
-			"Description":    t.Description,
-		})
-		if len(r.MultipartForm.Value["private"]) > 0 && r.MultipartForm.Value["private"][0] == "true" {
-			log.Info("Sharing " + t.ID + " with " + owner)
-			db.MakePrivate(t.ID, owner)
-		} else {
-			db.MakePublic(t.ID, owner)
+		artifact := db.Artifact{
+			ID:    t.ID,
+			Name:  filename,
+			Owner: owner,
+			Repo:  "template",
+			Info: map[string]string{
+				"arch":           t.Architecture,
+				"md5":            md5,
+				"sha256":         sha256,
+				"tags":           strings.Join(t.Tags, ","),
+				"parent":         t.Parent,
+				"parent-version": t.ParentVersion,
+				"parent-owner":   t.ParentOwner,
+				"version":        t.Version,
+				"prefsize":       t.Prefsize,
+				"Description":    t.Description,
+			},
+			Private: len(r.MultipartForm.Value["private"]) > 0 && r.MultipartForm.Value["private"][0] == "true",
+		}
+		if f, err := os.Stat(config.Storage.Path + md5); err == nil {
+			artifact.Size = int(f.Size())
+		}
+		if err := db.Register(artifact); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Failed to register template"))
+			// Content may be shared with templates uploaded before, it's removed only if nothing refers to it
+			if db.CountMd5(md5) == 0 {
+				os.Remove(config.Storage.Path + md5)
+			}
+			return
 		}
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte(t.ID))
@@ -301,7 +312,7 @@ func Tag(w http.ResponseWriter, r *http.Request) {
 		if r.ParseMultipartForm(32<<20) != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 		}
-		if code, err := addTag(r.MultipartForm.Value); err != nil {
+		if code, err := addTag(auth.RequestOwner(r), r.MultipartForm.Value); err != nil {
 			w.WriteHeader(code)
 			if _, err = w.Write([]byte(err.Error())); err != nil {
 				log.Warn("Failed to write HTTP response")
@@ -311,7 +322,7 @@ func Tag(w http.ResponseWriter, r *http.Request) {
 		if r.ParseMultipartForm(32<<20) != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 		}
-		if code, err := delTag(r.MultipartForm.Value); err != nil {
+		if code, err := delTag(auth.RequestOwner(r), r.MultipartForm.Value); err != nil {
 			w.WriteHeader(code)
 			if _, err = w.Write([]byte(err.Error())); err != nil {
 				log.Warn("Failed to write HTTP response")
@@ -326,55 +337,47 @@ func Tag(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func addTag(values map[string][]string) (int, error) {
-	if len(values["token"]) > 0 {
-		if user := db.TokenOwner(values["token"][0]); len(values["token"][0]) == 0 || len(user) == 0 {
-			return http.StatusUnauthorized, fmt.Errorf("Failed to authorize using provided token")
-		} else if len(values["id"]) > 0 && len(values["tags"]) > 0 {
-			if db.CheckRepo(user, []string{"template"}, values["id"][0]) > 0 {
-				db.Write(user, values["id"][0], "", map[string]string{"tags": values["tags"][0]})
-				return http.StatusOK, nil
-			}
+func addTag(user string, values map[string][]string) (int, error) {
+	if len(user) == 0 {
+		return http.StatusUnauthorized, fmt.Errorf("Failed to authorize using provided token")
+	} else if len(values["id"]) > 0 && len(values["tags"]) > 0 {
+		if db.CheckRepo(user, []string{"template"}, values["id"][0]) > 0 {
+			db.Write(user, values["id"][0], "", map[string]string{"tags": values["tags"][0]})
+			return http.StatusOK, nil
 		}
 	}
 	return http.StatusBadRequest, fmt.Errorf("Bad request")
 }
 
-func delTag(values map[string][]string) (int, error) {
-	if len(values["token"]) > 0 {
-		if user := db.TokenOwner(values["token"][0]); len(values["token"][0]) == 0 || len(user) == 0 {
-			return http.StatusUnauthorized, fmt.Errorf("Failed to authorize using provided token")
-		} else if len(values["id"]) > 0 && len(values["tags"]) > 0 {
-			if db.CheckRepo(user, []string{"template"}, values["id"][0]) > 0 {
-				db.RemoveTags(values["id"][0], values["tags"][0])
-				return http.StatusOK, nil
-			}
+func delTag(user string, values map[string][]string) (int, error) {
+	if len(user) == 0 {
+		return http.StatusUnauthorized, fmt.Errorf("Failed to authorize using provided token")
+	} else if len(values["id"]) > 0 && len(values["tags"]) > 0 {
+		if db.CheckRepo(user, []string{"template"}, values["id"][0]) > 0 {
+			db.RemoveTags(values["id"][0], values["tags"][0])
+			return http.StatusOK, nil
 		}
 	}
 	return http.StatusBadRequest, fmt.Errorf("Bad request")
 }
 
 func ModifyConfig(w http.ResponseWriter, r *http.Request) {
-	token := strings.ToLower(r.URL.Query().Get("token"))
 	name := r.URL.Query().Get("name")
-	owner := strings.ToLower(db.TokenOwner(token))
-	if len(token) == 0 || len(owner) == 0 {
+	owner := strings.ToLower(auth.RequestOwner(r))
+	if len(owner) == 0 {
 		w.WriteHeader(http.StatusUnauthorized)
 		w.Write([]byte("Not authorized"))
-		log.Warn(r.RemoteAddr + " - rejecting unauthorized owner request")
+		log.Warn(utils.ClientIP(r) + " - rejecting unauthorized owner request")
 		return
 	}
 	if owner != "subutai" {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte("Only allowed users can update template config"))
-		log.Warn(r.RemoteAddr + " - rejecting update request")
+		log.Warn(utils.ClientIP(r) + " - rejecting update request")
 		return
 	}
-	list := db.SearchName(name)
+	list := utils.Intersect(db.RepoFiles("template"), db.SearchName(name))
 	for _, k := range list {
-		if db.CheckRepo("", []string{"template"}, k) == 0 {
-			continue
-		}
 
 		item := download.FormatItem(db.Info(k), "template")
 		md5 := item.Hash.Md5
@@ -569,8 +572,10 @@ func allFieldsPresent(templateData *download.ListItem) (bool, string) {
 	return true, ""
 }
 
+// isParentExist looks for parent among templates of parent owner, version index can't be used here
+// because it is keyed by file name while parent is referred to by template name
 func isParentExist(templateData *download.ListItem) (bool, string) {
-	list := db.SearchName(templateData.Parent)
+	list := db.OwnerFiles("template", templateData.ParentOwner)
 	for _, id := range list {
 		item := download.FormatItem(db.Info(id), "template")
 		if len(item.Owner) == 0 {
@@ -0,0 +1,71 @@
+package template
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/subutai-io/cdn/config"
+	"github.com/subutai-io/cdn/db"
+	"github.com/subutai-io/cdn/download"
+)
+
+func TestIsValidTemplate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "template")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Empty database is restored into temporary directory, so the test doesn't touch configured one
+	empty, err := bolt.Open(filepath.Join(dir, "empty.db"), 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	empty.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{db.MyBucket, db.SearchIndex, db.Users} {
+			tx.CreateBucketIfNotExists(b)
+		}
+		return nil
+	})
+	empty.Close()
+	config.DB.Path, config.Storage.Path = filepath.Join(dir, "my.db"), dir+"/"
+	if err = db.Restore(filepath.Join(dir, "empty.db")); err != nil {
+		t.Fatal(err)
+	}
+	err = db.Register(db.Artifact{
+		ID:    "6a7e1e3a-0c5b-4a55-a0d8-5f6e8f1c2b91",
+		Name:  "master-subutai-template_4.0.0_amd64.tar.gz",
+		Owner: "subutai",
+		Repo:  "template",
+		Info:  map[string]string{"version": "4.0.0", "parent": "master", "parent-owner": "subutai", "parent-version": "4.0.0"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	child := func(parent, owner, version string) *download.ListItem {
+		return &download.ListItem{Name: "nginx", Owner: []string{"jdoe"}, Version: "1.0.0",
+			Parent: parent, ParentOwner: owner, ParentVersion: version}
+	}
+	tests := []struct {
+		name    string
+		item    *download.ListItem
+		valid   bool
+		message string
+	}{
+		{"TestIsValidTemplate-1", child("master", "subutai", "4.0.0"), true, ""},
+		{"TestIsValidTemplate-2", child("master", "subutai", "4.0.1"), false, "loop detected"},
+		{"TestIsValidTemplate-3", child("master", "jdoe", "4.0.0"), false, "loop detected"},
+		{"TestIsValidTemplate-4", child("debian", "subutai", "4.0.0"), false, "loop detected"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if valid, message := isValidTemplate(tt.item, "jdoe"); valid != tt.valid || message != tt.message {
+				t.Errorf("isValidTemplate() = %v, %q, want %v, %q", valid, message, tt.valid, tt.message)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package upload
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/subutai-io/agent/log"
+	"github.com/subutai-io/cdn/auth"
+	"github.com/subutai-io/cdn/config"
+	"github.com/subutai-io/cdn/db"
+	"github.com/subutai-io/cdn/utils"
+)
+
+type trashItem struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Repo      string    `json:"repo"`
+	Owner     []string  `json:"owner"`
+	Trashed   time.Time `json:"trashed"`
+	TrashedBy string    `json:"trashed-by"`
+	Expires   time.Time `json:"expires"`
+}
+
+// Restored keeps functions called with ID of file restored from trash by repo of the file. Repos which
+// publish indexes of their files register them, so restored files appear in indexes again.
+var Restored = map[string]func(id string){}
+
+// retention returns how long deleted files are kept in trash
+func retention() time.Duration {
+	return time.Duration(config.Storage.Trashretention) * time.Hour
+}
+
+// trashAccess returns true if user may see and restore file in trash: owners of file and administrators
+func trashAccess(user, id string) bool {
+	return user == "subutai" || user == "Hub" || utils.In([]string{strings.ToLower(user)}, db.FileField(id, "owner"))
+}
+
+// Trash lists deleted files which can be restored by authorized user, optionally filtered by repo
+func Trash(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Incorrect method"))
+		return
+	}
+	user := auth.RequestOwner(r)
+	if len(user) == 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("Not authorized"))
+		return
+	}
+	repo := r.URL.Query().Get("repo")
+	items := []trashItem{}
+	for id, date := range db.TrashedFiles() {
+		if !trashAccess(user, id) || len(repo) != 0 && db.CheckRepo("", []string{repo}, id) == 0 {
+			continue
+		}
+		info := db.Info(id)
+		items = append(items, trashItem{
+			ID:        id,
+			Name:      info["name"],
+			Repo:      db.CheckRepoOfHash(id),
+			Owner:     db.FileField(id, "owner"),
+			Trashed:   date,
+			TrashedBy: info["trashed-by"],
+			Expires:   date.Add(retention()),
+		})
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Trashed.After(items[j].Trashed) })
+	js, _ := json.Marshal(items)
+	w.Write(js)
+}
+
+// Restore returns file from trash to its repo
+func Restore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Incorrect method"))
+		return
+	}
+	user := auth.RequestOwner(r)
+	if len(user) == 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("Not authorized"))
+		return
+	}
+	id := r.FormValue("id")
+	if len(id) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Empty file id"))
+		return
+	}
+	if !db.Trashed(id) || !trashAccess(user, id) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("File not found in trash"))
+		return
+	}
+	if log.Check(log.WarnLevel, "Restoring "+id+" from trash", db.RestoreFile(id)) {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Failed to restore file"))
+		return
+	}
+	log.Info("File " + db.NameByHash(id) + " is restored from trash by " + user)
+	if restored, ok := Restored[db.CheckRepoOfHash(id)]; ok {
+		restored(id)
+	}
+	w.Write([]byte(id))
+}
+
+// PurgeTrash removes files which stay in trash longer than configured retention period
+func PurgeTrash() {
+	for id, date := range db.TrashedFiles() {
+		if time.Since(date) < retention() {
+			continue
+		}
+		owner := db.FileField(id, "owner")
+		if len(owner) == 0 {
+			continue
+		}
+		log.Info("Purging " + db.NameByHash(id) + " deleted at " + date.Format(time.RFC3339))
+		Remove(owner[0], db.CheckRepoOfHash(id), id)
+	}
+}
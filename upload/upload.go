@@ -14,8 +14,10 @@ import (
 	"strings"
 
 	"github.com/subutai-io/agent/log"
+	"github.com/subutai-io/cdn/auth"
 	"github.com/subutai-io/cdn/config"
 	"github.com/subutai-io/cdn/db"
+	"github.com/subutai-io/cdn/utils"
 )
 
 type share struct {
@@ -28,14 +30,13 @@ type share struct {
 
 // Handler function works with income upload requests, makes sanity checks, etc
 func Handler(w http.ResponseWriter, r *http.Request) (md5sum, sha256sum, owner string) {
-	token := strings.ToLower(r.Header.Get("token"))
-	owner = strings.ToLower(db.TokenOwner(token))
-	log.Debug(fmt.Sprintf("Upload request: %+v"))
-	log.Debug(fmt.Sprintf("token: %+v, owner: %+v", token, owner))
-	if len(token) == 0 || len(owner) == 0 {
+	owner = strings.ToLower(auth.RequestOwner(r))
+	log.Debug(fmt.Sprintf("Upload request: %+v", r.URL))
+	log.Debug(fmt.Sprintf("owner: %+v", owner))
+	if len(owner) == 0 {
 		w.WriteHeader(http.StatusUnauthorized)
 		w.Write([]byte("Not authorized"))
-		log.Warn(r.RemoteAddr + " - rejecting unauthorized upload request")
+		log.Warn(utils.ClientIP(r) + " - rejecting unauthorized upload request")
 		return
 	}
 	repo := strings.Split(r.URL.EscapedPath(), "/")
@@ -82,9 +83,6 @@ func Handler(w http.ResponseWriter, r *http.Request) (md5sum, sha256sum, owner s
 		log.Warn("User " + owner + " exceeded storage quota, removing file")
 		os.Remove(config.Storage.Path + header.Filename)
 		return
-	} else {
-		db.QuotaUsageSet(owner, int(copied))
-		log.Info("User " + owner + ", quota usage +" + strconv.Itoa(int(copied)))
 	}
 	md5sum = Hash(config.Storage.Path + header.Filename)
 	sha256sum = Hash(config.Storage.Path+header.Filename, "sha256")
@@ -125,18 +123,17 @@ func Hash(file string, algo ...string) string {
 
 func Delete(w http.ResponseWriter, r *http.Request) string {
 	id := r.URL.Query().Get("id")
-	token := strings.ToLower(r.URL.Query().Get("token"))
 	if len(id) == 0 {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte("Empty file id"))
-		log.Warn(r.RemoteAddr + " - empty file id")
+		log.Warn(utils.ClientIP(r) + " - empty file id")
 		return ""
 	}
-	user := db.TokenOwner(token)
-	if len(token) == 0 || len(user) == 0 {
+	user := auth.RequestOwner(r)
+	if len(user) == 0 {
 		w.WriteHeader(http.StatusUnauthorized)
 		w.Write([]byte("Failed to authorize using provided token"))
-		log.Warn(r.RemoteAddr + " - Failed to authorize using provided token")
+		log.Warn(utils.ClientIP(r) + " - Failed to authorize using provided token")
 		return ""
 	}
 	info := db.Info(id)
@@ -160,35 +157,55 @@ func Delete(w http.ResponseWriter, r *http.Request) string {
 		w.Write([]byte("File " + info["name"] + " not found or it has different owner"))
 		return ""
 	}
-	user = db.FileField(id, "owner")[0]
+	purge := r.URL.Query().Get("purge") == "true"
+	if db.Trashed(id) && !purge {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("File " + info["name"] + " is already in trash"))
+		return ""
+	}
+	if config.Storage.Trashretention > 0 && !purge {
+		if log.Check(log.WarnLevel, "Moving "+info["name"]+" to trash", db.TrashFile(id, user)) {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Failed to remove file"))
+			return ""
+		}
+		log.Info("Moving " + info["name"] + " from " + repo[3] + " repo to trash")
+		return id
+	}
+	if Remove(db.FileField(id, "owner")[0], repo[3], id) != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Failed to remove file"))
+		return ""
+	}
+	log.Info("Removing " + info["name"] + " from " + repo[3] + " repo")
+	return id
+}
 
+// Remove deletes record about file and, if no other records refer to it, its content. Quota usage of owner is decreased.
+// Content of apt packages is stored under package file name, content of other files under their MD5.
+func Remove(user, repo, id string) error {
+	info := db.Info(id)
 	md5, _ := db.Hash(id)
-	f, err := os.Stat(config.Storage.Path + md5)
+	blob := md5
+	if repo == "apt" {
+		if blob = info["Filename"]; len(blob) == 0 {
+			blob = info["name"]
+		}
+	}
+	f, err := os.Stat(config.Storage.Path + blob)
 	if !log.Check(log.WarnLevel, "Reading file stats", err) {
 		db.QuotaUsageSet(user, -int(f.Size()))
 		log.Info("User " + user + ", quota usage -" + strconv.Itoa(int(f.Size())))
 	}
-	db.Delete(user, repo[3], id)
-	if db.CountMd5(md5) == 0 && repo[3] != "apt" {
+	db.Delete(user, repo, id)
+	if len(blob) != 0 && db.CountMd5(md5) == 0 {
 		log.Warn("Removing " + id + " from disk")
 		// torrent.Delete(id)
-		if log.Check(log.WarnLevel, "Removing "+info["name"]+"from disk", os.Remove(config.Storage.Path+md5)) {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte("Failed to remove file"))
-			return ""
+		if err := os.Remove(config.Storage.Path + blob); log.Check(log.WarnLevel, "Removing "+info["name"]+" from disk", err) {
+			return err
 		}
 	}
-
-	if repo[3] == "apt" && db.CountMd5(info["md5"]) == 0 {
-		if log.Check(log.WarnLevel, "Removing "+info["name"]+"from disk", os.Remove(config.Storage.Path+info["Filename"])) {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte("Failed to remove file"))
-			return ""
-		}
-	}
-
-	log.Info("Removing " + info["name"] + " from " + repo[3] + " repo")
-	return id
+	return nil
 }
 
 // Share receives HTTP Request of type application/json and handles it
@@ -229,7 +246,11 @@ func Share(w http.ResponseWriter, r *http.Request) {
 				}
 			}
 		}
-		if len(data.Token) == 0 || len(db.TokenOwner(data.Token)) == 0 {
+		owner := strings.ToLower(auth.RequestOwner(r))
+		if len(data.Token) != 0 {
+			owner = strings.ToLower(auth.TokenOwner(data.Token))
+		}
+		if len(owner) == 0 {
 			w.WriteHeader(http.StatusUnauthorized)
 			w.Write([]byte("Not authorized"))
 			log.Warn("Empty or invalid token, rejecting share request")
@@ -247,7 +268,6 @@ func Share(w http.ResponseWriter, r *http.Request) {
 			log.Warn("Empty repo name, rejecting share request")
 			return
 		}
-		owner := strings.ToLower(db.TokenOwner(data.Token))
 		if db.CheckRepo(owner, []string{data.Repo}, data.Id) == 0 {
 			w.WriteHeader(http.StatusForbidden)
 			w.Write([]byte("File is not owned by authorized user"))
@@ -269,13 +289,12 @@ func Share(w http.ResponseWriter, r *http.Request) {
 			w.Write([]byte("Empty file id"))
 			return
 		}
-		token := strings.ToLower(r.URL.Query().Get("token"))
-		if len(token) == 0 || len(db.TokenOwner(token)) == 0 {
+		owner := auth.RequestOwner(r)
+		if len(owner) == 0 {
 			w.WriteHeader(http.StatusUnauthorized)
 			w.Write([]byte("Not authorized"))
 			return
 		}
-		owner := db.TokenOwner(token)
 		repo := r.URL.Query().Get("repo")
 		if len(repo) == 0 {
 			w.WriteHeader(http.StatusUnauthorized)
@@ -305,9 +324,9 @@ func Quota(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "GET" {
 		user := r.URL.Query().Get("user")
 		fix := r.URL.Query().Get("fix")
-		token := strings.ToLower(r.URL.Query().Get("token"))
+		owner := auth.RequestOwner(r)
 
-		if len(token) == 0 || len(db.TokenOwner(token)) == 0 || db.TokenOwner(token) != "Hub" && !strings.EqualFold(db.TokenOwner(token), user) {
+		if len(owner) == 0 || owner != "Hub" && !strings.EqualFold(owner, user) {
 			w.Write([]byte("Forbidden"))
 			w.WriteHeader(http.StatusForbidden)
 			return
@@ -328,9 +347,9 @@ func Quota(w http.ResponseWriter, r *http.Request) {
 	} else if r.Method == "POST" {
 		user := r.FormValue("user")
 		quota := r.FormValue("quota")
-		token := r.FormValue("token")
+		owner := auth.RequestOwner(r)
 
-		if len(token) == 0 || len(db.TokenOwner(token)) == 0 || db.TokenOwner(token) != "Hub" && db.TokenOwner(token) != "subutai" {
+		if len(owner) == 0 || owner != "Hub" && owner != "subutai" {
 			w.Write([]byte("Forbidden"))
 			w.WriteHeader(http.StatusForbidden)
 			return
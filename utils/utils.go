@@ -1,5 +1,13 @@
 package utils
 
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/subutai-io/cdn/config"
+)
+
 func ProcessVersion(version string) string {
 	if version == "latest" {
 		return ""
@@ -47,3 +55,111 @@ func Union(listA []string, listB []string) []string {
 	listA = append(listA, listB[:]...)
 	return Unique(listA)
 }
+
+// Set returns items of list as map for membership checks
+func Set(list []string) map[string]bool {
+	set := make(map[string]bool, len(list))
+	for _, v := range list {
+		set[v] = true
+	}
+	return set
+}
+
+// ClientIP returns address of the client which sent request. X-Forwarded-For header is honoured only when
+// the request comes from one of configured trusted proxies, the chain of addresses is walked from the nearest
+// hop and the first address which doesn't belong to trusted proxy is returned.
+func ClientIP(r *http.Request) string {
+	addr := host(r.RemoteAddr)
+	if !trusted(addr) {
+		return addr
+	}
+	chain := forwarded(r)
+	for i := len(chain) - 1; i >= 0; i-- {
+		addr = host(chain[i])
+		if !trusted(addr) {
+			break
+		}
+	}
+	return addr
+}
+
+// Local returns true if request is sent from the same host, either directly or through trusted proxy.
+// Requests carrying forwarding headers are never local unless they come from trusted proxy.
+func Local(r *http.Request) bool {
+	if !trusted(host(r.RemoteAddr)) && (len(r.Header["X-Forwarded-For"]) != 0 || len(r.Header["Forwarded"]) != 0) {
+		return false
+	}
+	ip := net.ParseIP(ClientIP(r))
+	return ip != nil && ip.IsLoopback()
+}
+
+// forwarded returns list of client addresses from X-Forwarded-For header or, if there is no such header, from "for"
+// parameters of standard Forwarded header (RFC 7239). X-Forwarded-For takes precedence, because proxies which set it
+// usually pass Forwarded header sent by client unchanged.
+func forwarded(r *http.Request) (chain []string) {
+	for _, header := range r.Header["X-Forwarded-For"] {
+		for _, item := range strings.Split(header, ",") {
+			if item = strings.TrimSpace(item); len(item) != 0 {
+				chain = append(chain, item)
+			}
+		}
+	}
+	if len(chain) != 0 {
+		return
+	}
+	for _, header := range r.Header["Forwarded"] {
+		for _, element := range splitQuoted(header, ',') {
+			for _, pair := range splitQuoted(element, ';') {
+				if kv := strings.SplitN(strings.TrimSpace(pair), "=", 2); len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+					// Quoted value may contain port and bracketed IPv6 address, like "[2001:db8::1]:4711"
+					chain = append(chain, strings.Trim(strings.TrimSpace(kv[1]), `"`))
+				}
+			}
+		}
+	}
+	return
+}
+
+// splitQuoted splits header value by separator which is not inside quoted string
+func splitQuoted(value string, sep rune) (list []string) {
+	quoted, escaped, start := false, false, 0
+	for i, c := range value {
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && c == '\\':
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case c == sep && !quoted:
+			list = append(list, value[start:i])
+			start = i + 1
+		}
+	}
+	return append(list, value[start:])
+}
+
+// host strips port and IPv6 brackets from address
+func host(addr string) string {
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		return h
+	}
+	return strings.Trim(addr, "[]")
+}
+
+func trusted(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, proxy := range config.Network.Trustedproxy {
+		if _, subnet, err := net.ParseCIDR(proxy); err == nil {
+			if subnet.Contains(ip) {
+				return true
+			}
+		} else if p := net.ParseIP(proxy); p != nil && p.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,8 +1,11 @@
 package utils
 
 import (
+	"net/http/httptest"
 	"testing"
 	"reflect"
+
+	"github.com/subutai-io/cdn/config"
 )
 
 func TestIn(t *testing.T) {
@@ -103,6 +106,25 @@ func Test_union(t *testing.T) {
 	}
 }
 
+func TestSet(t *testing.T) {
+	tests := []struct {
+		name string
+		list []string
+		want map[string]bool
+	}{
+		{"TestSet-1", []string{"in", "out", "in"}, map[string]bool{"in": true, "out": true}},
+		{"TestSet-2", []string(nil), map[string]bool{}},
+		// TODO: Add test cases.
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Set(tt.list); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Set() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 func Test_processVersion(t *testing.T) {
 	type args struct {
 		version string
@@ -126,3 +148,77 @@ func Test_processVersion(t *testing.T) {
 	}
 }
 
+func TestClientIP(t *testing.T) {
+	saved := config.Network.Trustedproxy
+	defer func() { config.Network.Trustedproxy = saved }()
+	config.Network.Trustedproxy = []string{"127.0.0.1", "10.0.0.0/8"}
+
+	type args struct {
+		remote  string
+		headers map[string]string
+	}
+	tests := []struct {
+		name string
+		args args
+		want string
+	}{
+		{"TestClientIP-1", args{"192.0.2.1:1234", nil}, "192.0.2.1"},
+		{"TestClientIP-2", args{"192.0.2.1:1234", map[string]string{"X-Forwarded-For": "127.0.0.1"}}, "192.0.2.1"},
+		{"TestClientIP-3", args{"127.0.0.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.7, 10.1.1.1"}}, "198.51.100.7"},
+		{"TestClientIP-4", args{"127.0.0.1:1234", map[string]string{"X-Forwarded-For": "127.0.0.1, 198.51.100.7"}}, "198.51.100.7"},
+		{"TestClientIP-5", args{"127.0.0.1:1234", map[string]string{"Forwarded": `for="[2001:db8::1]:4711";proto=https, for=10.0.0.2`}}, "2001:db8::1"},
+		{"TestClientIP-6", args{"127.0.0.1:1234", nil}, "127.0.0.1"},
+		{"TestClientIP-7", args{"[::1]:1234", nil}, "::1"},
+		{"TestClientIP-8", args{"127.0.0.1:1234", map[string]string{"Forwarded": `For="198.51.100.7:8080"`}}, "198.51.100.7"},
+		{"TestClientIP-9", args{"192.0.2.1:1234", map[string]string{"Forwarded": "for=198.51.100.7"}}, "192.0.2.1"},
+		{"TestClientIP-10", args{"127.0.0.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.7", "Forwarded": "for=203.0.113.9"}}, "198.51.100.7"},
+		{"TestClientIP-11", args{"127.0.0.1:1234", map[string]string{"Forwarded": `for=unknown;by=10.0.0.1, for="[2001:db8::2]"`}}, "2001:db8::2"},
+		{"TestClientIP-12", args{"127.0.0.1:1234", map[string]string{"Forwarded": `for="198.51.100.7";host="a,b", for=10.0.0.3`}}, "198.51.100.7"},
+		// TODO: Add test cases.
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.args.remote
+			for k, v := range tt.args.headers {
+				r.Header.Set(k, v)
+			}
+			if got := ClientIP(r); got != tt.want {
+				t.Errorf("ClientIP() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLocal(t *testing.T) {
+	saved := config.Network.Trustedproxy
+	defer func() { config.Network.Trustedproxy = saved }()
+	config.Network.Trustedproxy = []string{"10.0.0.1"}
+
+	tests := []struct {
+		name    string
+		remote  string
+		headers map[string]string
+		want    bool
+	}{
+		{"TestLocal-1", "127.0.0.1:1234", nil, true},
+		{"TestLocal-2", "192.0.2.1:1234", nil, false},
+		{"TestLocal-3", "127.0.0.1:1234", map[string]string{"X-Forwarded-For": "127.0.0.1"}, false},
+		{"TestLocal-4", "127.0.0.1:1234", map[string]string{"Forwarded": "for=127.0.0.1"}, false},
+		{"TestLocal-5", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "127.0.0.1"}, true},
+		{"TestLocal-6", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "192.0.2.1", "Forwarded": "for=127.0.0.1"}, false},
+		{"TestLocal-7", "10.0.0.1:1234", map[string]string{"Forwarded": `for="127.0.0.1:5000"`}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remote
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			if got := Local(r); got != tt.want {
+				t.Errorf("Local() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}